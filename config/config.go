@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"os"
 
+	"github.com/ackhia/flash/models"
 	"gopkg.in/yaml.v3"
 )
 
@@ -31,19 +32,39 @@ func ReadBootstrapPeers(filename string) ([]string, error) {
 	return peers, nil
 }
 
-func ReadGenesis(filename string) (map[string]float64, error) {
+// ReadGenesis reads the starting balance of each peer. Balances are written
+// in whole coins with up to models.AmountDecimals decimal places, the same
+// format older float based genesis files used, and returned in base units.
+func ReadGenesis(filename string) (map[string]models.Amount, error) {
 	// Read the YAML file
 	data, err := os.ReadFile(filename)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read file: %w", err)
 	}
 
-	// Parse the YAML file into a map
-	var genMap map[string]float64
-	err = yaml.Unmarshal(data, &genMap)
+	// Parse the YAML file into a map. Values are read as text so they are
+	// never rounded through a float.
+	var rawMap map[string]string
+	err = yaml.Unmarshal(data, &rawMap)
 	if err != nil {
 		return nil, fmt.Errorf("failed to unmarshal YAML: %w", err)
 	}
 
+	genMap := make(map[string]models.Amount, len(rawMap))
+	var total models.Amount
+	for peerID, raw := range rawMap {
+		amount, err := models.ParseAmount(raw)
+		if err != nil {
+			return nil, fmt.Errorf("invalid balance for %s: %w", peerID, err)
+		}
+
+		total, err = total.Add(amount)
+		if err != nil {
+			return nil, fmt.Errorf("total coins in genesis: %w", err)
+		}
+
+		genMap[peerID] = amount
+	}
+
 	return genMap, nil
 }
@@ -1,11 +1,13 @@
 package crypto
 
 import (
+	"bytes"
 	"crypto/sha256"
 	"encoding/base64"
 	"fmt"
 	"log"
 	"os"
+	"sort"
 
 	"github.com/ackhia/flash/models"
 	"github.com/libp2p/go-libp2p/core/crypto"
@@ -64,17 +66,15 @@ func ReadPrivateKey(filename string) (crypto.PrivKey, error) {
 }
 
 func hashTx(tx *models.Tx) []byte {
-	data := fmt.Sprintf("%d%s%s%f%X", tx.SequenceNum, tx.From, tx.To, tx.Amount, tx.Pubkey)
-	hash := sha256.Sum256([]byte(data))
+	hash := sha256.Sum256(models.EncodeTx(tx))
 
 	return hash[:]
 }
 
 func hashTxWithSig(tx *models.Tx) []byte {
-	data := fmt.Sprintf("%d%s%s%f%x%x", tx.SequenceNum, tx.From, tx.To, tx.Amount, tx.Sig, tx.Pubkey)
-	hash := sha256.Sum256([]byte(data))
+	id := tx.ID()
 
-	return hash[:]
+	return id[:]
 }
 
 func SignTx(tx *models.Tx, privKey crypto.PrivKey) error {
@@ -89,9 +89,20 @@ func SignTx(tx *models.Tx, privKey crypto.PrivKey) error {
 	return nil
 }
 
-func VerifyTxSig(tx models.Tx) (bool, error) {
-	//TODO: Check the from is derived from the pubkey
+// PeerIDFromPubkey derives the peer ID of a marshalled public key
+func PeerIDFromPubkey(pubKeyBytes []byte) (peer.ID, error) {
+	pubKey, err := crypto.UnmarshalPublicKey(pubKeyBytes)
+	if err != nil {
+		return "", fmt.Errorf("failed to unmarshal public key: %v", err)
+	}
 
+	return peer.IDFromPublicKey(pubKey)
+}
+
+// VerifyTxSig checks the tx was signed by the key in tx.Pubkey and that
+// tx.From is the peer ID of that key, so nobody can spend from an account
+// they don't hold the key for
+func VerifyTxSig(tx models.Tx) (bool, error) {
 	hash := hashTx(&tx)
 
 	pubKey, err := crypto.UnmarshalPublicKey(tx.Pubkey)
@@ -99,6 +110,15 @@ func VerifyTxSig(tx models.Tx) (bool, error) {
 		return false, fmt.Errorf("failed to unmarshal public key: %v", err)
 	}
 
+	signer, err := peer.IDFromPublicKey(pubKey)
+	if err != nil {
+		return false, fmt.Errorf("failed to derive peer ID: %v", err)
+	}
+
+	if signer.String() != tx.From {
+		return false, fmt.Errorf("from %s does not match the signing key %s", tx.From, signer)
+	}
+
 	result, err := pubKey.Verify(hash, tx.Sig)
 
 	if err != nil {
@@ -108,15 +128,172 @@ func VerifyTxSig(tx models.Tx) (bool, error) {
 	return result, nil
 }
 
-func VerifyVerifier(verifier *models.Verifier, tx *models.Tx, pubKey crypto.PubKey, p peer.ID) (bool, error) {
-	if verifier.ID != p.String() {
-		return false, nil
+// SignCancellation signs a cancellation with the sender's key
+func SignCancellation(c *models.Cancellation, privKey crypto.PrivKey) error {
+	hash := sha256.Sum256(models.EncodeCancellation(c))
+
+	sig, err := privKey.Sign(hash[:])
+	if err != nil {
+		return err
+	}
+
+	c.Sig = sig
+	return nil
+}
+
+// VerifyCancellationSig checks a cancellation was signed by the key in
+// c.Pubkey and that c.From is the peer ID of that key, so only the sender
+// can cancel its txs
+func VerifyCancellationSig(c *models.Cancellation) (bool, error) {
+	pubKey, err := crypto.UnmarshalPublicKey(c.Pubkey)
+	if err != nil {
+		return false, fmt.Errorf("failed to unmarshal public key: %v", err)
+	}
+
+	signer, err := peer.IDFromPublicKey(pubKey)
+	if err != nil {
+		return false, fmt.Errorf("failed to derive peer ID: %v", err)
+	}
+
+	if signer.String() != c.From {
+		return false, fmt.Errorf("from %s does not match the signing key %s", c.From, signer)
+	}
+
+	hash := sha256.Sum256(models.EncodeCancellation(c))
+	return pubKey.Verify(hash[:], c.Sig)
+}
+
+// VerifyVerifier checks the verifier's sig over tx using the public key it
+// carries, after checking the verifier's ID is derived from that key
+func VerifyVerifier(verifier *models.Verifier, tx *models.Tx) (bool, error) {
+	return verifySigner(verifier, hashTxWithSig(tx))
+}
+
+// verifySigner checks a verifier's sig over hash after checking its ID is
+// derived from the public key it carries
+func verifySigner(verifier *models.Verifier, hash []byte) (bool, error) {
+	pubKey, err := crypto.UnmarshalPublicKey(verifier.Pubkey)
+	if err != nil {
+		return false, fmt.Errorf("failed to unmarshal public key: %v", err)
+	}
+
+	id, err := peer.IDFromPublicKey(pubKey)
+	if err != nil {
+		return false, fmt.Errorf("failed to derive peer ID: %v", err)
+	}
+
+	if id.String() != verifier.ID {
+		return false, fmt.Errorf("verifier %s does not match its public key %s", verifier.ID, id)
 	}
 
-	hash := hashTxWithSig(tx)
 	return pubKey.Verify(hash, verifier.Sig)
 }
 
+// VerifyQuorumCertificate checks every verifier sig on tx and that the
+// verifiers hold more than half of the total weight. weights is normally the
+// balance of every account, which adds up to all the coins in existence.
+// It needs nothing but the tx so it can be used by any node or auditor.
+func VerifyQuorumCertificate(tx *models.Tx, weights map[string]models.Amount) error {
+	return verifyQuorum(tx.Verifiers, hashTxWithSig(tx), weights)
+}
+
+// VerifyCheckpointCertificate checks every signer of a checkpoint and that
+// they hold more than half of the total weight. weights must be the
+// balances of the checkpoint before it, or genesis for the first, so every
+// node checks it against the same weights.
+func VerifyCheckpointCertificate(cp *models.Checkpoint, weights map[string]models.Amount) error {
+	id := cp.ID()
+	return verifyQuorum(cp.Signers, id[:], weights)
+}
+
+func verifyQuorum(verifiers []models.Verifier, hash []byte, weights map[string]models.Amount) error {
+	var total models.Amount
+	for _, w := range weights {
+		var err error
+		total, err = total.Add(w)
+		if err != nil {
+			return fmt.Errorf("total weight: %v", err)
+		}
+	}
+
+	var signed models.Amount
+	seen := make(map[string]struct{})
+	for i := range verifiers {
+		v := &verifiers[i]
+		if _, ok := seen[v.ID]; ok {
+			return fmt.Errorf("verifier %s appears more than once", v.ID)
+		}
+		seen[v.ID] = struct{}{}
+
+		result, err := verifySigner(v, hash)
+		if err != nil {
+			return fmt.Errorf("verifier %s not valid: %v", v.ID, err)
+		}
+
+		if !result {
+			return fmt.Errorf("verifier %s has invalid sig", v.ID)
+		}
+
+		// Can't overflow as the weights were already summed
+		signed += weights[v.ID]
+	}
+
+	if signed <= total/2 {
+		return fmt.Errorf("verifier total balances was less than 50%% of available coins")
+	}
+
+	return nil
+}
+
+// CreateVerifier signs tx as a verifier and returns the signature with the
+// signing peer's ID and public key
+func CreateVerifier(tx *models.Tx, privKey crypto.PrivKey) (*models.Verifier, error) {
+	id, err := peer.IDFromPrivateKey(privKey)
+	if err != nil {
+		return nil, err
+	}
+
+	pubKey, err := crypto.MarshalPublicKey(privKey.GetPublic())
+	if err != nil {
+		return nil, err
+	}
+
+	sig, err := CreateVerifyerSig(tx, privKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &models.Verifier{ID: id.String(), Pubkey: pubKey, Sig: sig}, nil
+}
+
+// CreateCheckpointSigner signs a checkpoint's ID and returns the signature
+// with the signing peer's ID and public key
+func CreateCheckpointSigner(cp *models.Checkpoint, privKey crypto.PrivKey) (*models.Verifier, error) {
+	id, err := peer.IDFromPrivateKey(privKey)
+	if err != nil {
+		return nil, err
+	}
+
+	pubKey, err := crypto.MarshalPublicKey(privKey.GetPublic())
+	if err != nil {
+		return nil, err
+	}
+
+	cpID := cp.ID()
+	sig, err := privKey.Sign(cpID[:])
+	if err != nil {
+		return nil, err
+	}
+
+	return &models.Verifier{ID: id.String(), Pubkey: pubKey, Sig: sig}, nil
+}
+
+// VerifyCheckpointSigner checks one signer's sig over a checkpoint
+func VerifyCheckpointSigner(signer *models.Verifier, cp *models.Checkpoint) (bool, error) {
+	id := cp.ID()
+	return verifySigner(signer, id[:])
+}
+
 func CreateVerifyerSig(tx *models.Tx, privKey crypto.PrivKey) ([]byte, error) {
 	hash := hashTxWithSig(tx)
 	sig, err := privKey.Sign(hash)
@@ -126,3 +303,58 @@ func CreateVerifyerSig(tx *models.Tx, privKey crypto.PrivKey) ([]byte, error) {
 
 	return sig, nil
 }
+
+// VerifyEquivocationProof checks that both txs in the proof were signed by
+// the sender and that they are different txs for the same sequence number
+func VerifyEquivocationProof(proof *models.EquivocationProof) error {
+	first, second := &proof.First, &proof.Second
+
+	if first.From != second.From || first.SequenceNum != second.SequenceNum {
+		return fmt.Errorf("txs are for different senders or sequence numbers")
+	}
+
+	if bytes.Equal(hashTx(first), hashTx(second)) {
+		return fmt.Errorf("txs are identical")
+	}
+
+	for _, tx := range []*models.Tx{first, second} {
+		result, err := VerifyTxSig(*tx)
+		if err != nil {
+			return fmt.Errorf("could not verify tx sig: %v", err)
+		}
+
+		if !result {
+			return fmt.Errorf("tx has invalid sig")
+		}
+	}
+
+	return nil
+}
+
+// DoubleSigners returns the IDs of the verifiers with a valid sig on both
+// txs in an equivocation proof. The proof itself must already be checked.
+func DoubleSigners(proof *models.EquivocationProof) []string {
+	signedFirst := make(map[string]struct{})
+	for i := range proof.First.Verifiers {
+		v := &proof.First.Verifiers[i]
+		if ok, err := VerifyVerifier(v, &proof.First); err == nil && ok {
+			signedFirst[v.ID] = struct{}{}
+		}
+	}
+
+	var signers []string
+	for i := range proof.Second.Verifiers {
+		v := &proof.Second.Verifiers[i]
+		if _, ok := signedFirst[v.ID]; !ok {
+			continue
+		}
+
+		if ok, err := VerifyVerifier(v, &proof.Second); err == nil && ok {
+			signers = append(signers, v.ID)
+			delete(signedFirst, v.ID)
+		}
+	}
+	sort.Strings(signers)
+
+	return signers
+}
@@ -36,8 +36,13 @@ func TestSignVerify(t *testing.T) {
 		t.Fatal("Could not get public key")
 	}
 
+	senderID, err := peer.IDFromPublicKey(pubSender)
+	if err != nil {
+		t.Fatal("Could not derive peer ID")
+	}
+
 	tx := models.Tx{
-		From:   "Me",
+		From:   senderID.String(),
 		To:     "You",
 		Amount: 25,
 		Pubkey: pubKeyBytes,
@@ -72,12 +77,18 @@ func TestSignVerify(t *testing.T) {
 		return
 	}
 
+	verifierKeyBytes, err := crypto.MarshalPublicKey(pubVerifier)
+	if err != nil {
+		t.Fatal("Could not get public key")
+	}
+
 	ver := models.Verifier{
-		ID:  peerID.String(),
-		Sig: sig,
+		ID:     peerID.String(),
+		Pubkey: verifierKeyBytes,
+		Sig:    sig,
 	}
 
-	ok, err := VerifyVerifier(&ver, &tx, pubVerifier, peerID)
+	ok, err := VerifyVerifier(&ver, &tx)
 	if err != nil {
 		t.Fatal("Verify failed to calculate")
 	}
@@ -86,3 +97,315 @@ func TestSignVerify(t *testing.T) {
 		t.Fatal("Verify failed")
 	}
 }
+
+func TestVerifyEquivocationProof(t *testing.T) {
+	priv, pub := CreateKeyPair()
+
+	pubKeyBytes, err := crypto.MarshalPublicKey(pub)
+	if err != nil {
+		t.Fatal("Could not get public key")
+	}
+
+	senderID, err := peer.IDFromPublicKey(pub)
+	if err != nil {
+		t.Fatal("Could not derive peer ID")
+	}
+
+	first := models.Tx{SequenceNum: 3, From: senderID.String(), To: "You", Amount: 25, Pubkey: pubKeyBytes}
+	second := models.Tx{SequenceNum: 3, From: senderID.String(), To: "Them", Amount: 25, Pubkey: pubKeyBytes}
+	if SignTx(&first, priv) != nil || SignTx(&second, priv) != nil {
+		t.Fatal("Could not sign tx")
+	}
+
+	if err := VerifyEquivocationProof(&models.EquivocationProof{First: first, Second: second}); err != nil {
+		t.Fatalf("Valid proof rejected: %v", err)
+	}
+
+	if VerifyEquivocationProof(&models.EquivocationProof{First: first, Second: first}) == nil {
+		t.Fatal("Proof with identical txs accepted")
+	}
+
+	later := second
+	later.SequenceNum = 4
+	if SignTx(&later, priv) != nil {
+		t.Fatal("Could not sign tx")
+	}
+
+	if VerifyEquivocationProof(&models.EquivocationProof{First: first, Second: later}) == nil {
+		t.Fatal("Proof with different sequence numbers accepted")
+	}
+
+	forged := second
+	forged.Amount = 30
+	if VerifyEquivocationProof(&models.EquivocationProof{First: first, Second: forged}) == nil {
+		t.Fatal("Proof with invalid sig accepted")
+	}
+}
+
+func TestDoubleSigners(t *testing.T) {
+	priv, pub := CreateKeyPair()
+	pubKeyBytes, err := crypto.MarshalPublicKey(pub)
+	if err != nil {
+		t.Fatal("Could not get public key")
+	}
+
+	senderID, err := peer.IDFromPublicKey(pub)
+	if err != nil {
+		t.Fatal("Could not derive peer ID")
+	}
+
+	first := models.Tx{SequenceNum: 3, From: senderID.String(), To: "You", Amount: 25, Pubkey: pubKeyBytes}
+	second := models.Tx{SequenceNum: 3, From: senderID.String(), To: "Them", Amount: 25, Pubkey: pubKeyBytes}
+	if SignTx(&first, priv) != nil || SignTx(&second, priv) != nil {
+		t.Fatal("Could not sign tx")
+	}
+
+	bothPriv, _ := CreateKeyPair()
+	onePriv, _ := CreateKeyPair()
+	for _, k := range []crypto.PrivKey{bothPriv, onePriv} {
+		v, err := CreateVerifier(&first, k)
+		if err != nil {
+			t.Fatal("Could not create verifier")
+		}
+		first.Verifiers = append(first.Verifiers, *v)
+	}
+
+	v, err := CreateVerifier(&second, bothPriv)
+	if err != nil {
+		t.Fatal("Could not create verifier")
+	}
+	second.Verifiers = append(second.Verifiers, *v)
+
+	//A verifier that only signed the first tx can't be blamed by copying
+	//its entry onto the second
+	second.Verifiers = append(second.Verifiers, first.Verifiers[1])
+
+	signers := DoubleSigners(&models.EquivocationProof{First: first, Second: second})
+	if len(signers) != 1 || signers[0] != first.Verifiers[0].ID {
+		t.Fatalf("Wrong double signers %v", signers)
+	}
+}
+
+func TestSignVerify_SmallAmountChange(t *testing.T) {
+	priv, pub := CreateKeyPair()
+
+	pubKeyBytes, err := crypto.MarshalPublicKey(pub)
+	if err != nil {
+		t.Fatal("Could not get public key")
+	}
+
+	senderID, err := peer.IDFromPublicKey(pub)
+	if err != nil {
+		t.Fatal("Could not derive peer ID")
+	}
+
+	tx := models.Tx{From: senderID.String(), To: "You", Amount: 1, Pubkey: pubKeyBytes}
+	if SignTx(&tx, priv) != nil {
+		t.Fatal("Could not sign tx")
+	}
+
+	//A one base unit change must invalidate the sig
+	tx.Amount = 2
+	result, err := VerifyTxSig(tx)
+	if err == nil && result {
+		t.Fatal("Sig still valid after amount changed")
+	}
+}
+
+func TestVerifyTxSig_ForgedSender(t *testing.T) {
+	_, pubVictim := CreateKeyPair()
+	privAttacker, pubAttacker := CreateKeyPair()
+
+	victimID, err := peer.IDFromPublicKey(pubVictim)
+	if err != nil {
+		t.Fatal("Could not derive peer ID")
+	}
+
+	pubKeyBytes, err := crypto.MarshalPublicKey(pubAttacker)
+	if err != nil {
+		t.Fatal("Could not get public key")
+	}
+
+	//A validly signed tx spending from an account the signer does not own
+	tx := models.Tx{From: victimID.String(), To: "Attacker", Amount: 100, Pubkey: pubKeyBytes}
+	if SignTx(&tx, privAttacker) != nil {
+		t.Fatal("Could not sign tx")
+	}
+
+	result, err := VerifyTxSig(tx)
+	if err == nil || result {
+		t.Fatal("Tx with forged sender accepted")
+	}
+
+	//Swapping in the victim's public key breaks the sig instead
+	victimKeyBytes, err := crypto.MarshalPublicKey(pubVictim)
+	if err != nil {
+		t.Fatal("Could not get public key")
+	}
+
+	tx.Pubkey = victimKeyBytes
+	result, err = VerifyTxSig(tx)
+	if err == nil && result {
+		t.Fatal("Tx signed by the wrong key accepted")
+	}
+}
+
+func TestVerifyQuorumCertificate(t *testing.T) {
+	privSender, pubSender := CreateKeyPair()
+
+	senderID, err := peer.IDFromPublicKey(pubSender)
+	if err != nil {
+		t.Fatal("Could not derive peer ID")
+	}
+
+	pubKeyBytes, err := crypto.MarshalPublicKey(pubSender)
+	if err != nil {
+		t.Fatal("Could not get public key")
+	}
+
+	tx := models.Tx{From: senderID.String(), To: "You", Amount: 25, Pubkey: pubKeyBytes}
+	if SignTx(&tx, privSender) != nil {
+		t.Fatal("Could not sign tx")
+	}
+
+	weights := map[string]models.Amount{senderID.String(): 100}
+	var verifiers []models.Verifier
+	for i := 0; i < 3; i++ {
+		priv, _ := CreateKeyPair()
+		v, err := CreateVerifier(&tx, priv)
+		if err != nil {
+			t.Fatalf("Could not create verifier %v", err)
+		}
+		verifiers = append(verifiers, *v)
+		weights[v.ID] = 100
+	}
+
+	//Two of four equal weights is exactly half, which is not enough
+	tx.Verifiers = verifiers[:2]
+	if VerifyQuorumCertificate(&tx, weights) == nil {
+		t.Fatal("Certificate with half the weight accepted")
+	}
+
+	tx.Verifiers = verifiers
+	if err := VerifyQuorumCertificate(&tx, weights); err != nil {
+		t.Fatalf("Valid certificate rejected: %v", err)
+	}
+
+	//The same verifier can't be counted twice
+	tx.Verifiers = []models.Verifier{verifiers[0], verifiers[1], verifiers[1]}
+	if VerifyQuorumCertificate(&tx, weights) == nil {
+		t.Fatal("Certificate with a duplicate verifier accepted")
+	}
+
+	//A verifier claiming another peer's ID with its own key
+	forged := verifiers[2]
+	forged.ID = verifiers[0].ID
+	tx.Verifiers = []models.Verifier{forged, verifiers[1], verifiers[2]}
+	if VerifyQuorumCertificate(&tx, weights) == nil {
+		t.Fatal("Certificate with a forged verifier ID accepted")
+	}
+
+	//Sigs are over the tx so they can't be moved to another tx
+	other := tx
+	other.Amount = 26
+	other.Verifiers = verifiers
+	if VerifyQuorumCertificate(&other, weights) == nil {
+		t.Fatal("Certificate for another tx accepted")
+	}
+}
+
+func TestVerifyCancellationSig(t *testing.T) {
+	priv, pub := CreateKeyPair()
+	_, pubVictim := CreateKeyPair()
+
+	id, err := peer.IDFromPublicKey(pub)
+	if err != nil {
+		t.Fatal("Could not derive peer ID")
+	}
+
+	victimID, err := peer.IDFromPublicKey(pubVictim)
+	if err != nil {
+		t.Fatal("Could not derive peer ID")
+	}
+
+	pubKeyBytes, err := crypto.MarshalPublicKey(pub)
+	if err != nil {
+		t.Fatal("Could not get public key")
+	}
+
+	c := models.Cancellation{From: id.String(), SequenceNum: 3, Pubkey: pubKeyBytes}
+	if SignCancellation(&c, priv) != nil {
+		t.Fatal("Could not sign cancellation")
+	}
+
+	if result, err := VerifyCancellationSig(&c); err != nil || !result {
+		t.Fatal("Valid cancellation rejected")
+	}
+
+	c.SequenceNum = 2
+	if result, _ := VerifyCancellationSig(&c); result {
+		t.Fatal("Altered cancellation accepted")
+	}
+
+	//Only the sender can cancel its txs
+	forged := models.Cancellation{From: victimID.String(), SequenceNum: 3, Pubkey: pubKeyBytes}
+	if SignCancellation(&forged, priv) != nil {
+		t.Fatal("Could not sign cancellation")
+	}
+
+	if result, err := VerifyCancellationSig(&forged); err == nil || result {
+		t.Fatal("Cancellation with forged sender accepted")
+	}
+
+	//A tx sig can't be passed off as a cancellation
+	tx := models.Tx{SequenceNum: 3, From: id.String(), Pubkey: pubKeyBytes}
+	if SignTx(&tx, priv) != nil {
+		t.Fatal("Could not sign tx")
+	}
+
+	c = models.Cancellation{From: id.String(), SequenceNum: 3, Pubkey: pubKeyBytes, Sig: tx.Sig}
+	if result, _ := VerifyCancellationSig(&c); result {
+		t.Fatal("Tx sig accepted as a cancellation")
+	}
+}
+
+func TestVerifyCheckpointCertificate(t *testing.T) {
+	cp := models.Checkpoint{
+		Number:   1,
+		Heads:    map[string]int{"Alice": 2},
+		Balances: map[string]models.Amount{"Alice": 90, "Bob": 60},
+	}
+
+	weights := make(map[string]models.Amount)
+	var signers []models.Verifier
+	for i := 0; i < 3; i++ {
+		priv, _ := CreateKeyPair()
+		v, err := CreateCheckpointSigner(&cp, priv)
+		if err != nil {
+			t.Fatalf("Could not create signer %v", err)
+		}
+
+		if result, err := VerifyCheckpointSigner(v, &cp); err != nil || !result {
+			t.Fatal("Valid signer rejected")
+		}
+		signers = append(signers, *v)
+		weights[v.ID] = 100
+	}
+
+	cp.Signers = signers[:1]
+	if VerifyCheckpointCertificate(&cp, weights) == nil {
+		t.Fatal("Certificate with a third of the weight accepted")
+	}
+
+	cp.Signers = signers[:2]
+	if err := VerifyCheckpointCertificate(&cp, weights); err != nil {
+		t.Fatalf("Valid certificate rejected: %v", err)
+	}
+
+	//Sigs are over the balances so they can't be moved to other ones
+	other := cp
+	other.Balances = map[string]models.Amount{"Alice": 10, "Bob": 140}
+	if VerifyCheckpointCertificate(&other, weights) == nil {
+		t.Fatal("Certificate for other balances accepted")
+	}
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"log"
 	"os"
+	"time"
 
 	"github.com/ackhia/flash/config"
 	fcrypto "github.com/ackhia/flash/crypto"
@@ -36,21 +37,27 @@ func main() {
 		Args:  cobra.MinimumNArgs(1),
 	}
 	var port int
+	var dataDir string
+	var syncInterval time.Duration
+	var checkpointInterval time.Duration
 	startCmd.Flags().IntVarP(&port, "port", "p", 0, "Port to listen on")
+	startCmd.Flags().StringVarP(&dataDir, "data-dir", "d", "", "Directory to persist the ledger in (in memory if empty)")
+	startCmd.Flags().DurationVar(&syncInterval, "sync-interval", 30*time.Second, "How often to compare state with peers and catch up (0 to turn off)")
+	startCmd.Flags().DurationVar(&checkpointInterval, "checkpoint-interval", 10*time.Minute, "Roughly how often to propose a checkpoint and prune the history it covers (0 to turn off)")
 	startCmd.Run = func(cmd *cobra.Command, args []string) {
 		priv, err := fcrypto.ReadPrivateKey(args[0])
 		if err != nil {
 			log.Fatalf("Could not read file %s %v", args[0], err)
 		}
 
-		startNode(priv, port)
+		startNode(priv, port, dataDir, syncInterval, checkpointInterval)
 	}
 
 	rootCmd.AddCommand(genCmd, startCmd)
 	rootCmd.Execute()
 }
 
-func startNode(privKey crypto.PrivKey, port int) {
+func startNode(privKey crypto.PrivKey, port int, dataDir string, syncInterval time.Duration, checkpointInterval time.Duration) {
 	setupLogging()
 
 	host, err := p2p.MakeHost(&privKey, port)
@@ -70,9 +77,13 @@ func startNode(privKey crypto.PrivKey, port int) {
 		log.Fatalf("Could not read %s %v", genesisFilename, err)
 	}
 
-	n := node.New(privKey, &host, genesis, bs)
+	n := node.New(privKey, &host, genesis, bs, dataDir)
+	n.AntiEntropyInterval = syncInterval
+	n.CheckpointInterval = checkpointInterval
 
-	n.Start()
+	if err = n.Start(); err != nil {
+		log.Fatalf("Could not start node %v", err)
+	}
 
 	ui.Show(n)
 	logFile.Close()
@@ -0,0 +1,160 @@
+package merkle
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"sort"
+
+	"github.com/ackhia/flash/models"
+)
+
+// Depth is the number of levels below the root. Accounts are spread over
+// 2^Depth buckets by the hash of their ID.
+const Depth = 8
+const NumBuckets = 1 << Depth
+
+// The tree is stored as a heap: node 1 is the root, the children of node i
+// are 2i and 2i+1 and bucket b is node NumBuckets+b.
+const numNodes = 2 * NumBuckets
+
+// Hash is a node of the tree
+type Hash [32]byte
+
+func (h Hash) String() string {
+	return hex.EncodeToString(h[:])
+}
+
+func (h Hash) MarshalText() ([]byte, error) {
+	return []byte(h.String()), nil
+}
+
+func (h *Hash) UnmarshalText(text []byte) error {
+	if hex.DecodedLen(len(text)) != len(h) {
+		return fmt.Errorf("hash must be %d bytes", len(h))
+	}
+
+	_, err := hex.Decode(h[:], text)
+	return err
+}
+
+// AccountState is what the tree commits to for each account: its balance
+// from committed txs and how many of its txs are committed
+type AccountState struct {
+	Balance models.Amount `json:"balance"`
+	Head    int           `json:"head"`
+}
+
+// Tree is a Merkle tree over account states. Set only rehashes the account's
+// bucket and the path from it to the root. It is not safe for concurrent
+// use.
+type Tree struct {
+	buckets [NumBuckets]map[string]AccountState
+	nodes   [numNodes]Hash
+}
+
+func New() *Tree {
+	t := &Tree{}
+	for b := range t.buckets {
+		t.buckets[b] = make(map[string]AccountState)
+		t.nodes[NumBuckets+b] = hashBucket(t.buckets[b])
+	}
+
+	for i := NumBuckets - 1; i >= 1; i-- {
+		t.nodes[i] = hashChildren(t.nodes[2*i], t.nodes[2*i+1])
+	}
+
+	return t
+}
+
+// BucketOf returns the bucket an account is kept in
+func BucketOf(account string) int {
+	h := sha256.Sum256([]byte(account))
+	return int(h[0]) % NumBuckets
+}
+
+// IsBucket reports whether a node index is a bucket rather than an
+// internal node
+func IsBucket(index int) bool {
+	return index >= NumBuckets && index < numNodes
+}
+
+// Set records the state of an account and updates the hashes above it.
+// The zero state is the same as no state so setting it removes the account,
+// which keeps the root the same however the account got there.
+func (t *Tree) Set(account string, state AccountState) {
+	b := BucketOf(account)
+	if t.buckets[b][account] == state {
+		return
+	}
+
+	if state == (AccountState{}) {
+		delete(t.buckets[b], account)
+	} else {
+		t.buckets[b][account] = state
+	}
+
+	i := NumBuckets + b
+	t.nodes[i] = hashBucket(t.buckets[b])
+	for i > 1 {
+		i /= 2
+		t.nodes[i] = hashChildren(t.nodes[2*i], t.nodes[2*i+1])
+	}
+}
+
+func (t *Tree) Root() Hash {
+	return t.nodes[1]
+}
+
+// Node returns the hash of the node at a heap index
+func (t *Tree) Node(index int) (Hash, error) {
+	if index < 1 || index >= numNodes {
+		return Hash{}, fmt.Errorf("node %d is outside the tree", index)
+	}
+
+	return t.nodes[index], nil
+}
+
+// Bucket returns a copy of the account states in a bucket
+func (t *Tree) Bucket(b int) (map[string]AccountState, error) {
+	if b < 0 || b >= NumBuckets {
+		return nil, fmt.Errorf("bucket %d is outside the tree", b)
+	}
+
+	accounts := make(map[string]AccountState, len(t.buckets[b]))
+	for account, state := range t.buckets[b] {
+		accounts[account] = state
+	}
+
+	return accounts, nil
+}
+
+func hashChildren(left, right Hash) Hash {
+	return sha256.Sum256(append(left[:], right[:]...))
+}
+
+// hashBucket hashes the accounts in a bucket in sorted order. Each account
+// is its ID with a uint32 length prefix followed by its balance and head as
+// uint64s, all big endian.
+func hashBucket(bucket map[string]AccountState) Hash {
+	accounts := make([]string, 0, len(bucket))
+	for account := range bucket {
+		accounts = append(accounts, account)
+	}
+	sort.Strings(accounts)
+
+	h := sha256.New()
+	for _, account := range accounts {
+		var buf []byte
+		buf = binary.BigEndian.AppendUint32(buf, uint32(len(account)))
+		buf = append(buf, account...)
+		buf = binary.BigEndian.AppendUint64(buf, uint64(bucket[account].Balance))
+		buf = binary.BigEndian.AppendUint64(buf, uint64(bucket[account].Head))
+		h.Write(buf)
+	}
+
+	var sum Hash
+	copy(sum[:], h.Sum(nil))
+	return sum
+}
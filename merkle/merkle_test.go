@@ -0,0 +1,73 @@
+package merkle
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTree_RootDependsOnStateNotOrder(t *testing.T) {
+	a := New()
+	b := New()
+	assert.Equal(t, a.Root(), b.Root())
+
+	for i := 0; i < 50; i++ {
+		a.Set(fmt.Sprintf("account%d", i), AccountState{Balance: 100, Head: i})
+	}
+	for i := 49; i >= 0; i-- {
+		b.Set(fmt.Sprintf("account%d", i), AccountState{Balance: 100, Head: i})
+	}
+	assert.Equal(t, a.Root(), b.Root())
+
+	b.Set("account7", AccountState{Balance: 99, Head: 7})
+	assert.NotEqual(t, a.Root(), b.Root())
+
+	b.Set("account7", AccountState{Balance: 100, Head: 7})
+	assert.Equal(t, a.Root(), b.Root())
+
+	//An account set back to the zero state is the same as one never set
+	b.Set("extra", AccountState{Balance: 5})
+	b.Set("extra", AccountState{})
+	assert.Equal(t, a.Root(), b.Root())
+}
+
+func TestTree_DivergenceIsOnPathToBucket(t *testing.T) {
+	a := New()
+	b := New()
+	for i := 0; i < 20; i++ {
+		a.Set(fmt.Sprintf("account%d", i), AccountState{Balance: 10})
+		b.Set(fmt.Sprintf("account%d", i), AccountState{Balance: 10})
+	}
+	b.Set("account3", AccountState{Balance: 10, Head: 1})
+
+	//Only the nodes above account3's bucket differ
+	bucket := NumBuckets + BucketOf("account3")
+	onPath := make(map[int]bool)
+	for i := bucket; i >= 1; i /= 2 {
+		onPath[i] = true
+	}
+
+	for i := 1; i < numNodes; i++ {
+		ha, err := a.Node(i)
+		assert.NoError(t, err)
+		hb, err := b.Node(i)
+		assert.NoError(t, err)
+		assert.Equal(t, !onPath[i], ha == hb, "node %d", i)
+	}
+
+	_, err := a.Node(numNodes)
+	assert.Error(t, err)
+}
+
+func TestHash_Text(t *testing.T) {
+	h := New().Root()
+
+	text, err := h.MarshalText()
+	assert.NoError(t, err)
+
+	var parsed Hash
+	assert.NoError(t, parsed.UnmarshalText(text))
+	assert.Equal(t, h, parsed)
+	assert.Error(t, parsed.UnmarshalText([]byte("abcd")))
+}
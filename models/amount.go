@@ -0,0 +1,97 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Amount is a quantity of coins held as an integer number of base units so
+// that balance math and tx hashes are exact
+type Amount uint64
+
+// AmountDecimals is the number of decimal places a coin can be split into
+const AmountDecimals = 6
+
+// UnitsPerCoin is the number of base units in one coin
+const UnitsPerCoin Amount = 1_000_000
+
+var ErrAmountOverflow = errors.New("amount overflow")
+var ErrAmountUnderflow = errors.New("amount underflow")
+
+// ParseAmount parses a decimal number of coins such as "12" or "0.5" into
+// base units. It rejects negative numbers, exponents and more than
+// AmountDecimals decimal places.
+func ParseAmount(s string) (Amount, error) {
+	whole, frac, hasFrac := strings.Cut(s, ".")
+	if whole == "" && frac == "" {
+		return 0, fmt.Errorf("invalid amount %q", s)
+	}
+
+	if hasFrac && frac == "" {
+		return 0, fmt.Errorf("invalid amount %q", s)
+	}
+
+	if len(frac) > AmountDecimals {
+		return 0, fmt.Errorf("amount %q has more than %d decimal places", s, AmountDecimals)
+	}
+
+	for _, part := range []string{whole, frac} {
+		for _, c := range part {
+			if c < '0' || c > '9' {
+				return 0, fmt.Errorf("invalid amount %q", s)
+			}
+		}
+	}
+
+	var coins uint64
+	if whole != "" {
+		var err error
+		coins, err = strconv.ParseUint(whole, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid amount %q: %w", s, ErrAmountOverflow)
+		}
+	}
+
+	if coins > math.MaxUint64/uint64(UnitsPerCoin) {
+		return 0, fmt.Errorf("invalid amount %q: %w", s, ErrAmountOverflow)
+	}
+
+	var units uint64
+	if frac != "" {
+		frac += strings.Repeat("0", AmountDecimals-len(frac))
+		units, _ = strconv.ParseUint(frac, 10, 64)
+	}
+
+	return Amount(coins * uint64(UnitsPerCoin)).Add(Amount(units))
+}
+
+// String formats the amount as a decimal number of coins
+func (a Amount) String() string {
+	whole := a / UnitsPerCoin
+	frac := a % UnitsPerCoin
+	if frac == 0 {
+		return strconv.FormatUint(uint64(whole), 10)
+	}
+
+	fracStr := fmt.Sprintf("%0*d", AmountDecimals, uint64(frac))
+	return fmt.Sprintf("%d.%s", uint64(whole), strings.TrimRight(fracStr, "0"))
+}
+
+func (a Amount) Add(b Amount) (Amount, error) {
+	if a > math.MaxUint64-b {
+		return 0, ErrAmountOverflow
+	}
+
+	return a + b, nil
+}
+
+func (a Amount) Sub(b Amount) (Amount, error) {
+	if b > a {
+		return 0, ErrAmountUnderflow
+	}
+
+	return a - b, nil
+}
@@ -0,0 +1,58 @@
+package models
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseAmount(t *testing.T) {
+	tests := []struct {
+		in       string
+		expected Amount
+	}{
+		{"0", 0},
+		{"1", UnitsPerCoin},
+		{"1000", 1000 * UnitsPerCoin},
+		{"12.5", 12*UnitsPerCoin + 500_000},
+		{"0.000001", 1},
+		{".25", 250_000},
+		{"18446744073709.551615", 18446744073709551615},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			a, err := ParseAmount(tt.in)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, a)
+		})
+	}
+}
+
+func TestParseAmount_Invalid(t *testing.T) {
+	for _, in := range []string{"", ".", "1.", "-1", "+1", "1e3", "1.2.3", "0.0000001", "abc", "18446744073709.551616", "99999999999999999999"} {
+		t.Run(in, func(t *testing.T) {
+			_, err := ParseAmount(in)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestAmountString(t *testing.T) {
+	assert.Equal(t, "0", Amount(0).String())
+	assert.Equal(t, "1000", (1000 * UnitsPerCoin).String())
+	assert.Equal(t, "12.5", (12*UnitsPerCoin + 500_000).String())
+	assert.Equal(t, "0.000001", Amount(1).String())
+}
+
+func TestAmountAddSub(t *testing.T) {
+	_, err := Amount(^uint64(0)).Add(1)
+	assert.ErrorIs(t, err, ErrAmountOverflow)
+
+	_, err = Amount(1).Sub(2)
+	assert.ErrorIs(t, err, ErrAmountUnderflow)
+
+	a, err := Amount(5).Sub(2)
+	assert.NoError(t, err)
+	assert.Equal(t, Amount(3), a)
+}
@@ -0,0 +1,176 @@
+package models
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"sort"
+)
+
+// TxEncodingVersion is the first byte of every canonical tx encoding. It
+// must be bumped whenever the layout below changes.
+const TxEncodingVersion byte = 2
+
+// EncodeTx returns the canonical encoding of the fields a sender signs.
+// Integers are big endian and variable length fields are prefixed with
+// their length as a uint32:
+//
+//	version      uint8
+//	network      32 bytes
+//	sequenceNum  uint64
+//	from         uint32 length, bytes
+//	to           uint32 length, bytes
+//	amount       uint64 base units
+//	pubKey       uint32 length, bytes
+//
+// testdata/tx_vectors.json holds vectors other implementations can check
+// their encoding against.
+func EncodeTx(tx *Tx) []byte {
+	buf := make([]byte, 0, 1+len(tx.Network)+8+4+len(tx.From)+4+len(tx.To)+8+4+len(tx.Pubkey))
+	buf = append(buf, TxEncodingVersion)
+	buf = append(buf, tx.Network[:]...)
+	buf = binary.BigEndian.AppendUint64(buf, uint64(tx.SequenceNum))
+	buf = appendBytes(buf, []byte(tx.From))
+	buf = appendBytes(buf, []byte(tx.To))
+	buf = binary.BigEndian.AppendUint64(buf, uint64(tx.Amount))
+	buf = appendBytes(buf, tx.Pubkey)
+
+	return buf
+}
+
+// EncodeSignedTx returns EncodeTx followed by the sender's signature as a
+// uint32 length and bytes. This is what verifiers sign.
+func EncodeSignedTx(tx *Tx) []byte {
+	return appendBytes(EncodeTx(tx), tx.Sig)
+}
+
+// CancellationEncodingTag is the first byte of a cancellation encoding. It
+// is never a tx encoding version so a sender's sig over one can't be passed
+// off as a sig over the other.
+const CancellationEncodingTag byte = 0xff
+
+// EncodeCancellation returns the canonical encoding of the fields a sender
+// signs to cancel its pending txs, in the same form as EncodeTx:
+//
+//	tag          uint8
+//	network      32 bytes
+//	sequenceNum  uint64
+//	from         uint32 length, bytes
+//	pubKey       uint32 length, bytes
+func EncodeCancellation(c *Cancellation) []byte {
+	buf := make([]byte, 0, 1+len(c.Network)+8+4+len(c.From)+4+len(c.Pubkey))
+	buf = append(buf, CancellationEncodingTag)
+	buf = append(buf, c.Network[:]...)
+	buf = binary.BigEndian.AppendUint64(buf, uint64(c.SequenceNum))
+	buf = appendBytes(buf, []byte(c.From))
+	buf = appendBytes(buf, c.Pubkey)
+
+	return buf
+}
+
+// CheckpointEncodingTag is the first byte of a checkpoint encoding. Like
+// CancellationEncodingTag it is never a tx encoding version.
+const CheckpointEncodingTag byte = 0xfe
+
+// EncodeCheckpoint returns the canonical encoding of the fields verifiers
+// sign for a checkpoint, in the same form as EncodeTx. Accounts are in
+// sorted order and those with a zero balance and head are left out:
+//
+//	tag          uint8
+//	network      32 bytes
+//	number       uint64
+//	prev         32 bytes
+//	accounts     uint32 count, then for each
+//	  id         uint32 length, bytes
+//	  balance    uint64 base units
+//	  head       uint64
+func EncodeCheckpoint(cp *Checkpoint) []byte {
+	accounts := make([]string, 0, len(cp.Balances)+len(cp.Heads))
+	for id, b := range cp.Balances {
+		if b != 0 || cp.Heads[id] != 0 {
+			accounts = append(accounts, id)
+		}
+	}
+	for id, h := range cp.Heads {
+		if _, ok := cp.Balances[id]; !ok && h != 0 {
+			accounts = append(accounts, id)
+		}
+	}
+	sort.Strings(accounts)
+
+	buf := make([]byte, 0, 1+len(cp.Network)+8+len(cp.Prev)+4)
+	buf = append(buf, CheckpointEncodingTag)
+	buf = append(buf, cp.Network[:]...)
+	buf = binary.BigEndian.AppendUint64(buf, uint64(cp.Number))
+	buf = append(buf, cp.Prev[:]...)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(accounts)))
+	for _, id := range accounts {
+		buf = appendBytes(buf, []byte(id))
+		buf = binary.BigEndian.AppendUint64(buf, uint64(cp.Balances[id]))
+		buf = binary.BigEndian.AppendUint64(buf, uint64(cp.Heads[id]))
+	}
+
+	return buf
+}
+
+func appendBytes(buf []byte, b []byte) []byte {
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(b)))
+	return append(buf, b...)
+}
+
+// TxID identifies a tx by the SHA-256 hash of its signed encoding
+type TxID [32]byte
+
+func (tx *Tx) ID() TxID {
+	return sha256.Sum256(EncodeSignedTx(tx))
+}
+
+func (id TxID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+func (id TxID) MarshalText() ([]byte, error) {
+	return []byte(id.String()), nil
+}
+
+func (id *TxID) UnmarshalText(text []byte) error {
+	if hex.DecodedLen(len(text)) != len(id) {
+		return fmt.Errorf("tx ID must be %d bytes", len(id))
+	}
+
+	_, err := hex.Decode(id[:], text)
+	return err
+}
+
+// ParseTxID parses the hex form returned by TxID.String
+func ParseTxID(s string) (TxID, error) {
+	var id TxID
+	err := id.UnmarshalText([]byte(s))
+	return id, err
+}
+
+// CheckpointID identifies a checkpoint by the SHA-256 hash of its encoding.
+// Verifiers sign it. The zero ID is the Prev of the first checkpoint.
+type CheckpointID [32]byte
+
+func (cp *Checkpoint) ID() CheckpointID {
+	return sha256.Sum256(EncodeCheckpoint(cp))
+}
+
+func (id CheckpointID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+func (id CheckpointID) MarshalText() ([]byte, error) {
+	return []byte(id.String()), nil
+}
+
+func (id *CheckpointID) UnmarshalText(text []byte) error {
+	if hex.DecodedLen(len(text)) != len(id) {
+		return fmt.Errorf("checkpoint ID must be %d bytes", len(id))
+	}
+
+	_, err := hex.Decode(id[:], text)
+	return err
+}
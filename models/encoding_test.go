@@ -0,0 +1,114 @@
+package models
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type txVector struct {
+	Name           string `json:"name"`
+	Tx             Tx     `json:"tx"`
+	Encoding       string `json:"encoding"`
+	SignedEncoding string `json:"signedEncoding"`
+	ID             string `json:"id"`
+}
+
+func TestEncodeTx_Vectors(t *testing.T) {
+	data, err := os.ReadFile("testdata/tx_vectors.json")
+	assert.NoError(t, err)
+
+	var vectors []txVector
+	assert.NoError(t, json.Unmarshal(data, &vectors))
+	assert.NotEmpty(t, vectors)
+
+	for _, v := range vectors {
+		t.Run(v.Name, func(t *testing.T) {
+			assert.Equal(t, v.Encoding, hex.EncodeToString(EncodeTx(&v.Tx)))
+			assert.Equal(t, v.SignedEncoding, hex.EncodeToString(EncodeSignedTx(&v.Tx)))
+			assert.Equal(t, v.ID, v.Tx.ID().String())
+		})
+	}
+}
+
+func TestEncodeTx_FieldBoundaries(t *testing.T) {
+	a := Tx{From: "ab", To: "c"}
+	b := Tx{From: "a", To: "bc"}
+
+	assert.NotEqual(t, EncodeTx(&a), EncodeTx(&b))
+	assert.NotEqual(t, a.ID(), b.ID())
+}
+
+func TestTxID_Text(t *testing.T) {
+	tx := Tx{SequenceNum: 1, From: "a", To: "b", Amount: 5}
+	id := tx.ID()
+
+	parsed, err := ParseTxID(id.String())
+	assert.NoError(t, err)
+	assert.Equal(t, id, parsed)
+
+	_, err = ParseTxID("abcd")
+	assert.Error(t, err)
+}
+
+func TestNewNetworkID(t *testing.T) {
+	genesis := map[string]Amount{"Alice": 100, "Bob": 50, "Carol": 25}
+	id := NewNetworkID(genesis)
+
+	//Map order must not matter
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, id, NewNetworkID(map[string]Amount{"Carol": 25, "Alice": 100, "Bob": 50}))
+	}
+
+	assert.NotEqual(t, id, NewNetworkID(map[string]Amount{"Alice": 100, "Bob": 50, "Carol": 26}))
+	assert.NotEqual(t, id, NewNetworkID(map[string]Amount{"Alice": 100, "Bob": 50}))
+
+	var parsed NetworkID
+	assert.NoError(t, parsed.UnmarshalText([]byte(id.String())))
+	assert.Equal(t, id, parsed)
+}
+
+func TestEncodeTx_Network(t *testing.T) {
+	a := Tx{From: "a", To: "b", Amount: 5}
+	b := a
+	b.Network = NewNetworkID(map[string]Amount{"Alice": 100})
+
+	assert.NotEqual(t, a.ID(), b.ID())
+}
+
+func TestEncodeCheckpoint(t *testing.T) {
+	cp := Checkpoint{
+		Number:   1,
+		Heads:    map[string]int{"Alice": 2},
+		Balances: map[string]Amount{"Alice": 90, "Bob": 60},
+	}
+
+	//Accounts at zero don't change the encoding
+	zeros := cp
+	zeros.Heads = map[string]int{"Alice": 2, "Carol": 0}
+	zeros.Balances = map[string]Amount{"Alice": 90, "Bob": 60, "Carol": 0}
+	assert.Equal(t, EncodeCheckpoint(&cp), EncodeCheckpoint(&zeros))
+
+	//Signers aren't signed
+	signed := cp
+	signed.Signers = []Verifier{{ID: "Alice"}}
+	assert.Equal(t, cp.ID(), signed.ID())
+
+	other := cp
+	other.Heads = map[string]int{"Alice": 3}
+	assert.NotEqual(t, cp.ID(), other.ID())
+
+	other = cp
+	other.Prev = CheckpointID{1}
+	assert.NotEqual(t, cp.ID(), other.ID())
+
+	assert.Equal(t, 2, cp.Height())
+
+	var parsed CheckpointID
+	id := cp.ID()
+	assert.NoError(t, parsed.UnmarshalText([]byte(id.String())))
+	assert.Equal(t, id, parsed)
+}
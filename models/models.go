@@ -1,17 +1,141 @@
 package models
 
+import "time"
+
+// Verifier is a peer's signature over a tx. It carries the peer's public
+// key so it can be checked without knowing the peer.
 type Verifier struct {
-	ID  string `json:"id"`
-	Sig []byte `json:"sig"`
+	ID     string `json:"id"`
+	Pubkey []byte `json:"pubKey"`
+	Sig    []byte `json:"sig"`
 }
 
 type Tx struct {
+	Network     NetworkID  `json:"network"`
 	SequenceNum int        `json:"sequenceNum"`
 	From        string     `json:"from"`
 	To          string     `json:"to"`
 	Pubkey      []byte     `json:"pubKey"`
-	Amount      float64    `json:"amount"`
+	Amount      Amount     `json:"amount"`
 	Sig         []byte     `json:"sig"`
 	Verifiers   []Verifier `json:"verifiers"`
 	Comitted    bool       `json:"-"`
 }
+
+// LedgerTx is a tx a node holds and when the node first received it
+type LedgerTx struct {
+	Tx       Tx        `json:"tx"`
+	Received time.Time `json:"received"`
+}
+
+// TxState is where a tx is in its lifecycle
+type TxState string
+
+const (
+	TxBuilt         TxState = "built"
+	TxSigned        TxState = "signed"
+	TxVerifying     TxState = "verifying"
+	TxQuorumReached TxState = "quorum reached"
+	TxCommitting    TxState = "committing"
+	TxCommitted     TxState = "committed"
+	TxFailed        TxState = "failed"
+	TxExpired       TxState = "expired"
+)
+
+// Final reports whether a tx can't leave the state
+func (s TxState) Final() bool {
+	return s == TxCommitted || s == TxFailed || s == TxExpired
+}
+
+// TxStateChange records when a tx moved to a state
+type TxStateChange struct {
+	State TxState   `json:"state"`
+	Time  time.Time `json:"time"`
+}
+
+// TxStatus is what a node knows about a tx: the tx, the state it is in and
+// the states it went through to get there. Error says why a failed tx
+// failed.
+type TxStatus struct {
+	Tx      Tx              `json:"tx"`
+	State   TxState         `json:"state"`
+	Error   string          `json:"error,omitempty"`
+	History []TxStateChange `json:"history"`
+}
+
+// Cancellation is signed by a sender to abandon its pending txs from
+// SequenceNum on so the sequence number can be used again
+type Cancellation struct {
+	Network     NetworkID `json:"network"`
+	From        string    `json:"from"`
+	SequenceNum int       `json:"sequenceNum"`
+	Pubkey      []byte    `json:"pubKey"`
+	Sig         []byte    `json:"sig"`
+}
+
+// AccountHead is how far a node's ledger goes for a sender: how many of its
+// txs from sequence number zero on are committed and the sequence number
+// the node expects next, counting pending txs
+type AccountHead struct {
+	Committed int `json:"committed"`
+	Next      int `json:"next"`
+}
+
+// Checkpoint freezes every account's committed balance and sequence head at
+// a point in the history. Once it is signed by verifiers holding a quorum
+// of the voting weight the txs it covers can be pruned and a new node can
+// start from it instead of genesis. Checkpoints are numbered from 1 and
+// each names the one before it, the first naming none.
+type Checkpoint struct {
+	Network NetworkID    `json:"network"`
+	Number  int          `json:"number"`
+	Prev    CheckpointID `json:"prev"`
+	// Heads is how many txs from each sender the checkpoint covers and
+	// Balances is every balance once they are applied. Accounts at zero are
+	// left out.
+	Heads    map[string]int    `json:"heads"`
+	Balances map[string]Amount `json:"balances"`
+	Signers  []Verifier        `json:"signers"`
+}
+
+// Height is how many txs the checkpoint covers in all
+func (cp *Checkpoint) Height() int {
+	height := 0
+	for _, h := range cp.Heads {
+		height += h
+	}
+
+	return height
+}
+
+// Covers reports whether cp covers every tx other does
+func (cp *Checkpoint) Covers(other *Checkpoint) bool {
+	for from, head := range other.Heads {
+		if cp.Heads[from] < head {
+			return false
+		}
+	}
+
+	return true
+}
+
+// EquivocationProof holds two conflicting txs signed by the same sender for
+// the same sequence number
+type EquivocationProof struct {
+	First  Tx `json:"first"`
+	Second Tx `json:"second"`
+}
+
+// Reconciliation records how a node resolved two conflicting txs from the
+// same sender for the same sequence number
+type Reconciliation struct {
+	From        string    `json:"from"`
+	SequenceNum int       `json:"sequenceNum"`
+	Kept        TxID      `json:"kept"`
+	Dropped     []TxID    `json:"dropped"`
+	Reason      string    `json:"reason"`
+	Time        time.Time `json:"time"`
+	// DoubleSigners are the verifiers that signed both txs when both were
+	// certified
+	DoubleSigners []string `json:"doubleSigners,omitempty"`
+}
@@ -0,0 +1,51 @@
+package models
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"sort"
+)
+
+// NetworkID identifies a Flash network by the hash of its genesis. It is part
+// of every signed payload so txs and verifier sigs can't be replayed on a
+// network with a different genesis.
+type NetworkID [32]byte
+
+const genesisDomain = "flash-genesis-v1"
+
+// NewNetworkID hashes the genesis balances in peer ID order so every node
+// with the same genesis derives the same ID
+func NewNetworkID(genesis map[string]Amount) NetworkID {
+	ids := make([]string, 0, len(genesis))
+	for id := range genesis {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	buf := []byte(genesisDomain)
+	for _, id := range ids {
+		buf = appendBytes(buf, []byte(id))
+		buf = binary.BigEndian.AppendUint64(buf, uint64(genesis[id]))
+	}
+
+	return sha256.Sum256(buf)
+}
+
+func (id NetworkID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+func (id NetworkID) MarshalText() ([]byte, error) {
+	return []byte(id.String()), nil
+}
+
+func (id *NetworkID) UnmarshalText(text []byte) error {
+	if hex.DecodedLen(len(text)) != len(id) {
+		return fmt.Errorf("network ID must be %d bytes", len(id))
+	}
+
+	_, err := hex.Decode(id[:], text)
+	return err
+}
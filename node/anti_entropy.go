@@ -0,0 +1,113 @@
+package node
+
+import (
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// Defaults for how often a node compares state with its peers and how many
+// peers it compares with each time
+const defaultAntiEntropyInterval = 30 * time.Second
+const defaultAntiEntropyPeers = 3
+
+// AntiEntropyStats counts what the anti-entropy loop has done since the
+// node started
+type AntiEntropyStats struct {
+	Rounds int
+	// PeersCompared is how many state comparisons were made
+	PeersCompared int
+	// DivergenceFound is how many comparisons found accounts that differ
+	DivergenceFound int
+	// Repaired is how many of those agreed after syncing from the peer. The
+	// rest were peers behind us.
+	Repaired int
+	Errors   int
+	LastRun  time.Time
+}
+
+type antiEntropyStats struct {
+	mu    sync.Mutex
+	stats AntiEntropyStats
+}
+
+func (s *antiEntropyStats) update(f func(*AntiEntropyStats)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f(&s.stats)
+}
+
+func (s *antiEntropyStats) get() AntiEntropyStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.stats
+}
+
+// startAntiEntropy runs an anti-entropy round every interval so a node that
+// misses commits while running catches up
+func (n *Node) startAntiEntropy(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			n.antiEntropyRound()
+		}
+	}()
+}
+
+// antiEntropyRound compares our state with a random sample of connected
+// peers and syncs from any that differ
+func (n *Node) antiEntropyRound() {
+	peers := n.Host.Network().Peers()
+	rand.Shuffle(len(peers), func(i, j int) { peers[i], peers[j] = peers[j], peers[i] })
+	if len(peers) > n.AntiEntropyPeers {
+		peers = peers[:n.AntiEntropyPeers]
+	}
+
+	for _, p := range peers {
+		n.antiEntropyWith(p)
+	}
+
+	n.antiEntropy.update(func(s *AntiEntropyStats) {
+		s.Rounds++
+		s.LastRun = time.Now()
+	})
+}
+
+func (n *Node) antiEntropyWith(p peer.ID) {
+	diverging, err := n.CompareState(p)
+	if err != nil {
+		log.Printf("Could not compare state with %s %v", p, err)
+		n.antiEntropy.update(func(s *AntiEntropyStats) { s.Errors++ })
+		return
+	}
+
+	n.antiEntropy.update(func(s *AntiEntropyStats) { s.PeersCompared++ })
+	if len(diverging) == 0 {
+		return
+	}
+
+	log.Printf("State differs from %s for %d accounts, syncing", p, len(diverging))
+	n.antiEntropy.update(func(s *AntiEntropyStats) { s.DivergenceFound++ })
+
+	if err = n.syncFrom(p); err != nil {
+		log.Printf("Could not sync from %s %v", p, err)
+		n.antiEntropy.update(func(s *AntiEntropyStats) { s.Errors++ })
+		return
+	}
+
+	diverging, err = n.CompareState(p)
+	if err == nil && len(diverging) == 0 {
+		n.antiEntropy.update(func(s *AntiEntropyStats) { s.Repaired++ })
+	}
+}
@@ -0,0 +1,45 @@
+package node
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ackhia/flash/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAntiEntropy_RepairsMissedCommit(t *testing.T) {
+	node1, node2, node3 := createNetworkThreePeers(t, 1000, 2000, 500)
+
+	from := node1.Host.ID().String()
+	to := node2.Host.ID().String()
+
+	//node3 misses the commit
+	tx := verifyWith(t, node1, node2, to, 25)
+	assert.NoError(t, node1.ledger.commit(tx))
+	assert.NoError(t, node2.ledger.commit(tx))
+
+	node3.antiEntropyRound()
+
+	assert.Equal(t, node1.StateRoot(), node3.StateRoot())
+	assert.Equal(t, models.Amount(975), node3.Balance(from))
+
+	stats := node3.AntiEntropyStats()
+	assert.Equal(t, 1, stats.Rounds)
+	assert.Equal(t, 2, stats.PeersCompared)
+	assert.Equal(t, 1, stats.DivergenceFound)
+	assert.Equal(t, 1, stats.Repaired)
+	assert.Equal(t, 0, stats.Errors)
+}
+
+func TestAntiEntropy_Loop(t *testing.T) {
+	node1, node2, node3 := createNetworkThreePeers(t, 1000, 2000, 500)
+
+	tx := verifyWith(t, node1, node2, node2.Host.ID().String(), 25)
+	assert.NoError(t, node1.ledger.commit(tx))
+	assert.NoError(t, node2.ledger.commit(tx))
+
+	node3.startAntiEntropy(20 * time.Millisecond)
+
+	assert.Eventually(t, func() bool { return node3.StateRoot() == node1.StateRoot() }, 5*time.Second, 10*time.Millisecond)
+}
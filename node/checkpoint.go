@@ -0,0 +1,709 @@
+package node
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"math/rand"
+	"strconv"
+	"sync"
+	"time"
+
+	fcrypto "github.com/ackhia/flash/crypto"
+	"github.com/ackhia/flash/models"
+	"github.com/ackhia/flash/transport"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// How often a node proposes a checkpoint if it has new commits
+const defaultCheckpointInterval = 10 * time.Minute
+
+// Largest checkpoint message a node will read
+const maxCheckpointBytes = 4 << 20
+
+// checkpointAheadError is returned when a checkpoint covers commits we
+// don't have yet
+type checkpointAheadError struct {
+	from string
+	head int
+}
+
+func (e *checkpointAheadError) Error() string {
+	return fmt.Sprintf("checkpoint covers %d txs from %s which we don't have", e.head, e.from)
+}
+
+// baseBalances returns the balances the held txs apply on top of: those of
+// the latest checkpoint or genesis. The caller must hold the lock.
+func (l *ledger) baseBalances() map[string]models.Amount {
+	if len(l.checkpoints) == 0 {
+		return l.genesis
+	}
+
+	return l.checkpoints[len(l.checkpoints)-1].Balances
+}
+
+// latestCheckpointID returns the ID of the latest checkpoint, zero if there
+// is none. The caller must hold the lock.
+func (l *ledger) latestCheckpointID() models.CheckpointID {
+	if len(l.checkpoints) == 0 {
+		return models.CheckpointID{}
+	}
+
+	return l.checkpoints[len(l.checkpoints)-1].ID()
+}
+
+// LatestCheckpoint returns the latest checkpoint applied to the ledger
+func (l *ledger) LatestCheckpoint() (models.Checkpoint, bool) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	if len(l.checkpoints) == 0 {
+		return models.Checkpoint{}, false
+	}
+
+	return l.checkpoints[len(l.checkpoints)-1], true
+}
+
+// checkpointsAfter returns the checkpoints numbered above number, oldest
+// first
+func (l *ledger) checkpointsAfter(number int) []models.Checkpoint {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	if number < 0 || number >= len(l.checkpoints) {
+		return nil
+	}
+
+	return append([]models.Checkpoint(nil), l.checkpoints[number:]...)
+}
+
+// balancesAt returns every balance once the txs up to heads are applied to
+// the latest checkpoint. Every tx it covers must be committed and no head
+// can go back past the checkpoint. The caller must hold the lock.
+func (l *ledger) balancesAt(heads map[string]int) (map[string]models.Amount, error) {
+	for from, base := range l.base {
+		if heads[from] < base {
+			return nil, fmt.Errorf("head %d of %s is before the latest checkpoint", heads[from], from)
+		}
+	}
+
+	//Credits and debits are summed first as a sender's debits can come
+	//before the credits that funded them in a different sender's txs
+	credits := make(map[string]models.Amount)
+	debits := make(map[string]models.Amount)
+	for from, head := range heads {
+		if head < l.base[from] {
+			return nil, fmt.Errorf("head %d of %s is before the latest checkpoint", head, from)
+		}
+
+		for seq := l.base[from]; seq < head; seq++ {
+			tx := l.txAt(from, seq)
+			if tx == nil {
+				return nil, &checkpointAheadError{from: from, head: head}
+			}
+			if !tx.Comitted {
+				return nil, fmt.Errorf("tx %d from %s is not committed", seq, from)
+			}
+
+			var err error
+			if credits[tx.To], err = credits[tx.To].Add(tx.Amount); err != nil {
+				return nil, fmt.Errorf("balance of %s overflows", tx.To)
+			}
+			if debits[tx.From], err = debits[tx.From].Add(tx.Amount); err != nil {
+				return nil, fmt.Errorf("debits of %s overflow", tx.From)
+			}
+		}
+	}
+
+	balances := make(map[string]models.Amount)
+	for account, b := range l.baseBalances() {
+		if b != 0 {
+			balances[account] = b
+		}
+	}
+
+	for account, credit := range credits {
+		b, err := balances[account].Add(credit)
+		if err != nil {
+			return nil, fmt.Errorf("balance of %s overflows", account)
+		}
+		balances[account] = b
+	}
+
+	for account, debit := range debits {
+		b, err := balances[account].Sub(debit)
+		if err != nil {
+			return nil, fmt.Errorf("negative balances not allowed")
+		}
+
+		if b == 0 {
+			delete(balances, account)
+		} else {
+			balances[account] = b
+		}
+	}
+
+	return balances, nil
+}
+
+// committedHeads returns every sender's committed head, leaving out those
+// at zero. The caller must hold the lock.
+func (l *ledger) committedHeads() map[string]int {
+	heads := make(map[string]int)
+	for _, from := range l.senders() {
+		if head := l.accountHead(from).Committed; head > 0 {
+			heads[from] = head
+		}
+	}
+
+	return heads
+}
+
+// proposeCheckpoint builds the next checkpoint from the commits we hold. It
+// is nil if nothing was committed since the latest one. If we already
+// signed a checkpoint for the next number that our commits don't cover yet,
+// that one is proposed again, as we can only sign one covering it.
+func (l *ledger) proposeCheckpoint() (*models.Checkpoint, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	number := len(l.checkpoints) + 1
+	cp := models.Checkpoint{
+		Number: number,
+		Prev:   l.latestCheckpointID(),
+		Heads:  l.committedHeads(),
+	}
+
+	if v, ok := l.votes[number]; ok && !cp.Covers(&v) {
+		cp := v
+		cp.Heads = maps.Clone(v.Heads)
+		cp.Balances = maps.Clone(v.Balances)
+		return &cp, nil
+	}
+
+	height := 0
+	for _, base := range l.base {
+		height += base
+	}
+	if cp.Height() == height {
+		return nil, nil
+	}
+
+	balances, err := l.balancesAt(cp.Heads)
+	if err != nil {
+		return nil, err
+	}
+	cp.Balances = balances
+
+	return &cp, nil
+}
+
+// checkFollows checks a checkpoint is the next one after ours. The caller
+// must hold the lock.
+func (l *ledger) checkFollows(cp *models.Checkpoint) error {
+	if cp.Number != len(l.checkpoints)+1 {
+		return fmt.Errorf("checkpoint %d doesn't follow %d", cp.Number, len(l.checkpoints))
+	}
+
+	if cp.Prev != l.latestCheckpointID() {
+		return fmt.Errorf("checkpoint %d follows another checkpoint %s", cp.Number, cp.Prev)
+	}
+
+	return nil
+}
+
+// voteCheckpoint checks a proposed checkpoint against our own commits and
+// records that we are signing it. Once we sign a checkpoint for a number,
+// even across a restart, we only sign another for it that covers it. Any
+// two certified for a number share a signer, so one covers the other. A
+// split vote ends once a proposer's commits cover both sides.
+func (l *ledger) voteCheckpoint(cp *models.Checkpoint) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := l.checkFollows(cp); err != nil {
+		return err
+	}
+
+	balances, err := l.balancesAt(cp.Heads)
+	if err != nil {
+		return err
+	}
+
+	if !sameBalances(balances, cp.Balances) {
+		return fmt.Errorf("checkpoint %d balances differ from ours", cp.Number)
+	}
+
+	if v, ok := l.votes[cp.Number]; ok {
+		if v.ID() == cp.ID() {
+			return nil
+		}
+		if !cp.Covers(&v) {
+			return fmt.Errorf("already signed checkpoint %d %s which this doesn't cover", cp.Number, v.ID())
+		}
+	}
+
+	vote := *cp
+	vote.Signers = nil
+	if err = l.persistVote(&vote); err != nil {
+		return fmt.Errorf("could not persist vote: %v", err)
+	}
+	l.votes[cp.Number] = vote
+
+	return nil
+}
+
+func sameBalances(a map[string]models.Amount, b map[string]models.Amount) bool {
+	for account, balance := range a {
+		if b[account] != balance {
+			return false
+		}
+	}
+
+	for account, balance := range b {
+		if a[account] != balance {
+			return false
+		}
+	}
+
+	return true
+}
+
+// supersedesLatest reports whether a checkpoint is another for the number
+// of our latest that covers it. The caller must hold the lock.
+func (l *ledger) supersedesLatest(cp *models.Checkpoint) bool {
+	if len(l.checkpoints) == 0 {
+		return false
+	}
+
+	latest := &l.checkpoints[len(l.checkpoints)-1]
+	return cp.Number == latest.Number && cp.Prev == latest.Prev &&
+		cp.ID() != latest.ID() && cp.Covers(latest)
+}
+
+// checkCertified checks a checkpoint follows ours, or supersedes our
+// latest, and is signed by a quorum of the weight the checkpoint before it
+// gives. The caller must hold the lock.
+func (l *ledger) checkCertified(cp *models.Checkpoint) error {
+	weights := l.baseBalances()
+	if l.supersedesLatest(cp) {
+		weights = l.genesis
+		if len(l.checkpoints) > 1 {
+			weights = l.checkpoints[len(l.checkpoints)-2].Balances
+		}
+	} else if err := l.checkFollows(cp); err != nil {
+		return err
+	}
+
+	if err := fcrypto.VerifyCheckpointCertificate(cp, weights); err != nil {
+		return fmt.Errorf("checkpoint %d is not certified: %v", cp.Number, err)
+	}
+
+	return nil
+}
+
+// CheckCertified is checkCertified for callers that don't hold the lock
+func (l *ledger) CheckCertified(cp *models.Checkpoint) error {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	return l.checkCertified(cp)
+}
+
+// applyCheckpoint makes a certified checkpoint the base of the ledger. The
+// txs it covers are pruned, along with any we hold pending for sequence
+// numbers it covers as they can never commit. Commits we are missing below
+// its heads are no longer needed. A certified checkpoint that covers our
+// latest for the same number replaces it, so nodes that applied either one
+// end up on the same.
+func (l *ledger) applyCheckpoint(cp *models.Checkpoint) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := l.checkCertified(cp); err != nil {
+		return err
+	}
+	replace := l.supersedesLatest(cp)
+
+	for from, base := range l.base {
+		if cp.Heads[from] < base {
+			return fmt.Errorf("checkpoint %d moves the head of %s back", cp.Number, from)
+		}
+	}
+
+	for from, head := range cp.Heads {
+		txs := l.txs[from]
+		pruned := min(head-l.base[from], len(txs))
+		for i := 0; i < pruned; i++ {
+			if !txs[i].Comitted {
+				l.releasePending(&txs[i])
+			}
+		}
+
+		if pruned == len(txs) {
+			delete(l.txs, from)
+		} else {
+			l.txs[from] = append([]models.Tx(nil), txs[pruned:]...)
+		}
+		l.base[from] = head
+
+		for seq := range l.buffered[from] {
+			if seq < head {
+				delete(l.buffered[from], seq)
+			}
+		}
+		for seq := range l.signed[from] {
+			if seq < head {
+				delete(l.signed[from], seq)
+			}
+		}
+		if len(l.signed[from]) == 0 {
+			delete(l.signed, from)
+		}
+		l.drainBuffered(from)
+	}
+
+	applied := *cp
+	applied.Signers = append([]models.Verifier(nil), cp.Signers...)
+	if replace {
+		l.checkpoints[len(l.checkpoints)-1] = applied
+	} else {
+		l.checkpoints = append(l.checkpoints, applied)
+	}
+	for number := range l.votes {
+		if number <= cp.Number {
+			delete(l.votes, number)
+		}
+	}
+
+	if err := l.rebuildState(); err != nil {
+		log.Printf("Could not calculate balances %v", err)
+	}
+
+	//The log may hold records for the pruned txs so it is replaced now
+	l.writeSnapshot()
+	log.Printf("Applied checkpoint %d at height %d", cp.Number, cp.Height())
+
+	return nil
+}
+
+// startCheckpointServer signs checkpoints proposed by peers that match our
+// own commits. If the checkpoint covers commits we don't have we sync them
+// from the proposer first.
+func (n *Node) startCheckpointServer() {
+	n.Host.SetStreamHandler(n.protocolID(checkpointProtocol), func(s network.Stream) {
+		defer s.Close()
+
+		data, err := transport.ReceiveBytesMax(s, maxCheckpointBytes)
+		if err != nil {
+			log.Printf("Could not read checkpoint %v", err)
+			return
+		}
+
+		var cp models.Checkpoint
+		if err = json.Unmarshal(data, &cp); err != nil {
+			log.Printf("Could not unmarshal checkpoint %v", err)
+			return
+		}
+
+		if cp.Network != n.networkID {
+			log.Printf("Checkpoint is for network %s", cp.Network)
+			return
+		}
+
+		err = n.ledger.voteCheckpoint(&cp)
+		var aheadErr *checkpointAheadError
+		if errors.As(err, &aheadErr) {
+			if err = n.syncFrom(s.Conn().RemotePeer()); err == nil {
+				err = n.ledger.voteCheckpoint(&cp)
+			}
+		}
+
+		if err != nil {
+			log.Printf("Won't sign checkpoint %d %v", cp.Number, err)
+			return
+		}
+
+		signer, err := fcrypto.CreateCheckpointSigner(&cp, n.privKey)
+		if err != nil {
+			log.Printf("Could not sign checkpoint %v", err)
+			return
+		}
+
+		msg, err := json.Marshal(signer)
+		if err != nil {
+			log.Printf("Could not marshal signer %v", err)
+			return
+		}
+
+		if err = transport.SendBytes(msg, s); err != nil {
+			log.Printf("Could not send signer %v", err)
+		}
+	})
+}
+
+func (n *Node) requestCheckpointSig(cp *models.Checkpoint, p peer.ID) (*models.Verifier, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	stream, err := n.Host.NewStream(ctx, p, n.protocolID(checkpointProtocol))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open stream: %v", err)
+	}
+
+	defer stream.Close()
+
+	//The peer may sync from us before it answers
+	stream.SetDeadline(time.Now().Add(syncBatchTimeout))
+
+	msg, err := json.Marshal(cp)
+	if err != nil {
+		return nil, fmt.Errorf("error marshalling struct to JSON: %v", err)
+	}
+
+	if err = transport.SendBytes(msg, stream); err != nil {
+		return nil, fmt.Errorf("failed to send checkpoint: %v", err)
+	}
+
+	data, err := transport.ReceiveBytesMax(stream, maxCheckpointBytes)
+	if err != nil || len(data) == 0 {
+		return nil, fmt.Errorf("failed to receive signer: %v", err)
+	}
+
+	var signer models.Verifier
+	if err = json.Unmarshal(data, &signer); err != nil {
+		return nil, fmt.Errorf("could not unmarshal signer: %v", err)
+	}
+
+	if signer.ID != p.String() {
+		return nil, fmt.Errorf("signer %s is not the peer asked", signer.ID)
+	}
+
+	result, err := fcrypto.VerifyCheckpointSigner(&signer, cp)
+	if err != nil {
+		return nil, fmt.Errorf("failed to verify signer: %v", err)
+	}
+
+	if !result {
+		return nil, fmt.Errorf("invalid sig")
+	}
+
+	return &signer, nil
+}
+
+// Checkpoint proposes a checkpoint of everything we hold committed, gets
+// it signed by our peers and, once it is certified, prunes the txs it
+// covers and gossips it. It returns nil if nothing was committed since the
+// latest checkpoint.
+func (n *Node) Checkpoint() (*models.Checkpoint, error) {
+	cp, err := n.ledger.proposeCheckpoint()
+	if err != nil || cp == nil {
+		return nil, err
+	}
+	cp.Network = n.networkID
+
+	if err = n.ledger.voteCheckpoint(cp); err != nil {
+		return nil, fmt.Errorf("could not vote for checkpoint: %v", err)
+	}
+
+	signer, err := fcrypto.CreateCheckpointSigner(cp, n.privKey)
+	if err != nil {
+		return nil, fmt.Errorf("could not sign checkpoint: %v", err)
+	}
+	cp.Signers = append(cp.Signers, *signer)
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, p := range n.Host.Network().Peers() {
+		wg.Add(1)
+		go func(p peer.ID) {
+			defer wg.Done()
+
+			signer, err := n.requestCheckpointSig(cp, p)
+			if err != nil {
+				log.Printf("Peer %s did not sign checkpoint %d %v", p, cp.Number, err)
+				return
+			}
+
+			mu.Lock()
+			cp.Signers = append(cp.Signers, *signer)
+			mu.Unlock()
+		}(p)
+	}
+	wg.Wait()
+
+	if err = n.ledger.applyCheckpoint(cp); err != nil {
+		return nil, err
+	}
+
+	msg, err := json.Marshal(cp)
+	if err != nil {
+		return nil, fmt.Errorf("could not marshal checkpoint: %v", err)
+	}
+	n.checkpoints.Publish(msg)
+
+	return cp, nil
+}
+
+// LatestCheckpoint returns the latest certified checkpoint the node has
+// applied
+func (n *Node) LatestCheckpoint() (models.Checkpoint, bool) {
+	return n.ledger.LatestCheckpoint()
+}
+
+// startCheckpoints proposes a checkpoint about every interval. The wait is
+// jittered so nodes don't all propose at once and split the vote.
+func (n *Node) startCheckpoints(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+
+	go func() {
+		for {
+			time.Sleep(interval/2 + time.Duration(rand.Int63n(int64(interval))))
+
+			cp, err := n.Checkpoint()
+			if err != nil {
+				log.Printf("Could not checkpoint %v", err)
+				continue
+			}
+
+			if cp != nil {
+				log.Printf("Checkpoint %d certified by %d signers", cp.Number, len(cp.Signers))
+			}
+		}
+	}()
+}
+
+// validateCheckpointMsg is the checkpoint topic's validator. Only the next
+// certified checkpoint is gossiped on. If we are further behind we catch up
+// from the peer that sent it.
+func (n *Node) validateCheckpointMsg(from peer.ID, data []byte) error {
+	var cp models.Checkpoint
+	if err := json.Unmarshal(data, &cp); err != nil {
+		return fmt.Errorf("could not unmarshal checkpoint: %v", err)
+	}
+
+	if cp.Network != n.networkID {
+		return fmt.Errorf("checkpoint is for network %s", cp.Network)
+	}
+
+	if latest, _ := n.ledger.LatestCheckpoint(); cp.Number > latest.Number+1 {
+		go func() {
+			if err := n.syncCheckpoints(from); err != nil {
+				log.Printf("Could not sync checkpoints from %s %v", from, err)
+			}
+		}()
+	}
+
+	return n.ledger.CheckCertified(&cp)
+}
+
+func (n *Node) handleCheckpointMsg(from peer.ID, data []byte) {
+	var cp models.Checkpoint
+	if err := json.Unmarshal(data, &cp); err != nil {
+		return
+	}
+
+	if err := n.ledger.applyCheckpoint(&cp); err != nil {
+		log.Printf("Could not apply checkpoint %d %v", cp.Number, err)
+	}
+}
+
+// startCheckpointSyncServer answers the number of a peer's latest
+// checkpoint with the ones after it, one per message, and an empty message
+// ends the stream
+func (n *Node) startCheckpointSyncServer() {
+	n.Host.SetStreamHandler(n.protocolID(checkpointSyncProtocol), func(s network.Stream) {
+		defer s.Close()
+
+		data, err := transport.ReceiveBytesMax(s, maxAccountIDBytes)
+		if err != nil {
+			log.Printf("Could not read checkpoint number %v", err)
+			return
+		}
+
+		number, err := strconv.Atoi(string(data))
+		if err != nil {
+			log.Printf("Invalid checkpoint number %v", err)
+			return
+		}
+
+		for _, cp := range n.ledger.checkpointsAfter(number) {
+			msg, err := json.Marshal(&cp)
+			if err != nil {
+				log.Printf("Could not marshal checkpoint %v", err)
+				return
+			}
+
+			if err = transport.SendBytes(msg, s); err != nil {
+				log.Printf("Could not send checkpoint %v", err)
+				return
+			}
+		}
+
+		transport.SendBytes(nil, s)
+	})
+}
+
+// syncCheckpoints pulls the checkpoints after our latest from a peer. Each
+// must be certified by the weight of the one before it, starting from
+// genesis, so a new node can trust the balances without the txs behind
+// them.
+func (n *Node) syncCheckpoints(p peer.ID) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	stream, err := n.Host.NewStream(ctx, p, n.protocolID(checkpointSyncProtocol))
+	if err != nil {
+		return fmt.Errorf("failed to open stream: %v", err)
+	}
+
+	defer stream.Close()
+
+	latest, _ := n.ledger.LatestCheckpoint()
+	if err = transport.SendBytes([]byte(strconv.Itoa(latest.Number)), stream); err != nil {
+		return fmt.Errorf("failed to send checkpoint number: %v", err)
+	}
+
+	applied := 0
+	for {
+		stream.SetReadDeadline(time.Now().Add(syncBatchTimeout))
+
+		data, err := transport.ReceiveBytesMax(stream, maxCheckpointBytes)
+		if err != nil {
+			return fmt.Errorf("failed to receive checkpoint after %d: %v", applied, err)
+		}
+
+		if len(data) == 0 {
+			break
+		}
+
+		var cp models.Checkpoint
+		if err = json.Unmarshal(data, &cp); err != nil {
+			return n.reportPeer(p, fmt.Errorf("could not unmarshal checkpoint: %v", err))
+		}
+
+		if cp.Network != n.networkID {
+			return n.reportPeer(p, fmt.Errorf("sent checkpoint for network %s", cp.Network))
+		}
+
+		if err = n.ledger.applyCheckpoint(&cp); err != nil {
+			//Gossip may have got the checkpoint to us first
+			if current, _ := n.ledger.LatestCheckpoint(); cp.Number <= current.Number {
+				continue
+			}
+			return n.reportPeer(p, err)
+		}
+		applied++
+	}
+
+	if applied > 0 {
+		log.Printf("Synced %d checkpoints from %s", applied, p)
+	}
+	return nil
+}
@@ -0,0 +1,328 @@
+package node
+
+import (
+	"testing"
+	"time"
+
+	fcrypto "github.com/ackhia/flash/crypto"
+	"github.com/ackhia/flash/models"
+	"github.com/libp2p/go-libp2p/core/host"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckpoint_PrunesCoveredTxs(t *testing.T) {
+	node1, node2, node3 := createNetworkThreePeers(t, 1000, 1000, 1000)
+
+	addr1 := node1.Host.ID().String()
+	addr2 := node2.Host.ID().String()
+	for _, amount := range []models.Amount{10, 20} {
+		_, err := node1.Transfer(addr2, amount)
+		assert.NoError(t, err)
+	}
+	root := node1.StateRoot()
+
+	cp, err := node1.Checkpoint()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, cp.Number)
+	assert.Equal(t, 2, cp.Height())
+	assert.Len(t, cp.Signers, 3)
+
+	//The checkpoint is gossiped and every node prunes the txs it covers
+	for _, n := range []*Node{node1, node2, node3} {
+		latest, ok := n.LatestCheckpoint()
+		assert.True(t, ok)
+		assert.Equal(t, cp.ID(), latest.ID())
+		assert.Empty(t, n.Txs())
+		assert.Empty(t, n.TxsTo(addr2))
+		assert.Equal(t, models.Amount(970), n.Balance(addr1))
+		assert.Equal(t, models.Amount(1030), n.Balance(addr2))
+		assert.Equal(t, models.AccountHead{Committed: 2, Next: 2}, n.AccountHead(addr1))
+		assert.Equal(t, root, n.StateRoot())
+
+		//What a verifier signed is only kept until a checkpoint covers it
+		n.ledger.mu.RLock()
+		assert.Empty(t, n.ledger.signed)
+		n.ledger.mu.RUnlock()
+	}
+
+	//Nothing new to checkpoint
+	cp, err = node2.Checkpoint()
+	assert.NoError(t, err)
+	assert.Nil(t, cp)
+
+	//Sequence numbers carry on from the checkpoint
+	_, err = node1.Transfer(addr2, 30)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, node3.Txs()[addr1][0].SequenceNum)
+	assert.Equal(t, models.Amount(940), node3.Balance(addr1))
+
+	cp, err = node2.Checkpoint()
+	assert.NoError(t, err)
+	assert.Equal(t, 2, cp.Number)
+	assert.Equal(t, 3, cp.Height())
+	assert.Empty(t, node1.Txs())
+}
+
+func TestCheckpoint_Bootstrap(t *testing.T) {
+	server, client := createNetworkTwoPeers(t, 1000, 3000)
+
+	from := client.Host.ID().String()
+	to := server.Host.ID().String()
+	_, err := client.Transfer(to, 10)
+	assert.NoError(t, err)
+
+	_, err = server.Checkpoint()
+	assert.NoError(t, err)
+
+	_, err = client.Transfer(to, 20)
+	assert.NoError(t, err)
+
+	//The server starts again with an empty ledger and bootstraps from the
+	//checkpoint and the txs after it
+	restarted := New(server.privKey, &server.Host, server.ledger.genesis, []string{createMultiaddress(t, client)}, "")
+	assert.NoError(t, restarted.Start())
+
+	latest, ok := restarted.LatestCheckpoint()
+	assert.True(t, ok)
+	assert.Equal(t, 1, latest.Number)
+	assert.Len(t, restarted.Txs()[from], 1)
+	assert.Equal(t, 1, restarted.Txs()[from][0].SequenceNum)
+	assert.Equal(t, models.Amount(970), restarted.Balance(from))
+	assert.Equal(t, models.Amount(3030), restarted.Balance(to))
+	assert.Equal(t, client.StateRoot(), restarted.StateRoot())
+}
+
+func TestCheckpoint_Persisted(t *testing.T) {
+	mn := mocknet.New()
+
+	clientHost, err := mn.GenPeer()
+	assert.NoError(t, err)
+
+	serverHost, err := mn.GenPeer()
+	assert.NoError(t, err)
+
+	assert.NoError(t, mn.LinkAll())
+
+	from := clientHost.ID().String()
+	to := serverHost.ID().String()
+	genesis := map[string]models.Amount{from: 1000, to: 3000}
+
+	dataDir := t.TempDir()
+	serverNode := New(serverHost.Peerstore().PrivKey(serverHost.ID()), &serverHost, genesis, []string{}, dataDir)
+	assert.NoError(t, serverNode.Start())
+
+	clientNode := New(clientHost.Peerstore().PrivKey(clientHost.ID()), &clientHost, genesis, []string{createMultiaddress(t, serverNode)}, "")
+	assert.NoError(t, clientNode.Start())
+
+	_, err = clientNode.Transfer(to, 10)
+	assert.NoError(t, err)
+
+	_, err = serverNode.Checkpoint()
+	assert.NoError(t, err)
+
+	_, err = clientNode.Transfer(to, 20)
+	assert.NoError(t, err)
+	serverNode.ledger.close()
+
+	//Restart the server from its data dir without any bootstrap peers
+	restartedHost, err := mn.GenPeer()
+	assert.NoError(t, err)
+
+	restarted := New(restartedHost.Peerstore().PrivKey(restartedHost.ID()), &restartedHost, genesis, []string{}, dataDir)
+	assert.NoError(t, restarted.Start())
+
+	latest, ok := restarted.LatestCheckpoint()
+	assert.True(t, ok)
+	assert.Equal(t, 1, latest.Number)
+	assert.Len(t, restarted.Txs()[from], 1)
+	assert.Equal(t, models.AccountHead{Committed: 2, Next: 2}, restarted.AccountHead(from))
+	assert.Equal(t, models.Amount(970), restarted.Balance(from))
+	assert.Equal(t, models.Amount(3030), restarted.Balance(to))
+	assert.Equal(t, clientNode.StateRoot(), restarted.StateRoot())
+}
+
+func TestLedger_VoteCheckpoint(t *testing.T) {
+	l := newLedger(map[string]models.Amount{"Alice": 100, "Bob": 50})
+	l.txs["Alice"] = []models.Tx{{From: "Alice", To: "Bob", Amount: 10, Comitted: true}}
+	assert.NoError(t, l.rebuildState())
+
+	cp, err := l.proposeCheckpoint()
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]int{"Alice": 1}, cp.Heads)
+	assert.Equal(t, map[string]models.Amount{"Alice": 90, "Bob": 60}, cp.Balances)
+
+	wrong := *cp
+	wrong.Balances = map[string]models.Amount{"Alice": 80, "Bob": 70}
+	assert.Error(t, l.voteCheckpoint(&wrong))
+
+	ahead := *cp
+	ahead.Heads = map[string]int{"Alice": 2}
+	assert.Error(t, l.voteCheckpoint(&ahead))
+
+	assert.NoError(t, l.voteCheckpoint(cp))
+	assert.NoError(t, l.voteCheckpoint(cp))
+
+	//Once one is signed for a number, however long ago, only one covering
+	//it is signed for that number
+	l.txs["Bob"] = []models.Tx{{From: "Bob", To: "Alice", Amount: 5, Comitted: true}}
+	assert.NoError(t, l.rebuildState())
+	other := otherCheckpoint(cp)
+	assert.NoError(t, l.voteCheckpoint(other))
+	assert.Error(t, l.voteCheckpoint(cp))
+
+	again, err := l.proposeCheckpoint()
+	assert.NoError(t, err)
+	assert.Equal(t, other.ID(), again.ID())
+
+	//The vote is proposed again while our commits don't cover it
+	l.txs["Bob"] = nil
+	assert.NoError(t, l.rebuildState())
+	again, err = l.proposeCheckpoint()
+	assert.NoError(t, err)
+	assert.Equal(t, other.ID(), again.ID())
+
+	//Certifying needs the signers
+	assert.Error(t, l.applyCheckpoint(cp))
+}
+
+// otherCheckpoint is a checkpoint for the same number as cp that also
+// covers Bob's tx to Alice
+func otherCheckpoint(cp *models.Checkpoint) *models.Checkpoint {
+	other := *cp
+	other.Heads = map[string]int{"Alice": 1, "Bob": 1}
+	other.Balances = map[string]models.Amount{"Alice": 95, "Bob": 55}
+
+	return &other
+}
+
+func TestLedger_VotePersisted(t *testing.T) {
+	dataDir := t.TempDir()
+	genesis := map[string]models.Amount{"Alice": 100, "Bob": 50}
+	l := newLedger(genesis)
+	assert.NoError(t, l.open(dataDir))
+
+	assert.NoError(t, l.commit(&models.Tx{SequenceNum: 0, From: "Alice", To: "Bob", Amount: 10, Sig: []byte("alice")}))
+	assert.NoError(t, l.commit(&models.Tx{SequenceNum: 0, From: "Bob", To: "Alice", Amount: 5, Sig: []byte("bob")}))
+	cp, err := l.proposeCheckpoint()
+	assert.NoError(t, err)
+	assert.NoError(t, l.voteCheckpoint(cp))
+	assert.NoError(t, l.close())
+
+	smaller := *cp
+	smaller.Heads = map[string]int{"Alice": 1}
+	smaller.Balances = map[string]models.Amount{"Alice": 90, "Bob": 60}
+
+	//The log keeps the vote and so does the snapshot replacing it
+	for i := 0; i < 2; i++ {
+		restarted := newLedger(genesis)
+		assert.NoError(t, restarted.open(dataDir))
+		assert.Error(t, restarted.voteCheckpoint(&smaller))
+		assert.NoError(t, restarted.voteCheckpoint(cp))
+
+		proposed, err := restarted.proposeCheckpoint()
+		assert.NoError(t, err)
+		assert.Equal(t, cp.ID(), proposed.ID())
+
+		restarted.mu.Lock()
+		restarted.writeSnapshot()
+		restarted.mu.Unlock()
+		assert.NoError(t, restarted.close())
+	}
+}
+
+func TestCheckpoint_SplitVote(t *testing.T) {
+	node1, node2, node3 := createNetworkThreePeers(t, 1000, 1000, 1000)
+	nodes := []*Node{node1, node2, node3}
+
+	addr1 := node1.Host.ID().String()
+	addr2 := node2.Host.ID().String()
+
+	//Each node signs a checkpoint at a different height so none of them
+	//has a quorum
+	var proposals []*models.Checkpoint
+	for _, amount := range []models.Amount{10, 20, 30} {
+		_, err := node1.Transfer(addr2, amount)
+		assert.NoError(t, err)
+
+		cp, err := node1.ledger.proposeCheckpoint()
+		assert.NoError(t, err)
+		cp.Network = node1.networkID
+		proposals = append(proposals, cp)
+	}
+	assert.Eventually(t, func() bool {
+		for _, n := range nodes {
+			if n.AccountHead(addr1).Committed != 3 {
+				return false
+			}
+		}
+		return true
+	}, 5*time.Second, 10*time.Millisecond)
+
+	for i, n := range nodes {
+		assert.NoError(t, n.ledger.voteCheckpoint(proposals[i]))
+	}
+	assert.Error(t, node3.ledger.voteCheckpoint(proposals[0]))
+
+	//A proposal covering every side of the split is signed by all
+	cp, err := node1.Checkpoint()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, cp.Number)
+	assert.Equal(t, 3, cp.Height())
+	assert.Len(t, cp.Signers, 3)
+
+	for _, n := range nodes {
+		assert.Eventually(t, func() bool {
+			latest, ok := n.LatestCheckpoint()
+			return ok && latest.ID() == cp.ID()
+		}, 5*time.Second, 10*time.Millisecond)
+		assert.Equal(t, models.Amount(940), n.Balance(addr1))
+	}
+}
+
+func TestLedger_CoveringCheckpointSupersedes(t *testing.T) {
+	mn := mocknet.New()
+
+	var hosts []host.Host
+	genesis := make(map[string]models.Amount)
+	for range 3 {
+		h, err := mn.GenPeer()
+		assert.NoError(t, err)
+		hosts = append(hosts, h)
+		genesis[h.ID().String()] = 1000
+	}
+
+	alice := hosts[0].ID().String()
+	bob := hosts[1].ID().String()
+	l := newLedger(genesis)
+	l.txs[alice] = []models.Tx{
+		{SequenceNum: 0, From: alice, To: bob, Amount: 10, Comitted: true},
+		{SequenceNum: 1, From: alice, To: bob, Amount: 20, Comitted: true},
+	}
+	assert.NoError(t, l.rebuildState())
+
+	certify := func(heads map[string]int, balances map[string]models.Amount) *models.Checkpoint {
+		cp := &models.Checkpoint{Number: 1, Heads: heads, Balances: balances}
+		for _, h := range hosts[:2] {
+			signer, err := fcrypto.CreateCheckpointSigner(cp, h.Peerstore().PrivKey(h.ID()))
+			assert.NoError(t, err)
+			cp.Signers = append(cp.Signers, *signer)
+		}
+		return cp
+	}
+	smaller := certify(map[string]int{alice: 1}, map[string]models.Amount{alice: 990, bob: 1010, hosts[2].ID().String(): 1000})
+	larger := certify(map[string]int{alice: 2}, map[string]models.Amount{alice: 970, bob: 1030, hosts[2].ID().String(): 1000})
+
+	//The larger of two certified checkpoints for a number replaces the
+	//smaller but never the other way round
+	assert.NoError(t, l.applyCheckpoint(smaller))
+	assert.NoError(t, l.applyCheckpoint(larger))
+	assert.Error(t, l.applyCheckpoint(smaller))
+
+	latest, ok := l.LatestCheckpoint()
+	assert.True(t, ok)
+	assert.Equal(t, larger.ID(), latest.ID())
+	assert.Len(t, l.checkpoints, 1)
+	assert.Empty(t, l.txs[alice])
+	assert.Equal(t, models.Amount(970), l.Balance(alice))
+}
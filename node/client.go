@@ -6,8 +6,8 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
 	"log"
+	"sync"
 	"time"
 
 	fcrypto "github.com/ackhia/flash/crypto"
@@ -17,115 +17,226 @@ import (
 	"github.com/libp2p/go-libp2p/core/protocol"
 )
 
-func (n Node) getTransactions(addrInfo string) (map[string][]models.Tx, error) {
+// connect connects to a peer and checks it is on our network
+func (n *Node) connect(addrInfo string) (peer.ID, error) {
 	serverAddr, err := peer.AddrInfoFromString(addrInfo)
 
 	if err != nil {
-		return nil, fmt.Errorf("invalid address %s %v", addrInfo, err)
+		return "", fmt.Errorf("invalid address %s %v", addrInfo, err)
 	}
 
 	n.Host.Connect(context.Background(), *serverAddr)
 
-	stream, err := n.Host.NewStream(context.Background(), serverAddr.ID, protocol.ID("/flash/transactions/1.0.0"))
+	if err = n.handshake(serverAddr.ID); err != nil {
+		return "", err
+	}
+
+	return serverAddr.ID, nil
+}
+
+// handshake checks the peer is on the same network and disconnects from it
+// if not
+func (n *Node) handshake(p peer.ID) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
 
+	stream, err := n.Host.NewStream(ctx, p, protocol.ID(handshakeProtocol))
 	if err != nil {
-		return nil, fmt.Errorf("could not create stream %v", err)
+		return fmt.Errorf("failed to open stream: %v", err)
 	}
 
 	defer stream.Close()
 
-	data, _ := io.ReadAll(stream)
+	err = transport.SendBytes(n.networkID[:], stream)
+	if err != nil {
+		return fmt.Errorf("failed to send handshake: %v", err)
+	}
+
+	data, err := transport.ReceiveBytesMax(stream, int64(len(n.networkID)))
+	if err != nil {
+		return fmt.Errorf("failed to receive handshake: %v", err)
+	}
 
-	txs := make(map[string][]models.Tx)
-	if err = json.Unmarshal(data, &txs); err != nil {
-		return nil, fmt.Errorf("could not unmarshal transactions")
+	if !bytes.Equal(data, n.networkID[:]) {
+		n.Host.Network().ClosePeer(p)
+		return fmt.Errorf("peer %s is on network %x not %s", p, data, n.networkID)
 	}
 
-	return txs, nil
+	return nil
 }
 
-func (n Node) fetchVerifications(tx *models.Tx) error {
-	peers := n.Host.Peerstore().Peers()
+// fetchVerifications asks peers to verify tx in parallel, heaviest voting
+// weight first, and cancels the outstanding requests as soon as the
+// verifiers collected hold a quorum
+func (n *Node) fetchVerifications(tx *models.Tx) error {
+	weights := n.ledger.Balances()
+	var total models.Amount
+	for _, w := range weights {
+		var err error
+		if total, err = total.Add(w); err != nil {
+			return fmt.Errorf("total weight overflows: %v", err)
+		}
+	}
 
-	for _, p := range peers {
+	var peers []peer.ID
+	for _, p := range n.Host.Peerstore().Peers() {
 
 		//Don't connect to myself
-		if p == n.Host.ID() {
+		if p != n.Host.ID() {
+			peers = append(peers, p)
+		}
+	}
+	n.peerStats.order(peers, weights)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	//The workers only read the request so they don't race with the
+	//verifiers being added to tx below
+	req := *tx
+	req.Verifiers = nil
+
+	type result struct {
+		p        peer.ID
+		verifier *models.Verifier
+		err      error
+	}
+	results := make(chan result)
+
+	go func() {
+		var wg sync.WaitGroup
+		sem := make(chan struct{}, maxParallelVerifications)
+
+	launch:
+		for _, p := range peers {
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				break launch
+			}
+
+			wg.Add(1)
+			go func(p peer.ID) {
+				defer wg.Done()
+				defer func() { <-sem }()
+
+				start := time.Now()
+				v, err := n.requestVerification(ctx, &req, p)
+				if ctx.Err() == nil || err == nil {
+					n.peerStats.record(p, time.Since(start), err)
+				}
+				results <- result{p, v, err}
+			}(p)
+		}
+
+		wg.Wait()
+		close(results)
+	}()
+
+	var signed models.Amount
+	for r := range results {
+		if r.err != nil {
+			if ctx.Err() == nil {
+				log.Printf("Error sending tx to peer %s: %v", r.p, r.err)
+			}
 			continue
 		}
 
-		err := n.getNodeVerification(tx, p)
-		if err != nil {
-			log.Printf("Error sending tx to peer %s: %v", p, err)
-		} else {
-			log.Printf("Message sent to peer %s\n", p)
+		log.Printf("Verification received from peer %s", r.p)
+		tx.Verifiers = append(tx.Verifiers, *r.verifier)
+		//signed can't pass total as each peer answers once
+		signed, _ = signed.Add(weights[r.verifier.ID])
+		if signed > total/2 {
+			cancel()
 		}
 	}
+
+	return nil
+}
+
+// getNodeVerification asks a single peer to verify tx and adds its verifier
+// to tx
+func (n *Node) getNodeVerification(tx *models.Tx, p peer.ID) error {
+	v, err := n.requestVerification(context.Background(), tx, p)
+	if err != nil {
+		return err
+	}
+
+	tx.Verifiers = append(tx.Verifiers, *v)
 	return nil
 }
 
-func (n Node) getNodeVerification(tx *models.Tx, p peer.ID) error {
+func (n *Node) requestVerification(ctx context.Context, tx *models.Tx, p peer.ID) (*models.Verifier, error) {
 	log.Printf("Connecting to %s", p)
 
-	protocolID := protocol.ID(verifyTxProtocol)
+	protocolID := n.protocolID(verifyTxProtocol)
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
 	defer cancel()
 
 	stream, err := n.Host.NewStream(ctx, p, protocolID)
 	if err != nil {
-		return fmt.Errorf("failed to open stream: %v", err)
+		return nil, fmt.Errorf("failed to open stream: %v", err)
 	}
 
 	defer stream.Close()
 
+	//Abort the exchange if the request is cancelled or times out
+	stop := context.AfterFunc(ctx, func() { stream.Reset() })
+	defer stop()
+
 	msg, err := json.Marshal(tx)
 	if err != nil {
-		return fmt.Errorf("error marshalling struct to JSON: %v", err)
+		return nil, fmt.Errorf("error marshalling struct to JSON: %v", err)
 	}
 
 	log.Print("Sending verification request")
 
 	err = transport.SendBytes(msg, stream)
 	if err != nil {
-		return fmt.Errorf("failed to write message: %v", err)
+		return nil, fmt.Errorf("failed to write message: %v", err)
 	}
 
 	log.Print("Verification request sent")
 
-	data, err := transport.ReceiveBytes(stream)
+	data, err := transport.ReceiveBytesMax(stream, maxVerifyMsgBytes)
 	if err != nil || len(data) == 0 {
-		return fmt.Errorf("failed to receive response: %v", err)
+		return nil, fmt.Errorf("failed to receive response: %v", err)
 	}
 
 	var verifier models.Verifier
-	verifier.Sig = data
-	verifier.ID = p.String()
+	if err = json.Unmarshal(data, &verifier); err != nil {
+		return nil, fmt.Errorf("could not unmarshal verifier: %v", err)
+	}
 
-	pubKey := n.Host.Peerstore().PubKey(p)
-	r, err := fcrypto.VerifyVerifier(&verifier, tx, pubKey, p)
+	if verifier.ID != p.String() {
+		return nil, fmt.Errorf("verifier %s is not the peer asked", verifier.ID)
+	}
+
+	r, err := fcrypto.VerifyVerifier(&verifier, tx)
 
 	if err != nil {
-		return fmt.Errorf("failed verify verifier: %v", err)
+		return nil, fmt.Errorf("failed verify verifier: %v", err)
 	}
 
 	if !r {
-		return fmt.Errorf("invalid sig")
+		return nil, fmt.Errorf("invalid sig")
 	}
 
-	tx.Verifiers = append(tx.Verifiers, verifier)
-
-	return nil
+	return &verifier, nil
 }
 
-func (n Node) VerifyTx(tx *models.Tx) error {
+func (n *Node) VerifyTx(tx *models.Tx) error {
 
 	err := n.fetchVerifications(tx)
 	if err != nil {
 		return err
 	}
 
-	n.Txs[n.Host.ID().String()] = append(n.Txs[n.Host.ID().String()], *tx)
+	err = n.ledger.addPending(*tx)
+	if err != nil {
+		return err
+	}
 
 	_, err = n.isVerifierConsensus(tx)
 	if err != nil {
@@ -135,9 +246,9 @@ func (n Node) VerifyTx(tx *models.Tx) error {
 	return nil
 }
 
-func (n *Node) BuildTx(from string, to string, amount float64, pubKey []byte) (*models.Tx, error) {
+func (n *Node) BuildTx(from string, to string, amount models.Amount, pubKey []byte) (*models.Tx, error) {
 
-	if amount <= 0 {
+	if amount == 0 {
 		return nil, errors.New("amount must be > 0")
 	}
 
@@ -146,97 +257,100 @@ func (n *Node) BuildTx(from string, to string, amount float64, pubKey []byte) (*
 		return nil, fmt.Errorf("invalid From peer ID: %v", err)
 	}
 
+	signer, err := fcrypto.PeerIDFromPubkey(pubKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if signer.String() != from {
+		return nil, fmt.Errorf("from %s does not match the public key %s", from, signer)
+	}
+
 	_, err = peer.Decode(to)
 	if err != nil {
 		return nil, fmt.Errorf("invalid To peer ID: %v", err)
 	}
 
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	//Never reuse a sequence number the ledger already holds for the sender
+	seq := max(n.nextSequenceNum, n.ledger.AccountHead(from).Next)
+
 	tx := models.Tx{
-		SequenceNum: n.nextSequenceNum,
+		Network:     n.networkID,
+		SequenceNum: seq,
 		From:        from,
 		To:          to,
 		Amount:      amount,
 		Pubkey:      pubKey,
 	}
-	n.nextSequenceNum++
+	n.nextSequenceNum = seq + 1
 
 	return &tx, nil
 }
 
-func (n Node) CommitTx(tx *models.Tx) {
+// CommitTx commits a certified tx locally and queues it for every peer. It
+// returns once the connected peers have acked it or failed, and the queue
+// keeps retrying those that haven't. A tx our own ledger rejects isn't sent.
+func (n *Node) CommitTx(tx *models.Tx) (*CommitCoverage, error) {
+	if err := n.ledger.commit(tx); err != nil && !n.ledger.hasCommitted(tx) {
+		return nil, fmt.Errorf("could not commit tx locally: %v", err)
+	}
+	tx.Comitted = true
 
-	peers := n.Host.Peerstore().Peers()
+	msg, err := json.Marshal(tx)
+	if err != nil {
+		return nil, fmt.Errorf("could not marshal commit: %v", err)
+	}
+
+	//Peers pass the commit on so nodes we aren't connected to learn of it
+	n.commits.markSeen(msg)
+	return n.outbox.add(tx, msg), nil
+}
 
-	for _, p := range peers {
+// fetchMissingTxs syncs from a peer to get the txs we need to apply
+// buffered commits
+func (n *Node) fetchMissingTxs(p peer.ID) {
+	if len(n.ledger.MissingTxs()) == 0 {
+		return
+	}
+
+	if err := n.syncFrom(p); err != nil {
+		log.Printf("Could not fetch missing txs from %s %v", p, err)
+	}
+}
+
+func (n *Node) broadcastEquivocation(proof *models.EquivocationProof) {
+	for _, p := range n.Host.Peerstore().Peers() {
 
 		//Don't connect to myself
 		if p == n.Host.ID() {
 			continue
 		}
 
-		err := n.sendPeerCommit(tx, p)
+		err := n.sendEquivocationProof(proof, p)
 		if err != nil {
-			log.Printf("Error sending commit tx to peer %s: %v", p, err)
-		} else {
-			log.Printf("Commit message sent to peer %s\n", p)
+			log.Printf("Error sending equivocation proof to peer %s: %v", p, err)
 		}
 	}
-
-	tx.Comitted = true
-	n.calcBalances()
 }
 
-func (n Node) sendPeerCommit(tx *models.Tx, p peer.ID) error {
-	log.Printf("Connecting to %s", p)
-
-	protocolID := protocol.ID(commitTxProtocol)
-
+func (n *Node) sendEquivocationProof(proof *models.EquivocationProof, p peer.ID) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	stream, err := n.Host.NewStream(ctx, p, protocolID)
+	stream, err := n.Host.NewStream(ctx, p, n.protocolID(equivocationProtocol))
 	if err != nil {
 		return fmt.Errorf("failed to open stream: %v", err)
 	}
 
 	defer stream.Close()
 
-	msg, err := json.Marshal(tx)
+	msg, err := json.Marshal(proof)
 	if err != nil {
 		return fmt.Errorf("error marshalling struct to JSON: %v", err)
 	}
 
-	log.Print("Sending verification request")
-
-	err = transport.SendBytes(msg, stream)
-	if err != nil {
-		return fmt.Errorf("failed to write message: %v", err)
-	}
-
-	log.Print("Verification request sent")
-
-	data, err := transport.ReceiveBytes(stream)
-	if err != nil || len(data) == 0 {
-		return fmt.Errorf("failed to receive response: %v", err)
-	}
-
-	if bytes.Compare(data, []byte("ok")) != 0 {
-		return fmt.Errorf("failed to commit tx")
-	}
-
-	var localTx *models.Tx
-	for i := range n.Txs[tx.From] {
-		t := &n.Txs[tx.From][i]
-		if bytes.Compare(t.Sig, tx.Sig) == 0 {
-			localTx = t
-			break
-		}
-	}
-
-	if localTx == nil {
-		return fmt.Errorf("Could not find local tx")
-	}
-
-	localTx.Comitted = true
-	return nil
+	return transport.SendBytes(msg, stream)
 }
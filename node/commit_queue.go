@@ -0,0 +1,338 @@
+package node
+
+import (
+	"encoding/json"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ackhia/flash/models"
+	"github.com/ackhia/flash/store"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// How long a commit we sent is kept for peers that haven't acked it, how
+// often due retries are sent and the backoff between retries to one peer
+const commitRetention = time.Hour
+const commitRetryInterval = time.Second
+const commitRetryBase = time.Second
+const commitRetryMax = time.Minute
+
+// CommitCoverage is how far a commit we sent has got: the peers that acked
+// it and the connected peers it is still being retried to
+type CommitCoverage struct {
+	Tx      models.TxID
+	Acked   []peer.ID
+	Pending []peer.ID
+	Queued  time.Time
+}
+
+type outboundCommit struct {
+	tx     models.Tx
+	msg    []byte
+	queued time.Time
+	acked  map[peer.ID]bool
+	// attempts and nextAttempt hold the backoff for each peer that hasn't
+	// acked yet
+	attempts    map[peer.ID]int
+	nextAttempt map[peer.ID]time.Time
+}
+
+// commitQueue delivers the commits we send to every connected peer until
+// each one acks, retrying with backoff and straight away when a peer
+// reconnects. It is written to the store so delivery carries on after a
+// restart.
+type commitQueue struct {
+	send  func(data []byte, p peer.ID) error
+	peers func() []peer.ID
+	wake  chan struct{}
+
+	mu      sync.Mutex
+	store   *store.Store
+	commits map[models.TxID]*outboundCommit
+}
+
+func newCommitQueue(send func([]byte, peer.ID) error, peers func() []peer.ID) *commitQueue {
+	return &commitQueue{
+		send:    send,
+		peers:   peers,
+		wake:    make(chan struct{}, 1),
+		commits: make(map[models.TxID]*outboundCommit),
+	}
+}
+
+func newOutboundCommit(tx *models.Tx, msg []byte, queued time.Time) *outboundCommit {
+	return &outboundCommit{
+		tx:          *tx,
+		msg:         msg,
+		queued:      queued,
+		acked:       make(map[peer.ID]bool),
+		attempts:    make(map[peer.ID]int),
+		nextAttempt: make(map[peer.ID]time.Time),
+	}
+}
+
+// load picks up the commits still being delivered when the node stopped.
+// The queue is only kept in memory when s is nil.
+func (q *commitQueue) load(s *store.Store) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.store = s
+	if s == nil {
+		return nil
+	}
+
+	queued, err := s.LoadCommitQueue()
+	if err != nil {
+		return err
+	}
+
+	for _, qc := range queued {
+		msg, err := json.Marshal(qc.Tx)
+		if err != nil {
+			log.Printf("Could not encode queued commit %v", err)
+			continue
+		}
+
+		c := newOutboundCommit(&qc.Tx, msg, qc.Queued)
+		for _, id := range qc.Acked {
+			p, err := peer.Decode(id)
+			if err != nil {
+				continue
+			}
+			c.acked[p] = true
+		}
+		q.commits[qc.Tx.ID()] = c
+	}
+
+	return nil
+}
+
+// add queues a commit for every peer and sends it to those connected. It
+// returns how far the commit got once they have acked or failed.
+func (q *commitQueue) add(tx *models.Tx, msg []byte) *CommitCoverage {
+	id := tx.ID()
+	now := time.Now()
+	peers := q.peers()
+
+	q.mu.Lock()
+	c, ok := q.commits[id]
+	if !ok {
+		c = newOutboundCommit(tx, msg, now)
+		q.commits[id] = c
+		q.persist()
+	}
+	attempts := c.due(id, peers, now)
+	q.mu.Unlock()
+
+	q.attempt(attempts)
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return c.coverage(id, peers)
+}
+
+// deliver sends each commit to the connected peers that haven't acked it
+// and are due a retry. Commits older than commitRetention are dropped.
+func (q *commitQueue) deliver(now time.Time) {
+	peers := q.peers()
+
+	q.mu.Lock()
+	var attempts []deliveryAttempt
+	expired := false
+	for id, c := range q.commits {
+		if now.Sub(c.queued) > commitRetention {
+			delete(q.commits, id)
+			expired = true
+			continue
+		}
+
+		attempts = append(attempts, c.due(id, peers, now)...)
+	}
+
+	if expired {
+		q.persist()
+	}
+	q.mu.Unlock()
+
+	q.attempt(attempts)
+}
+
+type deliveryAttempt struct {
+	id  models.TxID
+	p   peer.ID
+	msg []byte
+}
+
+// due returns an attempt for each of peers that hasn't acked the commit and
+// is due a retry. The next retry is scheduled straight away so an attempt
+// still in flight isn't sent again. The caller must hold the queue's lock.
+func (c *outboundCommit) due(id models.TxID, peers []peer.ID, now time.Time) []deliveryAttempt {
+	var attempts []deliveryAttempt
+	for _, p := range peers {
+		if c.acked[p] || now.Before(c.nextAttempt[p]) {
+			continue
+		}
+
+		c.nextAttempt[p] = now.Add(retryBackoff(c.attempts[p]))
+		c.attempts[p]++
+		attempts = append(attempts, deliveryAttempt{id: id, p: p, msg: c.msg})
+	}
+
+	return attempts
+}
+
+// attempt sends commits in parallel and records the peers that acked
+func (q *commitQueue) attempt(attempts []deliveryAttempt) {
+	var wg sync.WaitGroup
+	acks := make(chan deliveryAttempt, len(attempts))
+	for _, a := range attempts {
+		wg.Add(1)
+		go func(a deliveryAttempt) {
+			defer wg.Done()
+
+			if err := q.send(a.msg, a.p); err != nil {
+				log.Printf("Could not deliver commit %s to %s %v", a.id, a.p, err)
+				return
+			}
+			acks <- a
+		}(a)
+	}
+	wg.Wait()
+	close(acks)
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	acked := false
+	for a := range acks {
+		c, ok := q.commits[a.id]
+		if !ok {
+			continue
+		}
+
+		c.acked[a.p] = true
+		delete(c.attempts, a.p)
+		delete(c.nextAttempt, a.p)
+		acked = true
+	}
+
+	if acked {
+		q.persist()
+	}
+}
+
+// retryBackoff doubles the wait after each failed attempt up to
+// commitRetryMax
+func retryBackoff(attempts int) time.Duration {
+	backoff := commitRetryBase
+	for i := 0; i < attempts && backoff < commitRetryMax; i++ {
+		backoff *= 2
+	}
+
+	return min(backoff, commitRetryMax)
+}
+
+// peerConnected makes every commit a peer hasn't acked due straight away
+func (q *commitQueue) peerConnected(p peer.ID) {
+	q.mu.Lock()
+	for _, c := range q.commits {
+		if !c.acked[p] {
+			delete(c.attempts, p)
+			delete(c.nextAttempt, p)
+		}
+	}
+	q.mu.Unlock()
+
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// start delivers due commits every commitRetryInterval and whenever a peer
+// connects
+func (q *commitQueue) start() {
+	go func() {
+		ticker := time.NewTicker(commitRetryInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+			case <-q.wake:
+			}
+			q.deliver(time.Now())
+		}
+	}()
+}
+
+// coverage returns how far a queued commit has got
+func (q *commitQueue) coverage(id models.TxID) (*CommitCoverage, bool) {
+	peers := q.peers()
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	c, ok := q.commits[id]
+	if !ok {
+		return nil, false
+	}
+
+	return c.coverage(id, peers), true
+}
+
+// all returns the coverage of every queued commit, oldest first
+func (q *commitQueue) all() []CommitCoverage {
+	peers := q.peers()
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	coverage := make([]CommitCoverage, 0, len(q.commits))
+	for id, c := range q.commits {
+		coverage = append(coverage, *c.coverage(id, peers))
+	}
+	sort.Slice(coverage, func(i, j int) bool { return coverage[i].Queued.Before(coverage[j].Queued) })
+
+	return coverage
+}
+
+func (c *outboundCommit) coverage(id models.TxID, peers []peer.ID) *CommitCoverage {
+	coverage := CommitCoverage{Tx: id, Queued: c.queued}
+	for p := range c.acked {
+		coverage.Acked = append(coverage.Acked, p)
+	}
+	sort.Slice(coverage.Acked, func(i, j int) bool { return coverage.Acked[i] < coverage.Acked[j] })
+
+	for _, p := range peers {
+		if !c.acked[p] {
+			coverage.Pending = append(coverage.Pending, p)
+		}
+	}
+
+	return &coverage
+}
+
+// persist writes the queue to the store. The caller must hold the lock.
+func (q *commitQueue) persist() {
+	if q.store == nil {
+		return
+	}
+
+	queued := make([]store.QueuedCommit, 0, len(q.commits))
+	for _, c := range q.commits {
+		qc := store.QueuedCommit{Tx: c.tx, Queued: c.queued}
+		for p := range c.acked {
+			qc.Acked = append(qc.Acked, p.String())
+		}
+		queued = append(queued, qc)
+	}
+
+	if err := q.store.WriteCommitQueue(queued); err != nil {
+		log.Printf("Could not write commit queue %v", err)
+	}
+}
@@ -0,0 +1,143 @@
+package node
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	fcrypto "github.com/ackhia/flash/crypto"
+	"github.com/ackhia/flash/models"
+	"github.com/ackhia/flash/store"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeDelivery stands in for the commit topic. Peers in down fail.
+type fakeDelivery struct {
+	mu    sync.Mutex
+	peers []peer.ID
+	down  map[peer.ID]bool
+	sent  map[peer.ID]int
+}
+
+func (f *fakeDelivery) send(data []byte, p peer.ID) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.sent[p]++
+	if f.down[p] {
+		return fmt.Errorf("peer is down")
+	}
+	return nil
+}
+
+func (f *fakeDelivery) connected() []peer.ID {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return append([]peer.ID(nil), f.peers...)
+}
+
+func (f *fakeDelivery) setDown(p peer.ID, down bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.down[p] = down
+}
+
+func (f *fakeDelivery) sentTo(p peer.ID) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.sent[p]
+}
+
+func newPeerID(t *testing.T) peer.ID {
+	_, pub := fcrypto.CreateKeyPair()
+	id, err := peer.IDFromPublicKey(pub)
+	assert.NoError(t, err)
+
+	return id
+}
+
+func TestCommitQueue_Retries(t *testing.T) {
+	a, b := newPeerID(t), newPeerID(t)
+	f := &fakeDelivery{peers: []peer.ID{a, b}, down: map[peer.ID]bool{b: true}, sent: make(map[peer.ID]int)}
+	q := newCommitQueue(f.send, f.connected)
+
+	tx := models.Tx{From: "Alice", To: "Bob", Amount: 10, Sig: []byte("sig")}
+	coverage := q.add(&tx, []byte("commit"))
+	assert.Equal(t, []peer.ID{a}, coverage.Acked)
+	assert.Equal(t, []peer.ID{b}, coverage.Pending)
+
+	//b isn't tried again until its backoff is up
+	q.deliver(time.Now())
+	assert.Equal(t, 1, f.sentTo(b))
+	q.deliver(time.Now().Add(commitRetryBase + time.Millisecond))
+	assert.Equal(t, 2, f.sentTo(b))
+
+	//Reconnecting makes it due straight away
+	f.setDown(b, false)
+	q.peerConnected(b)
+	q.deliver(time.Now())
+	assert.Equal(t, 3, f.sentTo(b))
+	assert.Equal(t, 1, f.sentTo(a))
+
+	coverage, ok := q.coverage(tx.ID())
+	assert.True(t, ok)
+	assert.Len(t, coverage.Acked, 2)
+	assert.Empty(t, coverage.Pending)
+
+	//A peer that connects later is sent the commit too
+	c := newPeerID(t)
+	f.peers = append(f.peers, c)
+	q.deliver(time.Now())
+	assert.Equal(t, 1, f.sentTo(c))
+
+	q.deliver(time.Now().Add(commitRetention + time.Second))
+	_, ok = q.coverage(tx.ID())
+	assert.False(t, ok)
+}
+
+func TestRetryBackoff(t *testing.T) {
+	assert.Equal(t, commitRetryBase, retryBackoff(0))
+	assert.Equal(t, 2*commitRetryBase, retryBackoff(1))
+	assert.Equal(t, commitRetryMax, retryBackoff(100))
+}
+
+func TestCommitQueue_Persists(t *testing.T) {
+	a, b := newPeerID(t), newPeerID(t)
+	f := &fakeDelivery{peers: []peer.ID{a, b}, down: map[peer.ID]bool{b: true}, sent: make(map[peer.ID]int)}
+
+	s, err := store.Open(t.TempDir())
+	assert.NoError(t, err)
+	defer s.Close()
+
+	q := newCommitQueue(f.send, f.connected)
+	assert.NoError(t, q.load(s))
+	tx := models.Tx{From: "Alice", To: "Bob", Amount: 10, Sig: []byte("sig")}
+	q.add(&tx, []byte("commit"))
+
+	//After a restart only b is still owed the commit
+	f.setDown(b, false)
+	restarted := newCommitQueue(f.send, f.connected)
+	assert.NoError(t, restarted.load(s))
+	restarted.deliver(time.Now())
+	assert.Equal(t, 1, f.sentTo(a))
+	assert.Equal(t, 2, f.sentTo(b))
+
+	coverage, ok := restarted.coverage(tx.ID())
+	assert.True(t, ok)
+	assert.Len(t, coverage.Acked, 2)
+}
+
+func TestTransfer_ReportsCoverage(t *testing.T) {
+	node1, node2, node3 := createNetworkThreePeers(t, 1000, 1000, 1000)
+
+	coverage, err := node1.Transfer(node2.Host.ID().String(), 25)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []peer.ID{node2.Host.ID(), node3.Host.ID()}, coverage.Acked)
+	assert.Empty(t, coverage.Pending)
+	assert.Len(t, node1.OutboundCommits(), 1)
+}
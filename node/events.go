@@ -0,0 +1,189 @@
+package node
+
+import (
+	"sync"
+	"time"
+
+	"github.com/ackhia/flash/models"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// Number of events a subscription buffers before new ones are dropped
+const eventBufferSize = 64
+
+type EventType string
+
+const (
+	// EventTxVerified is sent when a tx passes our checks and is held
+	// pending, whether we are verifying it for a peer or sending it
+	EventTxVerified EventType = "tx verified"
+	// EventTxCommitted is sent when a tx is committed to our ledger
+	EventTxCommitted EventType = "tx committed"
+	// EventBalanceChanged is sent for each account whose balance changed
+	EventBalanceChanged   EventType = "balance changed"
+	EventPeerConnected    EventType = "peer connected"
+	EventPeerDisconnected EventType = "peer disconnected"
+	// EventEquivocation is sent when an account is frozen for signing two
+	// txs with the same sequence number
+	EventEquivocation EventType = "equivocation detected"
+)
+
+// Event is something that happened on the node. Only the fields for its
+// type are set.
+type Event struct {
+	Type EventType
+	Time time.Time
+	// Tx is set for verified and committed txs
+	Tx *models.Tx
+	// Account and Balance are set when a balance changes. Account is also
+	// set to the equivocating account.
+	Account string
+	Balance models.Amount
+	// Peer is set when a peer connects or disconnects
+	Peer  peer.ID
+	Proof *models.EquivocationProof
+}
+
+// EventFilter picks the events a subscription gets. Empty fields match any
+// event.
+type EventFilter struct {
+	Types []EventType
+	// Account matches txs from or to the account, its balance changes, its
+	// equivocations and the peer with that ID connecting or disconnecting
+	Account string
+}
+
+func (f *EventFilter) matches(e *Event) bool {
+	if len(f.Types) > 0 {
+		found := false
+		for _, t := range f.Types {
+			if t == e.Type {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if f.Account == "" {
+		return true
+	}
+
+	switch {
+	case e.Tx != nil:
+		return e.Tx.From == f.Account || e.Tx.To == f.Account
+	case e.Peer != "":
+		return e.Peer.String() == f.Account
+	default:
+		return e.Account == f.Account
+	}
+}
+
+// Subscription receives the events that match its filter on C. A
+// subscriber that falls more than eventBufferSize events behind misses
+// events rather than holding up the node. Dropped says how many.
+type Subscription struct {
+	C <-chan Event
+
+	c       chan Event
+	filter  EventFilter
+	bus     *eventBus
+	mu      sync.Mutex
+	dropped int
+}
+
+// Dropped returns how many events were missed because C was full
+func (s *Subscription) Dropped() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.dropped
+}
+
+// Unsubscribe stops the events and closes C
+func (s *Subscription) Unsubscribe() {
+	s.bus.remove(s)
+}
+
+type eventBus struct {
+	mu   sync.Mutex
+	subs map[*Subscription]struct{}
+}
+
+func newEventBus() *eventBus {
+	return &eventBus{subs: make(map[*Subscription]struct{})}
+}
+
+func (b *eventBus) subscribe(filter EventFilter) *Subscription {
+	c := make(chan Event, eventBufferSize)
+	s := &Subscription{C: c, c: c, filter: filter, bus: b}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.subs[s] = struct{}{}
+	return s
+}
+
+func (b *eventBus) remove(s *Subscription) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, ok := b.subs[s]; !ok {
+		return
+	}
+
+	delete(b.subs, s)
+	close(s.c)
+}
+
+// publish hands an event to every matching subscription without blocking,
+// so it is safe to call with the ledger locked
+func (b *eventBus) publish(e Event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for s := range b.subs {
+		if !s.filter.matches(&e) {
+			continue
+		}
+
+		select {
+		case s.c <- e:
+		default:
+			s.mu.Lock()
+			s.dropped++
+			s.mu.Unlock()
+		}
+	}
+}
+
+// Subscribe returns a subscription to the node's events that match filter.
+// Call Unsubscribe when done with it.
+func (n *Node) Subscribe(filter EventFilter) *Subscription {
+	return n.events.subscribe(filter)
+}
+
+// watchPeers sends an event when a peer connects for the first time or
+// loses its last connection
+func (n *Node) watchPeers() {
+	n.Host.Network().Notify(&network.NotifyBundle{
+		ConnectedF: func(net network.Network, c network.Conn) {
+			if len(net.ConnsToPeer(c.RemotePeer())) == 1 {
+				n.events.publish(Event{Type: EventPeerConnected, Peer: c.RemotePeer()})
+			}
+		},
+		DisconnectedF: func(net network.Network, c network.Conn) {
+			if net.Connectedness(c.RemotePeer()) != network.Connected {
+				n.events.publish(Event{Type: EventPeerDisconnected, Peer: c.RemotePeer()})
+			}
+		},
+	})
+}
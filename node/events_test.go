@@ -0,0 +1,97 @@
+package node
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ackhia/flash/models"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/stretchr/testify/assert"
+)
+
+func nextEvent(t *testing.T, sub *Subscription) Event {
+	select {
+	case e := <-sub.C:
+		return e
+	case <-time.After(5 * time.Second):
+		t.Fatal("No event received")
+		return Event{}
+	}
+}
+
+func TestSubscribe_Transfer(t *testing.T) {
+	node1, node2, node3 := createNetworkThreePeers(t, 1000, 1000, 1000)
+
+	from := node1.Host.ID().String()
+	to := node2.Host.ID().String()
+
+	verified := node2.Subscribe(EventFilter{Types: []EventType{EventTxVerified}})
+	defer verified.Unsubscribe()
+	committed := node3.Subscribe(EventFilter{Types: []EventType{EventTxCommitted, EventBalanceChanged}})
+	defer committed.Unsubscribe()
+	//node3's own balance doesn't change
+	unrelated := node3.Subscribe(EventFilter{Account: node3.Host.ID().String()})
+	defer unrelated.Unsubscribe()
+
+	_, err := node1.Transfer(to, 25)
+	assert.NoError(t, err)
+
+	e := nextEvent(t, verified)
+	assert.Equal(t, EventTxVerified, e.Type)
+	assert.Equal(t, from, e.Tx.From)
+
+	e = nextEvent(t, committed)
+	assert.Equal(t, EventTxCommitted, e.Type)
+	assert.Equal(t, models.Amount(25), e.Tx.Amount)
+
+	balances := make(map[string]models.Amount)
+	for i := 0; i < 2; i++ {
+		e = nextEvent(t, committed)
+		assert.Equal(t, EventBalanceChanged, e.Type)
+		balances[e.Account] = e.Balance
+	}
+	assert.Equal(t, map[string]models.Amount{from: 975, to: 1025}, balances)
+
+	assert.Empty(t, unrelated.C)
+}
+
+func TestSubscribe_Peers(t *testing.T) {
+	node1, node2, _ := createNetworkThreePeers(t, 1000, 1000, 1000)
+
+	sub := node1.Subscribe(EventFilter{Account: node2.Host.ID().String()})
+	defer sub.Unsubscribe()
+
+	assert.NoError(t, node1.Host.Network().ClosePeer(node2.Host.ID()))
+	e := nextEvent(t, sub)
+	assert.Equal(t, EventPeerDisconnected, e.Type)
+	assert.Equal(t, node2.Host.ID(), e.Peer)
+
+	info := peer.AddrInfo{ID: node2.Host.ID(), Addrs: node2.Host.Addrs()}
+	assert.NoError(t, node1.Host.Connect(context.Background(), info))
+	e = nextEvent(t, sub)
+	assert.Equal(t, EventPeerConnected, e.Type)
+	assert.Equal(t, node2.Host.ID(), e.Peer)
+}
+
+func TestEventBus_Backpressure(t *testing.T) {
+	bus := newEventBus()
+	sub := bus.subscribe(EventFilter{})
+
+	//A subscriber that doesn't keep up misses events instead of blocking
+	for i := 0; i < eventBufferSize+5; i++ {
+		bus.publish(Event{Type: EventBalanceChanged, Account: "Alice", Balance: models.Amount(i)})
+	}
+	assert.Equal(t, 5, sub.Dropped())
+	assert.Equal(t, models.Amount(0), (<-sub.C).Balance)
+
+	sub.Unsubscribe()
+	bus.publish(Event{Type: EventBalanceChanged})
+	sub.Unsubscribe()
+
+	received := 0
+	for range sub.C {
+		received++
+	}
+	assert.Equal(t, eventBufferSize-1, received)
+}
@@ -0,0 +1,181 @@
+package node
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/ackhia/flash/transport"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+// How long a message ID is remembered so copies arriving over other paths
+// are dropped instead of forwarded again
+const gossipSeenTTL = 2 * time.Minute
+
+// Largest gossip message a node will read, enough for a checkpoint
+const maxGossipMsgBytes = maxCheckpointBytes
+
+// Largest ack a node will read, the longest is "invalid"
+const maxGossipAckBytes = 16
+
+// topic floods messages through the mesh of connected peers. Each node
+// passes a message on to all its other connected peers the first time it
+// sees it, and only if the validator accepts it, so invalid messages stop at
+// the first honest node. A message is only remembered once it validates so
+// one rejected because our ledger was behind is accepted when it comes again.
+type topic struct {
+	host     host.Host
+	protocol protocol.ID
+	validate func(from peer.ID, data []byte) error
+	deliver  func(from peer.ID, data []byte)
+
+	mu        sync.Mutex
+	seen      map[[32]byte]time.Time
+	lastPrune time.Time
+}
+
+func newTopic(h host.Host, p protocol.ID, validate func(peer.ID, []byte) error, deliver func(peer.ID, []byte)) *topic {
+	return &topic{
+		host:      h,
+		protocol:  p,
+		validate:  validate,
+		deliver:   deliver,
+		seen:      make(map[[32]byte]time.Time),
+		lastPrune: time.Now(),
+	}
+}
+
+func (t *topic) start() {
+	t.host.SetStreamHandler(t.protocol, func(s network.Stream) {
+		defer s.Close()
+
+		from := s.Conn().RemotePeer()
+
+		data, err := transport.ReceiveBytesMax(s, maxGossipMsgBytes)
+		if err != nil {
+			log.Printf("Could not read gossip message %v", err)
+			return
+		}
+
+		if t.hasSeen(data) {
+			transport.SendBytes([]byte("seen"), s)
+			return
+		}
+
+		if err = t.validate(from, data); err != nil {
+			log.Printf("Rejected gossip message from %s %v", from, err)
+			transport.SendBytes([]byte("invalid"), s)
+			return
+		}
+
+		//Another copy may have validated while this one did
+		if !t.markSeen(data) {
+			transport.SendBytes([]byte("seen"), s)
+			return
+		}
+
+		go t.forward(data, from)
+		t.deliver(from, data)
+
+		//Acking after delivery lets the publisher know its direct peers
+		//have the message
+		transport.SendBytes([]byte("ok"), s)
+	})
+}
+
+// Publish sends a message to every connected peer and returns once they
+// have all acked it or timed out
+func (t *topic) Publish(data []byte) {
+	t.markSeen(data)
+	t.forward(data, "")
+}
+
+func (t *topic) forward(data []byte, except peer.ID) {
+	var wg sync.WaitGroup
+	for _, p := range t.host.Network().Peers() {
+		if p == except || p == t.host.ID() {
+			continue
+		}
+
+		wg.Add(1)
+		go func(p peer.ID) {
+			defer wg.Done()
+
+			if err := t.send(data, p); err != nil {
+				log.Printf("Could not gossip to peer %s %v", p, err)
+			}
+		}(p)
+	}
+	wg.Wait()
+}
+
+func (t *topic) send(data []byte, p peer.ID) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	stream, err := t.host.NewStream(ctx, p, t.protocol)
+	if err != nil {
+		return err
+	}
+
+	defer stream.Close()
+
+	if err = transport.SendBytes(data, stream); err != nil {
+		return err
+	}
+
+	reply, err := transport.ReceiveBytesMax(stream, maxGossipAckBytes)
+	if err != nil {
+		return fmt.Errorf("no ack %v", err)
+	}
+
+	if bytes.Equal(reply, []byte("invalid")) {
+		return fmt.Errorf("peer rejected the message")
+	}
+
+	return nil
+}
+
+// hasSeen reports whether a message was seen within gossipSeenTTL
+func (t *topic) hasSeen(data []byte) bool {
+	id := sha256.Sum256(data)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	at, ok := t.seen[id]
+	return ok && time.Since(at) <= gossipSeenTTL
+}
+
+// markSeen records a message and returns false if it was already seen
+func (t *topic) markSeen(data []byte) bool {
+	id := sha256.Sum256(data)
+	now := time.Now()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if now.Sub(t.lastPrune) > gossipSeenTTL {
+		for k, at := range t.seen {
+			if now.Sub(at) > gossipSeenTTL {
+				delete(t.seen, k)
+			}
+		}
+		t.lastPrune = now
+	}
+
+	if _, ok := t.seen[id]; ok {
+		return false
+	}
+
+	t.seen[id] = now
+	return true
+}
@@ -0,0 +1,96 @@
+package node
+
+import (
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTopic_RejectedMessageAcceptedLater(t *testing.T) {
+	mn := mocknet.New()
+
+	sender, err := mn.GenPeer()
+	assert.NoError(t, err)
+
+	receiver, err := mn.GenPeer()
+	assert.NoError(t, err)
+
+	assert.NoError(t, mn.LinkAll())
+	assert.NoError(t, mn.ConnectAllButSelf())
+
+	var mu sync.Mutex
+	valid := false
+	delivered := 0
+	validate := func(peer.ID, []byte) error {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if !valid {
+			return errors.New("not valid yet")
+		}
+		return nil
+	}
+	deliver := func(peer.ID, []byte) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		delivered++
+	}
+
+	topic := newTopic(receiver, "/flash/test/1.0.0", validate, deliver)
+	topic.start()
+	out := newTopic(sender, "/flash/test/1.0.0", func(peer.ID, []byte) error { return nil }, func(peer.ID, []byte) {})
+
+	//Rejected while the receiver's view is behind
+	msg := []byte("commit")
+	assert.Error(t, out.send(msg, receiver.ID()))
+
+	//The same message is accepted once it validates, and only once
+	mu.Lock()
+	valid = true
+	mu.Unlock()
+	assert.NoError(t, out.send(msg, receiver.ID()))
+	assert.NoError(t, out.send(msg, receiver.ID()))
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, 1, delivered)
+}
+
+func TestTopic_OversizedMessageDropped(t *testing.T) {
+	mn := mocknet.New()
+
+	sender, err := mn.GenPeer()
+	assert.NoError(t, err)
+
+	receiver, err := mn.GenPeer()
+	assert.NoError(t, err)
+
+	assert.NoError(t, mn.LinkAll())
+	assert.NoError(t, mn.ConnectAllButSelf())
+
+	var mu sync.Mutex
+	delivered := 0
+	deliver := func(peer.ID, []byte) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		delivered++
+	}
+
+	topic := newTopic(receiver, "/flash/test/1.0.0", func(peer.ID, []byte) error { return nil }, deliver)
+	topic.start()
+	out := newTopic(sender, "/flash/test/1.0.0", func(peer.ID, []byte) error { return nil }, func(peer.ID, []byte) {})
+
+	//The receiver stops reading at the length so gets no ack back
+	assert.Error(t, out.send(make([]byte, maxGossipMsgBytes+1), receiver.ID()))
+	assert.NoError(t, out.send([]byte("commit"), receiver.ID()))
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, 1, delivered)
+}
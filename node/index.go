@@ -0,0 +1,223 @@
+package node
+
+import (
+	"sort"
+	"time"
+
+	"github.com/ackhia/flash/models"
+)
+
+// txRef locates a held tx by its sender and sequence number
+type txRef struct {
+	from string
+	seq  int
+}
+
+type receivedTx struct {
+	at time.Time
+	id models.TxID
+}
+
+// txIndex looks up the txs a ledger holds by ID, by recipient and by when
+// they were received. Txs by sender are already held in sequence order.
+// The ledger keeps it up to date under its lock.
+type txIndex struct {
+	byID        map[models.TxID]txRef
+	byRecipient map[string]map[models.TxID]struct{}
+	// received holds when we first got each tx. byTime holds the same in
+	// time order and keeps removed txs until more than half are removed.
+	received map[models.TxID]time.Time
+	byTime   []receivedTx
+	stale    int
+}
+
+func newTxIndex() *txIndex {
+	return &txIndex{
+		byID:        make(map[models.TxID]txRef),
+		byRecipient: make(map[string]map[models.TxID]struct{}),
+		received:    make(map[models.TxID]time.Time),
+	}
+}
+
+// add indexes a tx received at the given time. A tx already indexed keeps
+// the time it was first received.
+func (x *txIndex) add(tx *models.Tx, at time.Time) {
+	id := tx.ID()
+	if _, ok := x.byID[id]; ok {
+		return
+	}
+
+	x.byID[id] = txRef{from: tx.From, seq: tx.SequenceNum}
+	if x.byRecipient[tx.To] == nil {
+		x.byRecipient[tx.To] = make(map[models.TxID]struct{})
+	}
+	x.byRecipient[tx.To][id] = struct{}{}
+	x.received[id] = at
+
+	//Txs nearly always arrive in time order so this is an append
+	i := sort.Search(len(x.byTime), func(i int) bool { return x.byTime[i].at.After(at) })
+	if i == len(x.byTime) {
+		x.byTime = append(x.byTime, receivedTx{at: at, id: id})
+		return
+	}
+	x.byTime = append(x.byTime[:i+1], x.byTime[i:]...)
+	x.byTime[i] = receivedTx{at: at, id: id}
+}
+
+func (x *txIndex) remove(tx *models.Tx) {
+	id := tx.ID()
+	if _, ok := x.byID[id]; !ok {
+		return
+	}
+
+	delete(x.byID, id)
+	delete(x.byRecipient[tx.To], id)
+	if len(x.byRecipient[tx.To]) == 0 {
+		delete(x.byRecipient, tx.To)
+	}
+	delete(x.received, id)
+
+	x.stale++
+	if x.stale > len(x.byTime)/2 {
+		x.compact()
+	}
+}
+
+// isCurrent reports whether an entry in byTime is for a tx still indexed.
+// A tx that was removed and added again has a later entry.
+func (x *txIndex) isCurrent(r receivedTx) bool {
+	at, ok := x.received[r.id]
+	return ok && at.Equal(r.at)
+}
+
+func (x *txIndex) compact() {
+	kept := x.byTime[:0]
+	for _, r := range x.byTime {
+		if x.isCurrent(r) {
+			kept = append(kept, r)
+		}
+	}
+	clear(x.byTime[len(kept):])
+	x.byTime = kept
+	x.stale = 0
+}
+
+// rebuild indexes every held tx again. Txs that were already indexed keep
+// their received time and the rest are taken as received now.
+func (x *txIndex) rebuild(txs map[string][]models.Tx) {
+	received := x.received
+	*x = *newTxIndex()
+
+	now := time.Now()
+	var all []*models.Tx
+	for from := range txs {
+		for i := range txs[from] {
+			all = append(all, &txs[from][i])
+		}
+	}
+
+	times := make(map[*models.Tx]time.Time, len(all))
+	for _, tx := range all {
+		at, ok := received[tx.ID()]
+		if !ok {
+			at = now
+		}
+		times[tx] = at
+	}
+
+	sort.SliceStable(all, func(i, j int) bool { return times[all[i]].Before(times[all[j]]) })
+	for _, tx := range all {
+		x.add(tx, times[tx])
+	}
+}
+
+// between returns the IDs of the txs received from start up to but not
+// including end, oldest first
+func (x *txIndex) between(start time.Time, end time.Time) []models.TxID {
+	i := sort.Search(len(x.byTime), func(i int) bool { return !x.byTime[i].at.Before(start) })
+
+	var ids []models.TxID
+	for ; i < len(x.byTime) && x.byTime[i].at.Before(end); i++ {
+		if x.isCurrent(x.byTime[i]) {
+			ids = append(ids, x.byTime[i].id)
+		}
+	}
+
+	return ids
+}
+
+// lookup returns the tx with the given ID. The caller must hold the lock.
+func (l *ledger) lookup(id models.TxID) *models.Tx {
+	ref, ok := l.index.byID[id]
+	if !ok {
+		return nil
+	}
+
+	return l.txAt(ref.from, ref.seq)
+}
+
+// ledgerTxs copies the txs with the given IDs along with when they were
+// received. The caller must hold the lock.
+func (l *ledger) ledgerTxs(ids []models.TxID) []models.LedgerTx {
+	txs := make([]models.LedgerTx, 0, len(ids))
+	for _, id := range ids {
+		tx := l.lookup(id)
+		if tx == nil {
+			continue
+		}
+		txs = append(txs, models.LedgerTx{Tx: *tx, Received: l.index.received[id]})
+	}
+
+	return txs
+}
+
+// TxByID returns a copy of the tx with the given ID from any sender
+func (l *ledger) TxByID(id models.TxID) (models.Tx, bool) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	tx := l.lookup(id)
+	if tx == nil {
+		return models.Tx{}, false
+	}
+
+	return *tx, true
+}
+
+// TxsFrom returns the txs we hold from a sender in sequence order
+func (l *ledger) TxsFrom(account string) []models.LedgerTx {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	txs := make([]models.LedgerTx, 0, len(l.txs[account]))
+	for _, tx := range l.txs[account] {
+		txs = append(txs, models.LedgerTx{Tx: tx, Received: l.index.received[tx.ID()]})
+	}
+
+	return txs
+}
+
+// TxsTo returns the txs we hold to a recipient, oldest first
+func (l *ledger) TxsTo(account string) []models.LedgerTx {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	ids := make([]models.TxID, 0, len(l.index.byRecipient[account]))
+	for id := range l.index.byRecipient[account] {
+		ids = append(ids, id)
+	}
+
+	txs := l.ledgerTxs(ids)
+	sort.SliceStable(txs, func(i, j int) bool { return txs[i].Received.Before(txs[j].Received) })
+
+	return txs
+}
+
+// TxsBetween returns the txs we received from start up to but not
+// including end, oldest first
+func (l *ledger) TxsBetween(start time.Time, end time.Time) []models.LedgerTx {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	return l.ledgerTxs(l.index.between(start, end))
+}
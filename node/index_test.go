@@ -0,0 +1,109 @@
+package node
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ackhia/flash/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func ids(txs []models.LedgerTx) []models.TxID {
+	var ids []models.TxID
+	for _, tx := range txs {
+		ids = append(ids, tx.Tx.ID())
+	}
+
+	return ids
+}
+
+func TestLedger_IndexLookups(t *testing.T) {
+	l := newLedger(map[string]models.Amount{"Alice": 100, "Bob": 100})
+
+	start := time.Now()
+	first := models.Tx{SequenceNum: 0, From: "Alice", To: "Bob", Amount: 10, Sig: []byte("first")}
+	assert.NoError(t, l.addPending(first))
+	assert.NoError(t, l.commit(&first))
+
+	mid := time.Now()
+	second := models.Tx{SequenceNum: 0, From: "Bob", To: "Carol", Amount: 20, Sig: []byte("second")}
+	assert.NoError(t, l.commit(&second))
+	third := models.Tx{SequenceNum: 1, From: "Alice", To: "Carol", Amount: 30, Sig: []byte("third")}
+	assert.NoError(t, l.addPending(third))
+	end := time.Now()
+
+	tx, ok := l.TxByID(second.ID())
+	assert.True(t, ok)
+	assert.Equal(t, "Carol", tx.To)
+	assert.True(t, tx.Comitted)
+
+	unknown := models.Tx{SequenceNum: 0, From: "Alice", To: "Bob", Amount: 10}
+	_, ok = l.TxByID(unknown.ID())
+	assert.False(t, ok)
+
+	assert.Equal(t, []models.TxID{first.ID(), third.ID()}, ids(l.TxsFrom("Alice")))
+	assert.Equal(t, []models.TxID{first.ID()}, ids(l.TxsTo("Bob")))
+	assert.Equal(t, []models.TxID{second.ID(), third.ID()}, ids(l.TxsTo("Carol")))
+	assert.Empty(t, l.TxsTo("Dave"))
+
+	assert.Equal(t, []models.TxID{first.ID(), second.ID(), third.ID()}, ids(l.TxsBetween(start, end)))
+	assert.Equal(t, []models.TxID{second.ID(), third.ID()}, ids(l.TxsBetween(mid, end)))
+	assert.Empty(t, l.TxsBetween(end, time.Now()))
+
+	for _, tx := range l.TxsBetween(start, end) {
+		assert.False(t, tx.Received.Before(start))
+		assert.True(t, tx.Received.Before(end))
+	}
+}
+
+func TestLedger_IndexDropsRemovedTxs(t *testing.T) {
+	l := newLedger(map[string]models.Amount{"Alice": 100, "Heavy": 50})
+
+	pending := models.Tx{SequenceNum: 0, From: "Alice", To: "Bob", Amount: 10, Sig: []byte("pending")}
+	later := models.Tx{SequenceNum: 1, From: "Alice", To: "Bob", Amount: 10, Sig: []byte("later")}
+	assert.NoError(t, l.addPending(pending))
+	assert.NoError(t, l.addPending(later))
+
+	//A cancellation drops the later tx
+	_, err := l.cancel(&models.Cancellation{From: "Alice", SequenceNum: 1})
+	assert.NoError(t, err)
+	_, ok := l.TxByID(later.ID())
+	assert.False(t, ok)
+
+	//A certified tx replaces the pending one
+	certified := models.Tx{SequenceNum: 0, From: "Alice", To: "Carol", Amount: 20, Sig: []byte("certified"), Verifiers: []models.Verifier{{ID: "Heavy"}}}
+	assert.Error(t, l.commit(&certified))
+
+	_, ok = l.TxByID(pending.ID())
+	assert.False(t, ok)
+	assert.Empty(t, l.TxsTo("Bob"))
+	assert.Equal(t, []models.TxID{certified.ID()}, ids(l.TxsTo("Carol")))
+	assert.Equal(t, []models.TxID{certified.ID()}, ids(l.TxsBetween(time.Time{}, time.Now())))
+}
+
+func TestLedger_IndexPersisted(t *testing.T) {
+	dataDir := t.TempDir()
+	l := newLedger(map[string]models.Amount{"Alice": 100})
+	assert.NoError(t, l.open(dataDir))
+
+	tx := models.Tx{SequenceNum: 0, From: "Alice", To: "Bob", Amount: 10, Sig: []byte("first")}
+	assert.NoError(t, l.addPending(tx))
+	assert.NoError(t, l.commit(&tx))
+	received := l.TxsTo("Bob")[0].Received
+	assert.NoError(t, l.close())
+
+	//The tx keeps the time we first received it across a restart
+	restarted := newLedger(map[string]models.Amount{"Alice": 100})
+	assert.NoError(t, restarted.open(dataDir))
+	defer restarted.close()
+
+	txs := restarted.TxsTo("Bob")
+	assert.Equal(t, 1, len(txs))
+	assert.Equal(t, tx.ID(), txs[0].Tx.ID())
+	assert.True(t, txs[0].Tx.Comitted)
+	assert.True(t, received.Equal(txs[0].Received))
+
+	found, ok := restarted.TxByID(tx.ID())
+	assert.True(t, ok)
+	assert.Equal(t, models.Amount(10), found.Amount)
+}
@@ -0,0 +1,1034 @@
+package node
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ackhia/flash/merkle"
+	"github.com/ackhia/flash/models"
+	"github.com/ackhia/flash/store"
+)
+
+// Fewest commits between ledger snapshots. Once the snapshot holds more
+// records than this, as many commits as it holds are made before the next,
+// so rewriting it costs the same per commit however long the history is.
+const snapshotInterval = 100
+
+// Number of reconciliations the ledger remembers
+const maxReconciliations = 100
+
+// ledger holds the transactions and balances known to a node. It is shared
+// by the libp2p stream handlers, Transfer and the UI so every access goes
+// through its lock. Changes are written through to the store when the node
+// has a data dir.
+type ledger struct {
+	mu      sync.RWMutex
+	txs     map[string][]models.Tx
+	genesis map[string]models.Amount
+	// balances holds committed balances only. They are updated as each tx
+	// commits rather than recalculated from the history.
+	balances             map[string]models.Amount
+	store                *store.Store
+	commitsSinceSnapshot int
+	snapshotRecords      int
+	// frozen holds accounts caught equivocating and when they thaw
+	frozen map[string]time.Time
+	// buffered holds certified commits, by sender and sequence number, that
+	// are waiting for the sender's earlier txs
+	buffered map[string]map[int]models.Tx
+	// reconciliations holds the latest conflicts resolved, oldest first
+	reconciliations []models.Reconciliation
+	// state commits to every account's balance and head from committed
+	// txs only, so nodes that agree on what is committed have the same root
+	state   *merkle.Tree
+	credits map[string]models.Amount
+	debits  map[string]models.Amount
+	// committed holds how many of each sender's held txs from the first on
+	// are committed
+	committed map[string]int
+	// order holds the committed txs after the latest checkpoint in the order
+	// we committed them. Each was valid against the balances of those
+	// before it, so sync sends them in this order.
+	order []txRef
+	// pendingDebits reserves what each account's uncommitted txs spend so
+	// several pending txs can't together overdraw it. pendingCredits is what
+	// they send it.
+	pendingDebits  map[string]models.Amount
+	pendingCredits map[string]models.Amount
+	// expiry holds when each pending tx can be dropped if it still isn't
+	// committed, pendingTTL after we accepted it
+	expiry     map[models.TxID]time.Time
+	pendingTTL time.Duration
+	// checkpoints holds the certified checkpoints applied so far, oldest
+	// first. The txs the latest one covers have been pruned so base holds
+	// the sequence number of each sender's first tx still held.
+	checkpoints []models.Checkpoint
+	base        map[string]int
+	// votes holds the checkpoint we signed for each number not yet applied
+	votes map[int]models.Checkpoint
+	// signed holds, by sender and sequence number, the tx we signed as a
+	// verifier. It outlives the tx being dropped so we never sign another
+	// for the same number, and is only pruned once a checkpoint covers it.
+	signed map[string]map[int]models.TxID
+	// index looks up held txs by ID, recipient and when they were received
+	index *txIndex
+	// notify is called with the ledger locked for each change subscribers
+	// can see. It must not block.
+	notify func(Event)
+}
+
+// equivocationError is returned when a tx conflicts with one already held
+// for the same sender and sequence number. It is reconciled when the ledger
+// has resolved the conflict and nothing is left for the caller to do
+// but deal with the sender.
+type equivocationError struct {
+	proof      models.EquivocationProof
+	reconciled bool
+}
+
+func (e *equivocationError) Error() string {
+	if e.reconciled {
+		return fmt.Sprintf("conflicting txs from %s for sequence number %d, reconciled", e.proof.First.From, e.proof.First.SequenceNum)
+	}
+	return fmt.Sprintf("conflicting txs from %s for sequence number %d", e.proof.First.From, e.proof.First.SequenceNum)
+}
+
+// missingTxsError is returned when a commit is buffered because the ledger
+// does not have the sender's earlier txs yet
+type missingTxsError struct {
+	from    string
+	missing []int
+}
+
+func (e *missingTxsError) Error() string {
+	return fmt.Sprintf("missing txs %v from %s", e.missing, e.from)
+}
+
+func newLedger(genesis map[string]models.Amount) *ledger {
+	l := &ledger{
+		txs:      make(map[string][]models.Tx),
+		genesis:  genesis,
+		frozen:   make(map[string]time.Time),
+		buffered: make(map[string]map[int]models.Tx),
+		expiry:   make(map[models.TxID]time.Time),
+		base:     make(map[string]int),
+		votes:    make(map[int]models.Checkpoint),
+		signed:   make(map[string]map[int]models.TxID),
+		balances: make(map[string]models.Amount),
+		index:    newTxIndex(),
+
+		pendingTTL: defaultPendingTxTTL,
+	}
+	l.rebuildState()
+
+	return l
+}
+
+// Txs returns a copy of all transactions keyed by sender
+func (l *ledger) Txs() map[string][]models.Tx {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	txs := make(map[string][]models.Tx, len(l.txs))
+	for from, accountTxs := range l.txs {
+		txs[from] = append([]models.Tx(nil), accountTxs...)
+	}
+
+	return txs
+}
+
+// Balances returns a copy of the current balances
+func (l *ledger) Balances() map[string]models.Amount {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	balances := make(map[string]models.Amount, len(l.balances))
+	for id, b := range l.balances {
+		balances[id] = b
+	}
+
+	return balances
+}
+
+func (l *ledger) Balance(id string) models.Amount {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	return l.balances[id]
+}
+
+// PendingBalance returns what an account's balance will be if all the txs
+// we hold pending for it commit
+func (l *ledger) PendingBalance(account string) models.Amount {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	return l.pendingBalance(account)
+}
+
+// AvailableBalance returns what an account can spend on top of its pending
+// txs
+func (l *ledger) AvailableBalance(account string) models.Amount {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	return l.available(account)
+}
+
+// FrozenAccounts returns the accounts that are currently frozen and when
+// each one thaws
+func (l *ledger) FrozenAccounts() map[string]time.Time {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	frozen := make(map[string]time.Time)
+	for id, until := range l.frozen {
+		if time.Now().Before(until) {
+			frozen[id] = until
+		}
+	}
+
+	return frozen
+}
+
+func (l *ledger) IsFrozen(id string) bool {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	return l.isFrozen(id)
+}
+
+func (l *ledger) isFrozen(id string) bool {
+	until, ok := l.frozen[id]
+	return ok && time.Now().Before(until)
+}
+
+// freeze stops id from getting txs verified until the given time. It returns
+// false if the account was already frozen.
+func (l *ledger) freeze(id string, until time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.isFrozen(id) {
+		return false
+	}
+
+	l.frozen[id] = until
+	return true
+}
+
+func (l *ledger) unfreeze(id string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	delete(l.frozen, id)
+}
+
+// conflictingTx returns the tx held for the same sender and sequence number
+// as tx if it is a different tx
+func (l *ledger) conflictingTx(tx *models.Tx) *models.Tx {
+	existing := l.txAt(tx.From, tx.SequenceNum)
+	if existing == nil || existing.ID() == tx.ID() {
+		return nil
+	}
+
+	return existing
+}
+
+// addPending checks an uncommitted tx against the ledger and appends it
+func (l *ledger) addPending(tx models.Tx) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	//Collecting signatures for a tx again leaves the copy we hold
+	if held := l.txAt(tx.From, tx.SequenceNum); held != nil && held.ID() == tx.ID() && !held.Comitted {
+		return nil
+	}
+
+	return l.addPendingLocked(tx)
+}
+
+// addSigned adds a tx we are about to sign as a verifier. Only one tx is
+// ever signed for a sender and sequence number, even once it is dropped, so
+// a sender can't hold back the certificate for one tx and get another
+// certified in its place. The sig must not be sent if this fails.
+func (l *ledger) addSigned(tx models.Tx) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	id := tx.ID()
+	signed, ok := l.signedAt(tx.From, tx.SequenceNum)
+	//While we still hold the tx we signed adding this one proves the
+	//equivocation
+	if ok && signed != id && l.lookup(signed) == nil {
+		return fmt.Errorf("already signed tx %s from %s for sequence number %d", signed, tx.From, tx.SequenceNum)
+	}
+
+	//Signing a tx we hold again is harmless and lets a sender that lost it
+	//collect its certificate
+	if held := l.txAt(tx.From, tx.SequenceNum); held == nil || held.ID() != id {
+		if err := l.addPendingLocked(tx); err != nil {
+			return err
+		}
+	}
+
+	if ok && signed == id {
+		return nil
+	}
+
+	if err := l.persist(store.RecordSigned, &tx); err != nil {
+		return fmt.Errorf("could not persist signed tx: %v", err)
+	}
+	l.markSigned(tx.From, tx.SequenceNum, id)
+
+	return nil
+}
+
+// signedAt returns the tx we signed for a sender and sequence number. The
+// caller must hold the lock.
+func (l *ledger) signedAt(from string, seq int) (models.TxID, bool) {
+	id, ok := l.signed[from][seq]
+	return id, ok
+}
+
+func (l *ledger) markSigned(from string, seq int, id models.TxID) {
+	if l.signed[from] == nil {
+		l.signed[from] = make(map[int]models.TxID)
+	}
+	l.signed[from][seq] = id
+}
+
+// addPendingLocked is addPending for callers that hold the lock
+func (l *ledger) addPendingLocked(tx models.Tx) error {
+	if l.isFrozen(tx.From) {
+		return fmt.Errorf("account %s is frozen", tx.From)
+	}
+
+	//A sequence number held by abandoned txs is freed for the new one
+	l.expireFrom(tx.From, tx.SequenceNum, time.Now())
+
+	//An uncertified tx never displaces the one we already hold
+	if existing := l.conflictingTx(&tx); existing != nil {
+		l.report(models.Reconciliation{
+			From:        tx.From,
+			SequenceNum: tx.SequenceNum,
+			Kept:        existing.ID(),
+			Dropped:     []models.TxID{tx.ID()},
+			Reason:      "pending tx conflicts with one we hold",
+			Time:        time.Now(),
+		})
+		return &equivocationError{proof: models.EquivocationProof{First: *existing, Second: tx}}
+	}
+
+	if l.available(tx.From) < tx.Amount {
+		return fmt.Errorf("balance too low for %s", tx.From)
+	}
+
+	if l.next(tx.From) != tx.SequenceNum {
+		return fmt.Errorf("invalid sequence number %d", tx.SequenceNum)
+	}
+
+	//Checked before the tx is persisted so a failure leaves no trace
+	if _, err := l.pendingCredits[tx.To].Add(tx.Amount); err != nil {
+		return fmt.Errorf("pending credits of %s overflow", tx.To)
+	}
+
+	tx.Comitted = false
+	received := time.Now()
+	if err := l.persistAt(store.RecordAdd, &tx, received); err != nil {
+		return fmt.Errorf("could not persist tx: %v", err)
+	}
+
+	l.txs[tx.From] = append(l.txs[tx.From], tx)
+	l.index.add(&tx, received)
+	//The available balance covers the debit and the credit was checked
+	addTo(l.pendingDebits, tx.From, tx.Amount)
+	addTo(l.pendingCredits, tx.To, tx.Amount)
+	l.expiry[tx.ID()] = time.Now().Add(l.pendingTTL)
+	l.emit(Event{Type: EventTxVerified, Tx: &tx})
+
+	l.drainBuffered(tx.From)
+
+	return nil
+}
+
+// commit marks the local copy of tx as committed with the verifiers of tx.
+// A tx the ledger has never seen is committed directly if it is the sender's
+// next one and buffered if earlier ones are missing, so the caller must
+// have checked its quorum certificate.
+func (l *ledger) commit(tx *models.Tx) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if tx.SequenceNum < l.base[tx.From] {
+		return fmt.Errorf("tx %s is covered by a checkpoint", tx.ID())
+	}
+
+	//The tx ID covers the sequence number so ours is found by it
+	localTx := l.txAt(tx.From, tx.SequenceNum)
+	if localTx == nil {
+		//A tx we signed is only missing if it was dropped uncommitted, and
+		//we may have signed another for the same number since
+		if signed, ok := l.signedAt(tx.From, tx.SequenceNum); ok && signed == tx.ID() {
+			return fmt.Errorf("tx %s was dropped after we signed it", tx.ID())
+		}
+
+		return l.commitUnknown(tx)
+	}
+
+	if localTx.ID() != tx.ID() {
+		return l.reconcile(localTx, tx)
+	}
+
+	//The tx ID covers every signed field so only the commit state can differ
+	if localTx.Comitted || tx.Comitted {
+		return fmt.Errorf("tx %s is already committed", tx.ID())
+	}
+
+	if err := l.persist(store.RecordCommit, tx); err != nil {
+		return fmt.Errorf("could not persist commit: %v", err)
+	}
+
+	localTx.Verifiers = tx.Verifiers
+	localTx.Comitted = true
+	l.releasePending(localTx)
+	l.emitCommitted(localTx)
+	l.trackCommit(localTx)
+	l.maybeSnapshot()
+
+	return nil
+}
+
+// reconcile resolves a certified tx that conflicts with one already held.
+// A certified tx replaces a pending one. A committed tx is never replaced as
+// its recipient may already have spent it. Two certified txs for one
+// sequence number mean some verifiers signed both, and they are named in
+// the report.
+func (l *ledger) reconcile(existing *models.Tx, tx *models.Tx) error {
+	proof := models.EquivocationProof{First: *existing, Second: *tx}
+	r := models.Reconciliation{
+		From:        tx.From,
+		SequenceNum: tx.SequenceNum,
+		Time:        time.Now(),
+	}
+
+	if existing.Comitted {
+		r.Kept = existing.ID()
+		r.Dropped = []models.TxID{tx.ID()}
+		r.Reason = "both certified, kept the committed one"
+		r.DoubleSigners = commonSigners(existing, tx)
+		l.report(r)
+
+		return &equivocationError{proof: proof, reconciled: true}
+	}
+
+	r.Reason = "certified tx replaced pending one"
+
+	if err := l.persist(store.RecordDrop, existing); err != nil {
+		return fmt.Errorf("could not persist drop: %v", err)
+	}
+
+	received := time.Now()
+	if err := l.persistAt(store.RecordCommit, tx, received); err != nil {
+		return fmt.Errorf("could not persist commit: %v", err)
+	}
+
+	r.Kept = tx.ID()
+	r.Dropped = []models.TxID{existing.ID()}
+
+	l.releasePending(existing)
+
+	committed := *tx
+	committed.Comitted = true
+	l.index.remove(existing)
+	*existing = committed
+	l.index.add(&committed, received)
+	l.emitCommitted(&committed)
+	l.trackCommit(&committed)
+
+	//Later pending txs may spend coins the replacement tx also spends
+	for l.committedBalance(tx.From) < l.pendingDebits[tx.From] {
+		txs := l.txs[tx.From]
+		last := len(txs) - 1
+		if txs[last].SequenceNum == tx.SequenceNum || txs[last].Comitted {
+			log.Printf("Balances are invalid after reconciling txs from %s", tx.From)
+			break
+		}
+
+		if err := l.persist(store.RecordDrop, &txs[last]); err != nil {
+			log.Printf("Could not persist drop %v", err)
+		}
+		l.releasePending(&txs[last])
+		l.index.remove(&txs[last])
+		r.Dropped = append(r.Dropped, txs[last].ID())
+		l.txs[tx.From] = txs[:last]
+	}
+
+	l.report(r)
+	l.maybeSnapshot()
+
+	return &equivocationError{proof: proof, reconciled: true}
+}
+
+// commonSigners returns the IDs of the verifiers that signed both txs
+func commonSigners(a *models.Tx, b *models.Tx) []string {
+	signed := make(map[string]struct{})
+	for _, v := range a.Verifiers {
+		signed[v.ID] = struct{}{}
+	}
+
+	var common []string
+	for _, v := range b.Verifiers {
+		if _, ok := signed[v.ID]; ok {
+			common = append(common, v.ID)
+			delete(signed, v.ID)
+		}
+	}
+	sort.Strings(common)
+
+	return common
+}
+
+func (l *ledger) report(r models.Reconciliation) {
+	log.Printf("Reconciled conflicting txs from %s for sequence number %d: %s, kept %s dropped %v", r.From, r.SequenceNum, r.Reason, r.Kept, r.Dropped)
+	if len(r.DoubleSigners) > 0 {
+		log.Printf("Verifiers %v signed both txs from %s for sequence number %d", r.DoubleSigners, r.From, r.SequenceNum)
+	}
+
+	l.reconciliations = append(l.reconciliations, r)
+	if len(l.reconciliations) > maxReconciliations {
+		l.reconciliations = l.reconciliations[len(l.reconciliations)-maxReconciliations:]
+	}
+}
+
+// Reconciliations returns the latest conflicts the ledger resolved, oldest
+// first
+func (l *ledger) Reconciliations() []models.Reconciliation {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	return append([]models.Reconciliation(nil), l.reconciliations...)
+}
+
+func (l *ledger) commitUnknown(tx *models.Tx) error {
+	if tx.SequenceNum > l.next(tx.From) {
+		if l.buffered[tx.From] == nil {
+			l.buffered[tx.From] = make(map[int]models.Tx)
+		}
+		l.buffered[tx.From][tx.SequenceNum] = *tx
+
+		return &missingTxsError{from: tx.From, missing: l.missing(tx.From)}
+	}
+
+	if err := l.appendCommitted(tx); err != nil {
+		return err
+	}
+	l.drainBuffered(tx.From)
+	l.maybeSnapshot()
+
+	return nil
+}
+
+// appendCommitted adds a certified tx that is the sender's next one
+func (l *ledger) appendCommitted(tx *models.Tx) error {
+	if l.available(tx.From) < tx.Amount {
+		return fmt.Errorf("balance too low for %s", tx.From)
+	}
+
+	received := time.Now()
+	if err := l.persistAt(store.RecordCommit, tx, received); err != nil {
+		return fmt.Errorf("could not persist commit: %v", err)
+	}
+
+	committed := *tx
+	committed.Comitted = true
+	l.txs[tx.From] = append(l.txs[tx.From], committed)
+	l.index.add(&committed, received)
+	l.emitCommitted(&committed)
+	l.trackCommit(&committed)
+
+	return nil
+}
+
+// drainBuffered appends buffered commits that now follow on from the
+// sender's txs and returns how many were appended
+func (l *ledger) drainBuffered(from string) int {
+	drained := 0
+	for {
+		next := l.next(from)
+		tx, ok := l.buffered[from][next]
+		if !ok {
+			break
+		}
+
+		delete(l.buffered[from], next)
+		if err := l.appendCommitted(&tx); err != nil {
+			log.Printf("Could not apply buffered commit %v", err)
+			break
+		}
+		drained++
+	}
+
+	if len(l.buffered[from]) == 0 {
+		delete(l.buffered, from)
+	}
+
+	return drained
+}
+
+// missing returns the sequence numbers the ledger needs before it can apply
+// the buffered commits from a sender
+func (l *ledger) missing(from string) []int {
+	var missing []int
+	last := -1
+	for seq := range l.buffered[from] {
+		last = max(last, seq)
+	}
+
+	for seq := l.next(from); seq < last; seq++ {
+		if _, ok := l.buffered[from][seq]; !ok {
+			missing = append(missing, seq)
+		}
+	}
+
+	return missing
+}
+
+// MissingTxs returns, by sender, the sequence numbers of txs the ledger
+// needs to apply its buffered commits
+func (l *ledger) MissingTxs() map[string][]int {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	missing := make(map[string][]int)
+	for from := range l.buffered {
+		if seqs := l.missing(from); len(seqs) > 0 {
+			missing[from] = seqs
+		}
+	}
+
+	return missing
+}
+
+// heads returns, by sender, how many of their txs from sequence number zero
+// on the ledger holds committed. Syncing picks up from there.
+func (l *ledger) heads() map[string]int {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	heads := make(map[string]int)
+	for _, from := range l.senders() {
+		heads[from] = l.accountHead(from).Committed
+	}
+
+	return heads
+}
+
+// AccountHead returns how far the ledger goes for a sender
+func (l *ledger) AccountHead(account string) models.AccountHead {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	return l.accountHead(account)
+}
+
+// AccountHeads returns the head of every sender the ledger holds txs for
+func (l *ledger) AccountHeads() map[string]models.AccountHead {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	heads := make(map[string]models.AccountHead, len(l.txs))
+	for _, account := range l.senders() {
+		heads[account] = l.accountHead(account)
+	}
+
+	return heads
+}
+
+func (l *ledger) accountHead(account string) models.AccountHead {
+	base := l.base[account]
+	return models.AccountHead{Committed: base + l.committed[account], Next: base + len(l.txs[account])}
+}
+
+// next returns the sequence number the ledger expects next from a sender.
+// The caller must hold the lock.
+func (l *ledger) next(from string) int {
+	return l.base[from] + len(l.txs[from])
+}
+
+// txAt returns the tx held for a sender and sequence number. It is nil if
+// the ledger doesn't hold one or it was pruned. The caller must hold the
+// lock.
+func (l *ledger) txAt(from string, seq int) *models.Tx {
+	i := seq - l.base[from]
+	if i < 0 || i >= len(l.txs[from]) {
+		return nil
+	}
+
+	return &l.txs[from][i]
+}
+
+// accounts returns the senders the ledger holds txs for in sorted order.
+// The caller must hold the lock.
+func (l *ledger) accounts() []string {
+	accounts := make([]string, 0, len(l.txs))
+	for from := range l.txs {
+		accounts = append(accounts, from)
+	}
+	sort.Strings(accounts)
+
+	return accounts
+}
+
+// senders returns every sender the ledger holds txs for or whose txs were
+// pruned by a checkpoint. The caller must hold the lock.
+func (l *ledger) senders() []string {
+	senders := make([]string, 0, len(l.txs)+len(l.base))
+	for from := range l.txs {
+		senders = append(senders, from)
+	}
+	for from := range l.base {
+		if _, ok := l.txs[from]; !ok {
+			senders = append(senders, from)
+		}
+	}
+
+	return senders
+}
+
+// hasCommitted reports whether tx is already committed on the ledger
+func (l *ledger) hasCommitted(tx *models.Tx) bool {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	//A checkpoint only covers committed txs
+	if tx.SequenceNum < l.base[tx.From] {
+		return true
+	}
+
+	localTx := l.txAt(tx.From, tx.SequenceNum)
+	return localTx != nil && localTx.Comitted && localTx.ID() == tx.ID()
+}
+
+// calcBalances recalculates the committed balances from the held txs on
+// top of the genesis balances, or those of the latest checkpoint. It is
+// only needed when the ledger is rebuilt as commits update the balances as
+// they happen. The caller must hold the lock.
+func (l *ledger) calcBalances() error {
+	credits := make(map[string]models.Amount)
+	debits := make(map[string]models.Amount)
+	for from, txs := range l.txs {
+		for i := 0; i < len(txs); i++ {
+			if txs[i].SequenceNum != l.base[from]+i {
+				return fmt.Errorf("transactions must be ordered by sequence number")
+			}
+
+			if !txs[i].Comitted {
+				continue
+			}
+
+			var err error
+			if credits[txs[i].To], err = credits[txs[i].To].Add(txs[i].Amount); err != nil {
+				return fmt.Errorf("balance of %s overflows", txs[i].To)
+			}
+			if debits[txs[i].From], err = debits[txs[i].From].Add(txs[i].Amount); err != nil {
+				return fmt.Errorf("negative balances not allowed")
+			}
+		}
+	}
+
+	balances := make(map[string]models.Amount)
+	for account, b := range l.baseBalances() {
+		balances[account] = b
+	}
+
+	for account, credit := range credits {
+		b, err := balances[account].Add(credit)
+		if err != nil {
+			return fmt.Errorf("balance of %s overflows", account)
+		}
+		balances[account] = b
+	}
+
+	for account, debit := range debits {
+		b, err := balances[account].Sub(debit)
+		if err != nil {
+			return fmt.Errorf("negative balances not allowed")
+		}
+		balances[account] = b
+	}
+
+	for account, balance := range balances {
+		if old, ok := l.balances[account]; !ok || old != balance {
+			l.emit(Event{Type: EventBalanceChanged, Account: account, Balance: balance})
+		}
+	}
+	for account := range l.balances {
+		if _, ok := balances[account]; !ok {
+			l.emit(Event{Type: EventBalanceChanged, Account: account})
+		}
+	}
+
+	l.balances = balances
+	l.credits = credits
+	l.debits = debits
+	return nil
+}
+
+func (l *ledger) emit(e Event) {
+	if l.notify != nil {
+		l.notify(e)
+	}
+}
+
+func (l *ledger) emitCommitted(tx *models.Tx) {
+	committed := *tx
+	l.emit(Event{Type: EventTxCommitted, Tx: &committed})
+}
+
+func (l *ledger) open(dir string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	s, err := store.Open(dir)
+	if err != nil {
+		return fmt.Errorf("could not open store: %v", err)
+	}
+
+	snap, records, err := s.Load()
+	if err != nil {
+		s.Close()
+		return fmt.Errorf("could not load store: %v", err)
+	}
+
+	if snap != nil {
+		if len(snap.Checkpoints) > 0 {
+			l.checkpoints = snap.Checkpoints
+			for from, head := range snap.Checkpoints[len(snap.Checkpoints)-1].Heads {
+				l.base[from] = head
+			}
+		}
+
+		for _, v := range snap.Votes {
+			if v.Number > len(l.checkpoints) {
+				l.votes[v.Number] = v
+			}
+		}
+
+		for _, s := range snap.Signed {
+			if s.SequenceNum >= l.base[s.From] {
+				l.markSigned(s.From, s.SequenceNum, s.ID)
+			}
+		}
+
+		for _, r := range snap.Records {
+			l.replayRecord(r)
+		}
+		l.snapshotRecords = len(snap.Records)
+	}
+
+	for _, r := range records {
+		l.replayRecord(r)
+	}
+
+	if err = l.rebuildState(); err != nil {
+		s.Close()
+		return fmt.Errorf("could not recover balances: %v", err)
+	}
+
+	//Pending txs get a fresh expiry as we don't know how long we were down
+	for _, txs := range l.txs {
+		for i := range txs {
+			if !txs[i].Comitted {
+				l.expiry[txs[i].ID()] = time.Now().Add(l.pendingTTL)
+			}
+		}
+	}
+
+	l.store = s
+	log.Printf("Recovered ledger from %s (%d log records)", dir, len(records))
+
+	return nil
+}
+
+func (l *ledger) close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.store == nil {
+		return nil
+	}
+
+	err := l.store.Close()
+	l.store = nil
+	return err
+}
+
+// replayRecord applies a stored record to the in memory ledger. Records may
+// be replayed more than once so this must be idempotent.
+func (l *ledger) replayRecord(r store.Record) {
+	if r.Type == store.RecordVote {
+		if r.Checkpoint != nil && r.Checkpoint.Number > len(l.checkpoints) {
+			l.votes[r.Checkpoint.Number] = *r.Checkpoint
+		}
+		return
+	}
+
+	tx := r.Tx
+	i := l.replayedTx(&tx)
+	var localTx *models.Tx
+	if i >= 0 {
+		localTx = &l.txs[tx.From][i]
+	}
+	id := tx.ID()
+	if _, ok := l.index.received[id]; !ok && !r.Received.IsZero() {
+		l.index.received[id] = r.Received
+	}
+
+	switch r.Type {
+	case store.RecordAdd:
+		if localTx == nil && tx.SequenceNum >= l.base[tx.From] {
+			tx.Comitted = false
+			l.txs[tx.From] = append(l.txs[tx.From], tx)
+		}
+	case store.RecordCommit:
+		if tx.SequenceNum < l.base[tx.From] {
+			break
+		}
+		if localTx == nil {
+			localTx = l.insertTx(tx)
+		}
+		if !localTx.Comitted {
+			l.order = append(l.order, txRef{from: tx.From, seq: tx.SequenceNum})
+		}
+		localTx.Verifiers = tx.Verifiers
+		localTx.Comitted = true
+	case store.RecordSigned:
+		if tx.SequenceNum >= l.base[tx.From] {
+			l.markSigned(tx.From, tx.SequenceNum, id)
+		}
+	case store.RecordDrop:
+		if localTx == nil {
+			break
+		}
+		txs := l.txs[tx.From]
+		l.txs[tx.From] = append(txs[:i:i], txs[i+1:]...)
+		delete(l.index.received, id)
+	default:
+		log.Printf("Unknown record type %s", r.Type)
+	}
+}
+
+// replayedTx returns where the held copy of tx is in its sender's txs, or
+// -1 if it isn't held, while records are replayed. A sender's txs may have
+// a gap part way through a replay so it is found by sequence number rather
+// than with txAt.
+func (l *ledger) replayedTx(tx *models.Tx) int {
+	txs := l.txs[tx.From]
+	i := sort.Search(len(txs), func(i int) bool { return txs[i].SequenceNum >= tx.SequenceNum })
+	if i == len(txs) || txs[i].SequenceNum != tx.SequenceNum || txs[i].ID() != tx.ID() {
+		return -1
+	}
+
+	return i
+}
+
+// insertTx puts tx before any held txs from its sender with a higher
+// sequence number. A replacement for a dropped tx goes back in its place.
+func (l *ledger) insertTx(tx models.Tx) *models.Tx {
+	txs := l.txs[tx.From]
+	i := sort.Search(len(txs), func(i int) bool { return txs[i].SequenceNum > tx.SequenceNum })
+	l.txs[tx.From] = append(txs[:i:i], append([]models.Tx{tx}, txs[i:]...)...)
+
+	return &l.txs[tx.From][i]
+}
+
+// persist writes a ledger change through to disk. It is a no-op when the
+// node was started without a data dir.
+func (l *ledger) persist(recordType store.RecordType, tx *models.Tx) error {
+	if l.store == nil {
+		return nil
+	}
+
+	return l.persistAt(recordType, tx, l.index.received[tx.ID()])
+}
+
+// persistAt writes a ledger change for a tx we received at the given time
+func (l *ledger) persistAt(recordType store.RecordType, tx *models.Tx, received time.Time) error {
+	if l.store == nil {
+		return nil
+	}
+
+	return l.store.Append(store.Record{Type: recordType, Tx: *tx, Received: received})
+}
+
+// persistVote writes the checkpoint we are signing through to disk
+func (l *ledger) persistVote(cp *models.Checkpoint) error {
+	if l.store == nil {
+		return nil
+	}
+
+	return l.store.Append(store.Record{Type: store.RecordVote, Checkpoint: cp})
+}
+
+func (l *ledger) maybeSnapshot() {
+	if l.store == nil {
+		return
+	}
+
+	l.commitsSinceSnapshot++
+	if l.commitsSinceSnapshot < max(snapshotInterval, l.snapshotRecords) {
+		return
+	}
+
+	l.writeSnapshot()
+}
+
+// writeSnapshot replaces the store's snapshot with the ledger as it is now.
+// The caller must hold the lock.
+func (l *ledger) writeSnapshot() {
+	if l.store == nil {
+		return
+	}
+
+	snap := store.Snapshot{Balances: l.balances, Checkpoints: l.checkpoints}
+	for _, v := range l.votes {
+		snap.Votes = append(snap.Votes, v)
+	}
+	for from, seqs := range l.signed {
+		for seq, id := range seqs {
+			snap.Signed = append(snap.Signed, store.Signed{From: from, SequenceNum: seq, ID: id})
+		}
+	}
+	//Commits go first in the order they were made so it survives a restart
+	written := make(map[txRef]bool, len(l.order))
+	for _, ref := range l.order {
+		tx := l.txAt(ref.from, ref.seq)
+		snap.Records = append(snap.Records, store.Record{Type: store.RecordCommit, Tx: *tx, Received: l.index.received[tx.ID()]})
+		written[ref] = true
+	}
+	for from, txs := range l.txs {
+		for _, tx := range txs {
+			if written[txRef{from: from, seq: tx.SequenceNum}] {
+				continue
+			}
+
+			recordType := store.RecordAdd
+			if tx.Comitted {
+				recordType = store.RecordCommit
+			}
+			snap.Records = append(snap.Records, store.Record{Type: recordType, Tx: tx, Received: l.index.received[tx.ID()]})
+		}
+	}
+
+	if err := l.store.WriteSnapshot(&snap); err != nil {
+		log.Printf("Could not write snapshot %v", err)
+		return
+	}
+
+	l.commitsSinceSnapshot = 0
+	l.snapshotRecords = len(snap.Records)
+}
@@ -0,0 +1,351 @@
+package node
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ackhia/flash/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLedger_ConcurrentAddPendingSameSequence(t *testing.T) {
+	l := newLedger(map[string]models.Amount{"Alice": 100})
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs <- l.addPending(models.Tx{SequenceNum: 0, From: "Alice", To: "Bob", Amount: 10, Sig: []byte{byte(i)}})
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+
+	accepted := 0
+	for err := range errs {
+		if err == nil {
+			accepted++
+		}
+	}
+
+	assert.Equal(t, 1, accepted)
+	assert.Equal(t, 1, len(l.Txs()["Alice"]))
+}
+
+func TestLedger_CommitMissingTxs(t *testing.T) {
+	l := newLedger(map[string]models.Amount{"Alice": 100})
+
+	err := l.commit(&models.Tx{SequenceNum: 2, From: "Alice", To: "Bob", Amount: 10, Sig: []byte("sig2")})
+	var missingErr *missingTxsError
+	assert.ErrorAs(t, err, &missingErr)
+	assert.Equal(t, map[string][]int{"Alice": {0, 1}}, l.MissingTxs())
+
+	assert.NoError(t, l.commit(&models.Tx{SequenceNum: 0, From: "Alice", To: "Bob", Amount: 10, Sig: []byte("sig0")}))
+	assert.Equal(t, map[string][]int{"Alice": {1}}, l.MissingTxs())
+
+	assert.NoError(t, l.commit(&models.Tx{SequenceNum: 1, From: "Alice", To: "Bob", Amount: 10, Sig: []byte("sig1")}))
+	assert.Empty(t, l.MissingTxs())
+	assert.Equal(t, 3, len(l.Txs()["Alice"]))
+	assert.Equal(t, models.Amount(70), l.Balance("Alice"))
+}
+
+func TestLedger_CertifiedReplacesPending(t *testing.T) {
+	dataDir := t.TempDir()
+	l := newLedger(map[string]models.Amount{"Alice": 100})
+	assert.NoError(t, l.open(dataDir))
+
+	first := models.Tx{SequenceNum: 0, From: "Alice", To: "Bob", Amount: 60, Sig: []byte("first")}
+	next := models.Tx{SequenceNum: 1, From: "Alice", To: "Bob", Amount: 30, Sig: []byte("next")}
+	assert.NoError(t, l.addPending(first))
+	assert.NoError(t, l.addPending(next))
+
+	//The certified tx wins and Alice can no longer afford the later pending one
+	certified := models.Tx{SequenceNum: 0, From: "Alice", To: "Carol", Amount: 80, Sig: []byte("certified")}
+	err := l.commit(&certified)
+	var eqErr *equivocationError
+	assert.ErrorAs(t, err, &eqErr)
+	assert.True(t, eqErr.reconciled)
+
+	txs := l.Txs()["Alice"]
+	assert.Equal(t, 1, len(txs))
+	assert.Equal(t, certified.ID(), txs[0].ID())
+	assert.True(t, txs[0].Comitted)
+	assert.Equal(t, models.Amount(20), l.Balance("Alice"))
+	assert.Equal(t, models.Amount(80), l.Balance("Carol"))
+
+	reconciliations := l.Reconciliations()
+	assert.Equal(t, 1, len(reconciliations))
+	assert.Equal(t, certified.ID(), reconciliations[0].Kept)
+	assert.Equal(t, []models.TxID{first.ID(), next.ID()}, reconciliations[0].Dropped)
+
+	//The replacement survives a restart
+	assert.NoError(t, l.close())
+	restarted := newLedger(map[string]models.Amount{"Alice": 100})
+	assert.NoError(t, restarted.open(dataDir))
+	defer restarted.close()
+
+	txs = restarted.Txs()["Alice"]
+	assert.Equal(t, 1, len(txs))
+	assert.Equal(t, certified.ID(), txs[0].ID())
+	assert.Equal(t, models.Amount(20), restarted.Balance("Alice"))
+}
+
+func TestLedger_CommittedTxNeverReplaced(t *testing.T) {
+	l := newLedger(map[string]models.Amount{"Alice": 100, "Heavy": 50, "Light": 10})
+
+	light := models.Tx{SequenceNum: 0, From: "Alice", To: "Bob", Amount: 10, Sig: []byte("light"), Verifiers: []models.Verifier{{ID: "Light"}, {ID: "Both"}}}
+	heavy := models.Tx{SequenceNum: 0, From: "Alice", To: "Carol", Amount: 10, Sig: []byte("heavy"), Verifiers: []models.Verifier{{ID: "Heavy"}, {ID: "Both"}}}
+	assert.NoError(t, l.commit(&light))
+
+	//Bob may already have spent what he got so even a heavier tx doesn't
+	//replace it
+	err := l.commit(&heavy)
+	var eqErr *equivocationError
+	assert.ErrorAs(t, err, &eqErr)
+	assert.True(t, eqErr.reconciled)
+	assert.Equal(t, light.ID(), l.Txs()["Alice"][0].ID())
+	assert.Equal(t, models.Amount(10), l.Balance("Bob"))
+	assert.Equal(t, models.Amount(0), l.Balance("Carol"))
+
+	reconciliations := l.Reconciliations()
+	assert.Equal(t, 1, len(reconciliations))
+	assert.Equal(t, light.ID(), reconciliations[0].Kept)
+	assert.Equal(t, []models.TxID{heavy.ID()}, reconciliations[0].Dropped)
+	assert.Equal(t, []string{"Both"}, reconciliations[0].DoubleSigners)
+}
+
+func TestLedger_PendingTxsCantOverdraw(t *testing.T) {
+	l := newLedger(map[string]models.Amount{"Alice": 100, "Heavy": 50})
+
+	assert.NoError(t, l.addPending(models.Tx{SequenceNum: 0, From: "Alice", To: "Bob", Amount: 60, Sig: []byte("first")}))
+	assert.Equal(t, models.Amount(40), l.AvailableBalance("Alice"))
+
+	//Each is within the committed balance but not both together
+	assert.Error(t, l.addPending(models.Tx{SequenceNum: 1, From: "Alice", To: "Carol", Amount: 60, Sig: []byte("second")}))
+	assert.NoError(t, l.addPending(models.Tx{SequenceNum: 1, From: "Alice", To: "Carol", Amount: 40, Sig: []byte("second")}))
+	assert.Equal(t, models.Amount(0), l.AvailableBalance("Alice"))
+
+	//Coins from a pending tx can't be spent until it commits
+	assert.Error(t, l.addPending(models.Tx{SequenceNum: 0, From: "Bob", To: "Carol", Amount: 10, Sig: []byte("bob")}))
+
+	//Committing moves the reservation onto the committed balance
+	assert.NoError(t, l.commit(&models.Tx{SequenceNum: 0, From: "Alice", To: "Bob", Amount: 60, Sig: []byte("first")}))
+	assert.Equal(t, models.Amount(0), l.AvailableBalance("Alice"))
+	assert.Equal(t, models.Amount(60), l.AvailableBalance("Bob"))
+
+	//A certified tx that supersedes the pending one releases what it reserved
+	l.commit(&models.Tx{SequenceNum: 1, From: "Alice", To: "Dave", Amount: 10, Sig: []byte("certified"), Verifiers: []models.Verifier{{ID: "Heavy"}}})
+	assert.Equal(t, models.Amount(30), l.AvailableBalance("Alice"))
+
+	l.mu.Lock()
+	l.rebuildState()
+	l.mu.Unlock()
+	assert.Equal(t, models.Amount(30), l.AvailableBalance("Alice"))
+}
+
+func TestLedger_PendingCreditsCantOverflow(t *testing.T) {
+	half := models.Amount(math.MaxUint64/2 + 1)
+	l := newLedger(map[string]models.Amount{"Alice": half, "Carol": half})
+
+	assert.NoError(t, l.addPending(models.Tx{SequenceNum: 0, From: "Alice", To: "Bob", Amount: half, Sig: []byte("alice")}))
+	assert.Error(t, l.addPending(models.Tx{SequenceNum: 0, From: "Carol", To: "Bob", Amount: half, Sig: []byte("carol")}))
+	assert.Empty(t, l.Txs()["Carol"])
+	assert.Equal(t, half, l.PendingBalance("Carol"))
+}
+
+func TestLedger_PendingAndCommittedBalances(t *testing.T) {
+	l := newLedger(map[string]models.Amount{"Alice": 100})
+
+	tx := models.Tx{SequenceNum: 0, From: "Alice", To: "Bob", Amount: 30, Sig: []byte("first")}
+	assert.NoError(t, l.addPending(tx))
+	assert.Equal(t, models.Amount(100), l.Balance("Alice"))
+	assert.Equal(t, models.Amount(0), l.Balance("Bob"))
+	assert.Equal(t, models.Amount(70), l.PendingBalance("Alice"))
+	assert.Equal(t, models.Amount(30), l.PendingBalance("Bob"))
+
+	assert.NoError(t, l.commit(&tx))
+	assert.Equal(t, models.Amount(70), l.Balance("Alice"))
+	assert.Equal(t, models.Amount(30), l.Balance("Bob"))
+	assert.Equal(t, models.Amount(70), l.PendingBalance("Alice"))
+	assert.Equal(t, models.Amount(30), l.PendingBalance("Bob"))
+}
+
+func TestLedger_ReconcileRollsBackBalances(t *testing.T) {
+	l := newLedger(map[string]models.Amount{"Alice": 100, "Heavy": 50})
+
+	pending := models.Tx{SequenceNum: 0, From: "Alice", To: "Bob", Amount: 40, Sig: []byte("pending")}
+	certified := models.Tx{SequenceNum: 0, From: "Alice", To: "Carol", Amount: 10, Sig: []byte("certified"), Verifiers: []models.Verifier{{ID: "Heavy"}}}
+
+	assert.NoError(t, l.addPending(pending))
+	assert.Equal(t, models.Amount(40), l.PendingBalance("Bob"))
+
+	//The replaced pending tx is taken back out of the pending balances
+	assert.Error(t, l.commit(&certified))
+	assert.Equal(t, models.Amount(90), l.Balance("Alice"))
+	assert.Equal(t, models.Amount(90), l.PendingBalance("Alice"))
+	assert.Equal(t, models.Amount(0), l.PendingBalance("Bob"))
+	assert.Equal(t, models.Amount(10), l.Balance("Carol"))
+
+	//And agrees with recalculating from scratch
+	root := l.StateRoot()
+	l.mu.Lock()
+	assert.NoError(t, l.rebuildState())
+	l.mu.Unlock()
+	assert.Equal(t, models.Amount(90), l.Balance("Alice"))
+	assert.Equal(t, models.Amount(0), l.Balance("Bob"))
+	assert.Equal(t, models.Amount(10), l.Balance("Carol"))
+	assert.Equal(t, root, l.StateRoot())
+}
+
+func TestLedger_PendingTxsExpire(t *testing.T) {
+	l := newLedger(map[string]models.Amount{"Alice": 100})
+
+	first := models.Tx{SequenceNum: 0, From: "Alice", To: "Bob", Amount: 60, Sig: []byte("first")}
+	assert.NoError(t, l.addPending(first))
+	assert.NoError(t, l.addPending(models.Tx{SequenceNum: 1, From: "Alice", To: "Bob", Amount: 40, Sig: []byte("second")}))
+
+	assert.Empty(t, l.expirePending(time.Now()))
+	assert.Len(t, l.expirePending(time.Now().Add(defaultPendingTxTTL+time.Second)), 2)
+	assert.Empty(t, l.Txs()["Alice"])
+	assert.Equal(t, models.Amount(100), l.AvailableBalance("Alice"))
+
+	//Before it expires a pending tx holds its sequence number, after that a
+	//new tx takes its place
+	assert.NoError(t, l.addPending(first))
+	replacement := models.Tx{SequenceNum: 0, From: "Alice", To: "Carol", Amount: 10, Sig: []byte("replacement")}
+	assert.Error(t, l.addPending(replacement))
+
+	l.mu.Lock()
+	l.expiry[first.ID()] = time.Now().Add(-time.Second)
+	l.mu.Unlock()
+	assert.NoError(t, l.addPending(replacement))
+	assert.Equal(t, replacement.ID(), l.Txs()["Alice"][0].ID())
+	assert.Equal(t, models.Amount(90), l.AvailableBalance("Alice"))
+
+	//Committed txs never expire
+	assert.NoError(t, l.commit(&replacement))
+	assert.Empty(t, l.expirePending(time.Now().Add(defaultPendingTxTTL+time.Second)))
+	assert.Len(t, l.Txs()["Alice"], 1)
+}
+
+func TestLedger_Cancel(t *testing.T) {
+	l := newLedger(map[string]models.Amount{"Alice": 100})
+
+	assert.NoError(t, l.commit(&models.Tx{SequenceNum: 0, From: "Alice", To: "Bob", Amount: 10, Sig: []byte("committed")}))
+	assert.NoError(t, l.addPending(models.Tx{SequenceNum: 1, From: "Alice", To: "Bob", Amount: 20, Sig: []byte("pending")}))
+
+	_, err := l.cancel(&models.Cancellation{From: "Alice", SequenceNum: 0})
+	assert.Error(t, err)
+
+	dropped, err := l.cancel(&models.Cancellation{From: "Alice", SequenceNum: 1})
+	assert.NoError(t, err)
+	assert.Len(t, dropped, 1)
+	assert.Len(t, l.Txs()["Alice"], 1)
+	assert.Equal(t, models.Amount(90), l.AvailableBalance("Alice"))
+
+	assert.NoError(t, l.addPending(models.Tx{SequenceNum: 1, From: "Alice", To: "Carol", Amount: 90, Sig: []byte("new")}))
+}
+
+func TestLedger_SignedSurvivesRestart(t *testing.T) {
+	dataDir := t.TempDir()
+	l := newLedger(map[string]models.Amount{"Alice": 100})
+	assert.NoError(t, l.open(dataDir))
+
+	signed := models.Tx{SequenceNum: 0, From: "Alice", To: "Bob", Amount: 10, Sig: []byte("signed")}
+	other := models.Tx{SequenceNum: 0, From: "Alice", To: "Carol", Amount: 20, Sig: []byte("other")}
+	assert.NoError(t, l.addSigned(signed))
+	assert.NoError(t, l.addSigned(signed))
+	assert.Len(t, l.expirePending(time.Now().Add(defaultPendingTxTTL+time.Second)), 1)
+
+	//Once the signed tx is dropped no other is signed in its place and it
+	//isn't committed
+	assert.Error(t, l.addSigned(other))
+	assert.Error(t, l.commit(&signed))
+	assert.Empty(t, l.Txs()["Alice"])
+	assert.NoError(t, l.close())
+
+	//The log keeps what was signed and so does the snapshot replacing it
+	for i := 0; i < 2; i++ {
+		restarted := newLedger(map[string]models.Amount{"Alice": 100})
+		assert.NoError(t, restarted.open(dataDir))
+		assert.Error(t, restarted.addSigned(other))
+		assert.Error(t, restarted.commit(&signed))
+
+		restarted.mu.Lock()
+		restarted.writeSnapshot()
+		restarted.mu.Unlock()
+		assert.NoError(t, restarted.close())
+	}
+
+	//The signed tx itself can be signed again and committed
+	restarted := newLedger(map[string]models.Amount{"Alice": 100})
+	assert.NoError(t, restarted.open(dataDir))
+	defer restarted.close()
+	assert.NoError(t, restarted.addSigned(signed))
+	assert.NoError(t, restarted.commit(&signed))
+	assert.Equal(t, models.Amount(90), restarted.Balance("Alice"))
+}
+
+// BenchmarkLedger_Commit commits one tx at a time on top of histories of
+// different sizes. The cost per commit shouldn't grow with the history.
+func BenchmarkLedger_Commit(b *testing.B) {
+	for _, size := range []int{1000, 10000, 100000} {
+		b.Run(fmt.Sprintf("history=%d", size), func(b *testing.B) {
+			l := newLedger(map[string]models.Amount{"Alice": models.Amount(size+b.N) * 10})
+
+			txs := make([]models.Tx, size)
+			for i := range txs {
+				txs[i] = models.Tx{SequenceNum: i, From: "Alice", To: "Bob", Amount: 1, Comitted: true}
+			}
+			l.txs["Alice"] = txs
+			if err := l.rebuildState(); err != nil {
+				b.Fatal(err)
+			}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				tx := models.Tx{SequenceNum: size + i, From: "Alice", To: "Bob", Amount: 1}
+				if err := l.addPending(tx); err != nil {
+					b.Fatal(err)
+				}
+				if err := l.commit(&tx); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestLedger_SnapshotsSpreadOut(t *testing.T) {
+	dataDir := t.TempDir()
+	genesis := map[string]models.Amount{"Alice": 1000}
+	l := newLedger(genesis)
+	assert.NoError(t, l.open(dataDir))
+
+	commit := func(seq int) {
+		assert.NoError(t, l.commit(&models.Tx{SequenceNum: seq, From: "Alice", To: "Bob", Amount: 1, Sig: []byte(fmt.Sprint(seq))}))
+	}
+
+	//Snapshots are rewritten after as many commits as they hold
+	for seq := 0; seq < 399; seq++ {
+		commit(seq)
+	}
+	assert.Equal(t, 200, l.snapshotRecords)
+	assert.Equal(t, 199, l.commitsSinceSnapshot)
+
+	commit(399)
+	assert.Equal(t, 400, l.snapshotRecords)
+	assert.Equal(t, 0, l.commitsSinceSnapshot)
+	assert.NoError(t, l.close())
+
+	restarted := newLedger(genesis)
+	assert.NoError(t, restarted.open(dataDir))
+	assert.Equal(t, 400, restarted.snapshotRecords)
+	assert.Equal(t, models.Amount(600), restarted.Balance("Alice"))
+	assert.NoError(t, restarted.close())
+}
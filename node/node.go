@@ -3,36 +3,89 @@ package node
 import (
 	"fmt"
 	"log"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/libp2p/go-libp2p"
 	"github.com/libp2p/go-libp2p/core/crypto"
 	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
 
 	fcrypto "github.com/ackhia/flash/crypto"
+	"github.com/ackhia/flash/merkle"
 	"github.com/ackhia/flash/models"
 )
 
+// The handshake protocol is shared by all networks. Every other protocol is
+// scoped to the network ID with protocolID.
+const handshakeProtocol = "/flash/handshake/1.0.0"
+const syncProtocol = "/flash/sync/1.0.0"
 const verifyTxProtocol = "/flash/verify-transaction/1.0.0"
-const commitTxProtocol = "/flash/commit-transaction/1.0.0"
+const equivocationProtocol = "/flash/equivocation/1.0.0"
+const commitGossipProtocol = "/flash/commits/1.0.0"
+const stateProtocol = "/flash/state/1.0.0"
+const cancelGossipProtocol = "/flash/cancellations/1.0.0"
+const accountHeadProtocol = "/flash/account-head/1.0.0"
+const checkpointProtocol = "/flash/checkpoint/1.0.0"
+const checkpointGossipProtocol = "/flash/checkpoints/1.0.0"
+const checkpointSyncProtocol = "/flash/checkpoint-sync/1.0.0"
+
+// Number of verification requests a node has in flight at once
+const maxParallelVerifications = 8
 
 type Node struct {
 	Host            host.Host
+	mu              sync.Mutex
 	nextSequenceNum int
-	privKey         crypto.PrivKey
-	Txs             map[string][]models.Tx
-	genesis         map[string]float64
-	Balances        map[string]float64
-	TotalCoins      float64
-	bootstraoPeers  []string
+	// unfinished holds our txs, in sequence order, that a verifier signed
+	// but that didn't reach a quorum. A verifier never signs a different tx
+	// for a sequence number it has signed one for, so these are finished
+	// before anything new is sent.
+	unfinished     []models.Tx
+	privKey        crypto.PrivKey
+	ledger         *ledger
+	peerStats      *peerStats
+	commits        *topic
+	cancellations  *topic
+	checkpoints    *topic
+	outbox         *commitQueue
+	txStatus       *txTracker
+	events         *eventBus
+	networkID      models.NetworkID
+	TotalCoins     models.Amount
+	bootstraoPeers []string
+	// dataDir is where the ledger is persisted. Empty keeps it in memory.
+	dataDir string
+	// AntiEntropyInterval is how often the node compares state with
+	// AntiEntropyPeers random connected peers. Zero turns it off. Both must
+	// be set before Start.
+	AntiEntropyInterval time.Duration
+	AntiEntropyPeers    int
+	antiEntropy         antiEntropyStats
+	// CheckpointInterval is roughly how often the node proposes a
+	// checkpoint when it has new commits. Zero turns it off. It must be set
+	// before Start.
+	CheckpointInterval time.Duration
 }
 
-func New(privKey crypto.PrivKey, host *host.Host, genesis map[string]float64, bootstraoPeers []string) *Node {
+func New(privKey crypto.PrivKey, host *host.Host, genesis map[string]models.Amount, bootstraoPeers []string, dataDir string) *Node {
 	n := Node{
 		privKey:        privKey,
-		Txs:            make(map[string][]models.Tx),
-		genesis:        genesis,
-		Balances:       make(map[string]float64),
+		ledger:         newLedger(genesis),
+		peerStats:      newPeerStats(),
+		txStatus:       newTxTracker(),
+		events:         newEventBus(),
+		networkID:      models.NewNetworkID(genesis),
+		TotalCoins:     calcTotalCoins(genesis),
 		bootstraoPeers: bootstraoPeers,
+		dataDir:        dataDir,
+
+		AntiEntropyInterval: defaultAntiEntropyInterval,
+		AntiEntropyPeers:    defaultAntiEntropyPeers,
+		CheckpointInterval:  defaultCheckpointInterval,
 	}
 
 	if host == nil {
@@ -41,43 +94,234 @@ func New(privKey crypto.PrivKey, host *host.Host, genesis map[string]float64, bo
 		n.Host = *host
 	}
 
+	n.commits = newTopic(n.Host, n.protocolID(commitGossipProtocol), n.validateCommitMsg, n.handleCommitMsg)
+	n.ledger.notify = n.events.publish
+
+	n.outbox = newCommitQueue(n.commits.send, n.Host.Network().Peers)
+	n.cancellations = newTopic(n.Host, n.protocolID(cancelGossipProtocol), n.validateCancelMsg, n.handleCancelMsg)
+	n.checkpoints = newTopic(n.Host, n.protocolID(checkpointGossipProtocol), n.validateCheckpointMsg, n.handleCheckpointMsg)
+
 	return &n
 }
 
-func (n *Node) Start() {
+func (n *Node) Start() error {
 	log.Print("Node starting")
-	go n.startTransactionServer()
-	go n.startVerificationServer()
-	go n.startCommitTxServer()
 
-	for _, peer := range n.bootstraoPeers {
-		txs, err := n.getTransactions(peer)
+	if n.dataDir != "" {
+		if err := n.ledger.open(n.dataDir); err != nil {
+			return err
+		}
+	}
+
+	if err := n.outbox.load(n.ledger.store); err != nil {
+		return fmt.Errorf("could not load commit queue: %v", err)
+	}
+
+	//Register the handlers before syncing so peers can reach us straight away
+	n.startHandshakeServer()
+	n.startSyncServer()
+	n.startVerificationServer()
+	n.startEquivocationServer()
+	n.startStateServer()
+	n.startAccountHeadServer()
+	n.startCheckpointServer()
+	n.startCheckpointSyncServer()
+	n.commits.start()
+	n.cancellations.start()
+	n.checkpoints.start()
+
+	//Peers that were away when we sent a commit get it when they reconnect
+	n.Host.Network().Notify(&network.NotifyBundle{
+		ConnectedF: func(_ network.Network, c network.Conn) {
+			n.outbox.peerConnected(c.RemotePeer())
+		},
+	})
+	n.outbox.start()
+	n.watchPeers()
 
+	//Join every bootstrap peer but only sync from the first that gives us
+	//a valid history, falling back to the next if one fails
+	synced := false
+	for _, addr := range n.bootstraoPeers {
+		p, err := n.connect(addr)
 		if err != nil {
-			log.Printf("Could not get transactions from %s %v", peer, err)
+			log.Printf("Could not connect to %s %v", addr, err)
 			continue
 		}
 
-		n.Txs = n.mergeTxs(n.Txs, txs)
+		if synced {
+			continue
+		}
+
+		if err = n.syncFrom(p); err != nil {
+			log.Printf("Could not sync from %s %v", addr, err)
+			continue
+		}
+		synced = true
 	}
 
-	n.calcBalances()
-	n.TotalCoins = n.calcTotalCoins()
+	n.recoverSequence()
+	n.startAntiEntropy(n.AntiEntropyInterval)
+	n.startPendingExpiry(pendingSweepInterval)
+	n.startCheckpoints(n.CheckpointInterval)
+
+	return nil
+}
+
+// NetworkID identifies the network the node is on by its genesis
+func (n *Node) NetworkID() models.NetworkID {
+	return n.networkID
 }
 
-func (n Node) calcTotalCoins() float64 {
-	var total float64
-	for _, v := range n.genesis {
+// protocolID scopes a protocol to the node's network so peers with a
+// different genesis can't open streams with us
+func (n *Node) protocolID(p string) protocol.ID {
+	return protocol.ID("/flash/" + n.networkID.String() + strings.TrimPrefix(p, "/flash"))
+}
+
+// Txs returns a copy of the transactions known to the node keyed by sender
+func (n *Node) Txs() map[string][]models.Tx {
+	return n.ledger.Txs()
+}
+
+// Balances returns a copy of the balances known to the node
+func (n *Node) Balances() map[string]models.Amount {
+	return n.ledger.Balances()
+}
+
+func (n *Node) Balance(id string) models.Amount {
+	return n.ledger.Balance(id)
+}
+
+// AccountHead returns how many of an account's txs we hold committed and
+// the sequence number we expect from it next
+func (n *Node) AccountHead(id string) models.AccountHead {
+	return n.ledger.AccountHead(id)
+}
+
+// AccountHeads returns the head of every account we hold txs for
+func (n *Node) AccountHeads() map[string]models.AccountHead {
+	return n.ledger.AccountHeads()
+}
+
+// CommitCoverage returns how far a commit we sent has got. It is false once
+// the commit is older than commitRetention.
+func (n *Node) CommitCoverage(id models.TxID) (*CommitCoverage, bool) {
+	return n.outbox.coverage(id)
+}
+
+// OutboundCommits returns how far each commit we sent in the last
+// commitRetention has got, oldest first
+func (n *Node) OutboundCommits() []CommitCoverage {
+	return n.outbox.all()
+}
+
+// TxByID returns the tx with the given ID if we hold it
+func (n *Node) TxByID(id models.TxID) (models.Tx, bool) {
+	return n.ledger.TxByID(id)
+}
+
+// TxsFrom returns the txs we hold from an account in sequence order, with
+// when we received each one
+func (n *Node) TxsFrom(id string) []models.LedgerTx {
+	return n.ledger.TxsFrom(id)
+}
+
+// TxsTo returns the txs we hold to an account, oldest first
+func (n *Node) TxsTo(id string) []models.LedgerTx {
+	return n.ledger.TxsTo(id)
+}
+
+// TxsBetween returns the txs we received from start up to but not including
+// end, oldest first. Txs pruned by a checkpoint aren't included.
+func (n *Node) TxsBetween(start time.Time, end time.Time) []models.LedgerTx {
+	return n.ledger.TxsBetween(start, end)
+}
+
+// AvailableBalance returns what an account can spend once the txs it has
+// pending are taken off its committed balance
+func (n *Node) AvailableBalance(id string) models.Amount {
+	return n.ledger.AvailableBalance(id)
+}
+
+// PendingBalance returns an account's committed balance with the txs we
+// hold pending to and from it applied
+func (n *Node) PendingBalance(id string) models.Amount {
+	return n.ledger.PendingBalance(id)
+}
+
+// FrozenAccounts returns the accounts frozen for equivocating and when each
+// one thaws
+func (n *Node) FrozenAccounts() map[string]time.Time {
+	return n.ledger.FrozenAccounts()
+}
+
+func (n *Node) IsFrozen(id string) bool {
+	return n.ledger.IsFrozen(id)
+}
+
+// Unfreeze lets a frozen account get txs verified again before it times out
+func (n *Node) Unfreeze(id string) {
+	n.ledger.unfreeze(id)
+}
+
+// PeerLatency returns how long a peer takes on average to answer a
+// verification request and whether it has answered one yet
+func (n *Node) PeerLatency(p peer.ID) (time.Duration, bool) {
+	return n.peerStats.Latency(p)
+}
+
+// StateRoot returns the Merkle root over every account's committed balance
+// and sequence head. Nodes that agree on what is committed have the same
+// root.
+func (n *Node) StateRoot() merkle.Hash {
+	return n.ledger.StateRoot()
+}
+
+// AntiEntropyStats returns how often the background sync has found and
+// repaired divergence from its peers
+func (n *Node) AntiEntropyStats() AntiEntropyStats {
+	return n.antiEntropy.get()
+}
+
+// Reconciliations returns the latest conflicting txs the node resolved,
+// oldest first
+func (n *Node) Reconciliations() []models.Reconciliation {
+	return n.ledger.Reconciliations()
+}
+
+// MisbehavingPeers returns the peers that have sent invalid txs and why
+func (n *Node) MisbehavingPeers() map[peer.ID]string {
+	return n.peerStats.Misbehaving()
+}
+
+// MissingTxs returns, by sender, the sequence numbers of txs the node needs
+// before it can apply commits it has buffered
+func (n *Node) MissingTxs() map[string][]int {
+	return n.ledger.MissingTxs()
+}
+
+// calcTotalCoins sums the genesis balances. config.ReadGenesis rejects
+// genesis files whose total overflows.
+func calcTotalCoins(genesis map[string]models.Amount) models.Amount {
+	var total models.Amount
+	for _, v := range genesis {
 		total += v
 	}
 
 	return total
 }
 
-func (n *Node) Transfer(to string, amount float64) error {
+// Transfer sends amount to an account and returns which peers have acked the
+// commit so far. Peers that haven't are retried in the background.
+func (n *Node) Transfer(to string, amount models.Amount) (*CommitCoverage, error) {
+	if err := n.finishUnfinished(); err != nil {
+		return nil, fmt.Errorf("could not finish an earlier tx: %v", err)
+	}
+
 	pubKeyBytes, err := crypto.MarshalPublicKey(n.privKey.GetPublic())
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	tx, err := n.BuildTx(
@@ -88,20 +332,48 @@ func (n *Node) Transfer(to string, amount float64) error {
 	)
 
 	if err != nil {
-		return fmt.Errorf("could not build tx: %v", err)
+		return nil, fmt.Errorf("could not build tx: %v", err)
 	}
+	built := time.Now()
 
 	err = fcrypto.SignTx(tx, n.privKey)
 	if err != nil {
-		return fmt.Errorf("could not sign tx: %v", err)
+		return nil, fmt.Errorf("could not sign tx: %v", err)
 	}
+	n.txStatus.start(tx, built)
 
+	n.txStatus.update(tx, models.TxVerifying, nil)
 	err = n.VerifyTx(tx)
 	if err != nil {
-		return fmt.Errorf("could not send tx: %v", err)
+		//Once a verifier has signed it nothing else can take its sequence
+		//number, so it is sent again before our next tx
+		if len(tx.Verifiers) > 0 {
+			n.txStatus.update(tx, models.TxVerifying, err)
+			n.mu.Lock()
+			n.unfinished = append(n.unfinished, *tx)
+			n.mu.Unlock()
+			return nil, fmt.Errorf("could not send tx yet, it is retried before the next one: %v", err)
+		}
+
+		n.txStatus.update(tx, models.TxFailed, err)
+
+		//Free the sequence number rather than leave peers holding a tx
+		//that will never commit
+		if cancelErr := n.Cancel(tx.SequenceNum); cancelErr != nil {
+			log.Printf("Could not cancel tx %v", cancelErr)
+		}
+		return nil, fmt.Errorf("could not send tx: %v", err)
 	}
 
-	n.CommitTx(tx)
+	n.txStatus.update(tx, models.TxQuorumReached, nil)
 
-	return nil
+	n.txStatus.update(tx, models.TxCommitting, nil)
+	coverage, err := n.CommitTx(tx)
+	if err != nil {
+		n.txStatus.update(tx, models.TxFailed, err)
+		return nil, fmt.Errorf("could not send tx: %v", err)
+	}
+	n.txStatus.update(tx, models.TxCommitted, nil)
+
+	return coverage, nil
 }
@@ -2,17 +2,24 @@ package node
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
 	"log"
+	"sync"
 	"testing"
+	"time"
 
 	fcrypto "github.com/ackhia/flash/crypto"
+	"github.com/ackhia/flash/models"
 	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
 	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
 	ma "github.com/multiformats/go-multiaddr"
 	"github.com/stretchr/testify/assert"
 )
 
-func createNetworkTwoPeers(t *testing.T, clientBalance float64, serverBalance float64) (*Node, *Node) {
+func createNetworkTwoPeers(t *testing.T, clientBalance models.Amount, serverBalance models.Amount) (*Node, *Node) {
 	mn := mocknet.New()
 
 	clientHost, err := mn.GenPeer()
@@ -24,17 +31,17 @@ func createNetworkTwoPeers(t *testing.T, clientBalance float64, serverBalance fl
 	err = mn.LinkAll()
 	assert.NoError(t, err)
 
-	genesis := make(map[string]float64)
+	genesis := make(map[string]models.Amount)
 	genesis[clientHost.ID().String()] = clientBalance
 	genesis[serverHost.ID().String()] = serverBalance
 
 	privKey := serverHost.Peerstore().PrivKey(serverHost.ID())
-	serverNode := New(privKey, &serverHost, genesis, []string{})
+	serverNode := New(privKey, &serverHost, genesis, []string{}, "")
 	serverNode.Start()
 	serverMultiAddr := createMultiaddress(t, serverNode)
 
 	privKey = clientHost.Peerstore().PrivKey(clientHost.ID())
-	clientNode := New(privKey, &clientHost, genesis, []string{serverMultiAddr})
+	clientNode := New(privKey, &clientHost, genesis, []string{serverMultiAddr}, "")
 	clientNode.Start()
 
 	log.Printf("Client peer ID: %s", clientNode.Host.ID())
@@ -43,7 +50,7 @@ func createNetworkTwoPeers(t *testing.T, clientBalance float64, serverBalance fl
 	return serverNode, clientNode
 }
 
-func createNetworkThreePeers(t *testing.T, node1Balance float64, node2Balance float64, node3Balance float64) (*Node, *Node, *Node) {
+func createNetworkThreePeers(t *testing.T, node1Balance models.Amount, node2Balance models.Amount, node3Balance models.Amount) (*Node, *Node, *Node) {
 	mn := mocknet.New()
 
 	node1Host, err := mn.GenPeer()
@@ -58,23 +65,23 @@ func createNetworkThreePeers(t *testing.T, node1Balance float64, node2Balance fl
 	err = mn.LinkAll()
 	assert.NoError(t, err)
 
-	genesis := make(map[string]float64)
+	genesis := make(map[string]models.Amount)
 	genesis[node1Host.ID().String()] = node1Balance
 	genesis[node2Host.ID().String()] = node2Balance
 	genesis[node3Host.ID().String()] = node3Balance
 
 	privKey := node1Host.Peerstore().PrivKey(node1Host.ID())
-	node1 := New(privKey, &node1Host, genesis, []string{})
+	node1 := New(privKey, &node1Host, genesis, []string{}, "")
 	node1.Start()
 	node1MultiAddr := createMultiaddress(t, node1)
 
 	privKey = node2Host.Peerstore().PrivKey(node2Host.ID())
-	node2 := New(privKey, &node2Host, genesis, []string{node1MultiAddr})
+	node2 := New(privKey, &node2Host, genesis, []string{node1MultiAddr}, "")
 	node2.Start()
 	node2MultiAddr := createMultiaddress(t, node2)
 
 	privKey = node3Host.Peerstore().PrivKey(node3Host.ID())
-	node3 := New(privKey, &node3Host, genesis, []string{node1MultiAddr, node2MultiAddr})
+	node3 := New(privKey, &node3Host, genesis, []string{node1MultiAddr, node2MultiAddr}, "")
 	node3.Start()
 
 	return node1, node2, node3
@@ -114,25 +121,26 @@ func TestVerifyTx_NormalTx(t *testing.T) {
 		t.Fatal("Verification not found")
 	}
 
-	r, err := fcrypto.VerifyVerifier(&tx.Verifiers[0], tx, server.privKey.GetPublic(), server.Host.ID())
+	r, err := fcrypto.VerifyVerifier(&tx.Verifiers[0], tx)
 
 	assert.NoError(t, err)
+	assert.Equal(t, server.Host.ID().String(), tx.Verifiers[0].ID)
 
 	if !r {
 		t.Fatal("VerifyVerifier failed")
 	}
 
 	//Check the uncommited tx is in the client and server txs
-	if len(server.Txs) != 1 {
+	if len(server.Txs()) != 1 {
 		t.Fatal("Tx not in server")
 	}
 
-	if len(client.Txs) != 1 {
+	if len(client.Txs()) != 1 {
 		t.Fatal("Tx not in client")
 	}
 
-	clientTx := &client.Txs[client.Host.ID().String()][0]
-	serverTx := &server.Txs[client.Host.ID().String()][0]
+	clientTx := client.Txs()[client.Host.ID().String()][0]
+	serverTx := server.Txs()[client.Host.ID().String()][0]
 
 	if !bytes.Equal(clientTx.Sig, tx.Sig) {
 		t.Fatal("Invlid client tx")
@@ -145,21 +153,24 @@ func TestVerifyTx_NormalTx(t *testing.T) {
 	assert.False(t, clientTx.Comitted)
 	assert.False(t, serverTx.Comitted)
 
-	assert.Equal(t, float64(1000), client.Balances[clientTx.From])
-	assert.Equal(t, float64(3000), client.Balances[clientTx.To])
+	assert.Equal(t, models.Amount(1000), client.Balance(clientTx.From))
+	assert.Equal(t, models.Amount(3000), client.Balance(clientTx.To))
 
-	client.CommitTx(tx)
+	_, err = client.CommitTx(tx)
+	assert.NoError(t, err)
 
+	clientTx = client.Txs()[client.Host.ID().String()][0]
+	serverTx = server.Txs()[client.Host.ID().String()][0]
 	assert.True(t, clientTx.Comitted)
 	assert.True(t, serverTx.Comitted)
 
-	assert.Equal(t, float64(1000-20), client.Balances[clientTx.From])
-	assert.Equal(t, float64(3000+20), client.Balances[clientTx.To])
+	assert.Equal(t, models.Amount(1000-20), client.Balance(clientTx.From))
+	assert.Equal(t, models.Amount(3000+20), client.Balance(clientTx.To))
 
-	assert.Equal(t, len(client.Txs[tx.From]), 1)
-	assert.Equal(t, len(client.Txs[tx.To]), 0)
-	assert.Equal(t, len(server.Txs[tx.From]), 1)
-	assert.Equal(t, len(server.Txs[tx.To]), 0)
+	assert.Equal(t, len(client.Txs()[tx.From]), 1)
+	assert.Equal(t, len(client.Txs()[tx.To]), 0)
+	assert.Equal(t, len(server.Txs()[tx.From]), 1)
+	assert.Equal(t, len(server.Txs()[tx.To]), 0)
 }
 
 func TestVerifyTx_ClientBalanceTooLow(t *testing.T) {
@@ -206,21 +217,21 @@ func TestVerifyTx_VerifierBalanceTooLow(t *testing.T) {
 
 func TestCalcTotalCoins(t *testing.T) {
 	server, _ := createNetworkTwoPeers(t, 1000, 3000)
-	assert.Equal(t, server.TotalCoins, float64(4000))
+	assert.Equal(t, server.TotalCoins, models.Amount(4000))
 }
 
 func TestTransfer_Normal(t *testing.T) {
 	server, client := createNetworkTwoPeers(t, 500, 1000)
 
 	toAddr := server.Host.ID().String()
-	err := client.Transfer(toAddr, 25)
+	_, err := client.Transfer(toAddr, 25)
 
 	assert.NoError(t, err)
 
-	assert.Equal(t, float64(1025), server.Balances[toAddr])
-	assert.Equal(t, float64(475), server.Balances[client.Host.ID().String()])
-	assert.Equal(t, float64(1025), client.Balances[toAddr])
-	assert.Equal(t, float64(475), client.Balances[client.Host.ID().String()])
+	assert.Equal(t, models.Amount(1025), server.Balance(toAddr))
+	assert.Equal(t, models.Amount(475), server.Balance(client.Host.ID().String()))
+	assert.Equal(t, models.Amount(1025), client.Balance(toAddr))
+	assert.Equal(t, models.Amount(475), client.Balance(client.Host.ID().String()))
 
 }
 
@@ -228,23 +239,23 @@ func TestTransfer_TwoTransfers(t *testing.T) {
 	server, client := createNetworkTwoPeers(t, 500, 1000)
 
 	toAddr := server.Host.ID().String()
-	err := client.Transfer(toAddr, 25)
+	_, err := client.Transfer(toAddr, 25)
 
 	assert.NoError(t, err)
 
-	assert.Equal(t, float64(1025), server.Balances[toAddr])
-	assert.Equal(t, float64(475), server.Balances[client.Host.ID().String()])
-	assert.Equal(t, float64(1025), client.Balances[toAddr])
-	assert.Equal(t, float64(475), client.Balances[client.Host.ID().String()])
+	assert.Equal(t, models.Amount(1025), server.Balance(toAddr))
+	assert.Equal(t, models.Amount(475), server.Balance(client.Host.ID().String()))
+	assert.Equal(t, models.Amount(1025), client.Balance(toAddr))
+	assert.Equal(t, models.Amount(475), client.Balance(client.Host.ID().String()))
 
-	err = client.Transfer(toAddr, 30)
+	_, err = client.Transfer(toAddr, 30)
 
 	assert.NoError(t, err)
 
-	assert.Equal(t, float64(1055), server.Balances[toAddr])
-	assert.Equal(t, float64(445), server.Balances[client.Host.ID().String()])
-	assert.Equal(t, float64(1055), client.Balances[toAddr])
-	assert.Equal(t, float64(445), client.Balances[client.Host.ID().String()])
+	assert.Equal(t, models.Amount(1055), server.Balance(toAddr))
+	assert.Equal(t, models.Amount(445), server.Balance(client.Host.ID().String()))
+	assert.Equal(t, models.Amount(1055), client.Balance(toAddr))
+	assert.Equal(t, models.Amount(445), client.Balance(client.Host.ID().String()))
 
 	assert.Equal(t, client.nextSequenceNum, 2)
 	assert.Equal(t, server.nextSequenceNum, 0)
@@ -254,14 +265,14 @@ func TestTransfer_BalanceInsufficient(t *testing.T) {
 	server, client := createNetworkTwoPeers(t, 500, 1000)
 
 	toAddr := server.Host.ID().String()
-	err := client.Transfer(toAddr, 600)
+	_, err := client.Transfer(toAddr, 600)
 
 	assert.Error(t, err)
 
-	assert.Equal(t, float64(1000), server.Balances[toAddr])
-	assert.Equal(t, float64(500), server.Balances[client.Host.ID().String()])
-	assert.Equal(t, float64(1000), client.Balances[toAddr])
-	assert.Equal(t, float64(500), client.Balances[client.Host.ID().String()])
+	assert.Equal(t, models.Amount(1000), server.Balance(toAddr))
+	assert.Equal(t, models.Amount(500), server.Balance(client.Host.ID().String()))
+	assert.Equal(t, models.Amount(1000), client.Balance(toAddr))
+	assert.Equal(t, models.Amount(500), client.Balance(client.Host.ID().String()))
 
 }
 
@@ -269,15 +280,107 @@ func TestTransfer_BalanceNoConsensus(t *testing.T) {
 	server, client := createNetworkTwoPeers(t, 1500, 1000)
 
 	toAddr := server.Host.ID().String()
-	err := client.Transfer(toAddr, 600)
+	_, err := client.Transfer(toAddr, 600)
+
+	assert.Error(t, err)
+
+	assert.Equal(t, models.Amount(1000), server.Balance(toAddr))
+	assert.Equal(t, models.Amount(1500), server.Balance(client.Host.ID().String()))
+	assert.Equal(t, models.Amount(1000), client.Balance(toAddr))
+	assert.Equal(t, models.Amount(1500), client.Balance(client.Host.ID().String()))
+
+}
+
+func TestTransfer_NoConsensusCancels(t *testing.T) {
+	server, client := createNetworkTwoPeers(t, 1500, 1000)
+
+	from := client.Host.ID().String()
+	_, err := client.Transfer(server.Host.ID().String(), 2000)
+	assert.Error(t, err)
+
+	//No verifier signed the tx so its sequence number is reused
+	assert.Empty(t, server.Txs()[from])
+	assert.Empty(t, client.Txs()[from])
+	assert.Equal(t, models.Amount(1500), server.AvailableBalance(from))
+
+	pubKeyBytes, err := crypto.MarshalPublicKey(client.privKey.GetPublic())
+	assert.NoError(t, err)
+	tx, err := client.BuildTx(from, server.Host.ID().String(), 10, pubKeyBytes)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, tx.SequenceNum)
+}
+
+func TestTransfer_NoConsensusKeepsSignedTx(t *testing.T) {
+	server, client := createNetworkTwoPeers(t, 1500, 1000)
+
+	from := client.Host.ID().String()
+	to := server.Host.ID().String()
+	_, err := client.Transfer(to, 600)
+	assert.Error(t, err)
+
+	//The server signed the tx so it is kept rather than cancelled
+	assert.Len(t, server.Txs()[from], 1)
+	assert.Len(t, client.Txs()[from], 1)
+	assert.Equal(t, models.Amount(900), server.AvailableBalance(from))
+
+	//It still can't reach a quorum so nothing new is sent
+	_, err = client.Transfer(to, 10)
+	assert.Error(t, err)
+	assert.Len(t, server.Txs()[from], 1)
+	assert.Len(t, client.TxStatuses(), 1)
+}
+
+func TestTransfer_FinishesSignedTxFirst(t *testing.T) {
+	mn := mocknet.New()
 
+	var hosts []host.Host
+	for range 4 {
+		h, err := mn.GenPeer()
+		assert.NoError(t, err)
+		hosts = append(hosts, h)
+	}
+	assert.NoError(t, mn.LinkAll())
+
+	genesis := map[string]models.Amount{hosts[0].ID().String(): 100}
+	for _, h := range hosts[1:] {
+		genesis[h.ID().String()] = 1000
+	}
+
+	var nodes []*Node
+	var bootstrap []string
+	for _, h := range hosts {
+		n := New(h.Peerstore().PrivKey(h.ID()), &h, genesis, bootstrap, "")
+		n.Start()
+		nodes = append(nodes, n)
+		bootstrap = append(bootstrap, createMultiaddress(t, n))
+	}
+	sender, a, b, c := nodes[0], nodes[1], nodes[2], nodes[3]
+	from := sender.Host.ID().String()
+	to := a.Host.ID().String()
+
+	//Only b can be reached so the tx it signs is short of a quorum
+	for _, n := range []*Node{a, c} {
+		assert.NoError(t, mn.UnlinkPeers(sender.Host.ID(), n.Host.ID()))
+		assert.NoError(t, sender.Host.Network().ClosePeer(n.Host.ID()))
+	}
+	_, err := sender.Transfer(to, 10)
 	assert.Error(t, err)
+	assert.Len(t, b.Txs()[from], 1)
 
-	assert.Equal(t, float64(1000), server.Balances[toAddr])
-	assert.Equal(t, float64(1500), server.Balances[client.Host.ID().String()])
-	assert.Equal(t, float64(1000), client.Balances[toAddr])
-	assert.Equal(t, float64(1500), client.Balances[client.Host.ID().String()])
+	//With a back but c still away, b refuses any other tx for the
+	//sequence number, so the signed one is finished before the next
+	_, err = mn.LinkPeers(sender.Host.ID(), a.Host.ID())
+	assert.NoError(t, err)
+	_, err = sender.Transfer(to, 20)
+	assert.NoError(t, err)
+	txs := sender.Txs()[from]
+	assert.Len(t, txs, 2)
+	for _, tx := range txs {
+		assert.True(t, tx.Comitted)
+	}
 
+	assert.Equal(t, models.Amount(70), sender.Balance(from))
+	assert.Equal(t, models.Amount(1030), sender.Balance(to))
 }
 
 func TestTransfer_NormalThreePeers(t *testing.T) {
@@ -285,20 +388,20 @@ func TestTransfer_NormalThreePeers(t *testing.T) {
 
 	toAddr := node2.Host.ID().String()
 	fromAddr := node1.Host.ID().String()
-	err := node1.Transfer(toAddr, 25)
+	_, err := node1.Transfer(toAddr, 25)
 
 	assert.NoError(t, err)
 
-	assert.Equal(t, float64(1025), node1.Balances[toAddr])
-	assert.Equal(t, float64(975), node1.Balances[fromAddr])
-	assert.Equal(t, float64(1025), node2.Balances[toAddr])
-	assert.Equal(t, float64(975), node2.Balances[fromAddr])
-	assert.Equal(t, float64(1025), node3.Balances[toAddr])
-	assert.Equal(t, float64(975), node3.Balances[fromAddr])
+	assert.Equal(t, models.Amount(1025), node1.Balance(toAddr))
+	assert.Equal(t, models.Amount(975), node1.Balance(fromAddr))
+	assert.Equal(t, models.Amount(1025), node2.Balance(toAddr))
+	assert.Equal(t, models.Amount(975), node2.Balance(fromAddr))
+	assert.Equal(t, models.Amount(1025), node3.Balance(toAddr))
+	assert.Equal(t, models.Amount(975), node3.Balance(fromAddr))
 
-	assert.Equal(t, float64(3000), node1.TotalCoins)
-	assert.Equal(t, float64(3000), node2.TotalCoins)
-	assert.Equal(t, float64(3000), node3.TotalCoins)
+	assert.Equal(t, models.Amount(3000), node1.TotalCoins)
+	assert.Equal(t, models.Amount(3000), node2.TotalCoins)
+	assert.Equal(t, models.Amount(3000), node3.TotalCoins)
 }
 
 func TestNodeSync(t *testing.T) {
@@ -313,20 +416,20 @@ func TestNodeSync(t *testing.T) {
 	err = mn.LinkAll()
 	assert.NoError(t, err)
 
-	genesis := make(map[string]float64)
+	genesis := make(map[string]models.Amount)
 	genesis[clientHost.ID().String()] = 500
 	genesis[serverHost.ID().String()] = 1000
 
 	privKey := serverHost.Peerstore().PrivKey(serverHost.ID())
-	serverNode := New(privKey, &serverHost, genesis, []string{})
+	serverNode := New(privKey, &serverHost, genesis, []string{}, "")
 	serverNode.Start()
 	serverMultiAddr := createMultiaddress(t, serverNode)
 
 	privKey = clientHost.Peerstore().PrivKey(clientHost.ID())
-	clientNode := New(privKey, &clientHost, genesis, []string{serverMultiAddr})
+	clientNode := New(privKey, &clientHost, genesis, []string{serverMultiAddr}, "")
 	clientNode.Start()
 
-	err = clientNode.Transfer(serverHost.ID().String(), 30)
+	_, err = clientNode.Transfer(serverHost.ID().String(), 30)
 	assert.NoError(t, err)
 
 	//Create and join a new node
@@ -338,25 +441,455 @@ func TestNodeSync(t *testing.T) {
 
 	privKey = serverHost.Peerstore().PrivKey(serverHost.ID())
 	clientMultiAddr := createMultiaddress(t, clientNode)
-	newNode := New(privKey, &newHost, genesis, []string{serverMultiAddr, clientMultiAddr})
+	newNode := New(privKey, &newHost, genesis, []string{serverMultiAddr, clientMultiAddr}, "")
 	newNode.Start()
 
-	assert.Equal(t, 1, len(newNode.Txs))
+	assert.Equal(t, 1, len(newNode.Txs()))
 
-	assert.Equal(t, float64(470), newNode.Balances[clientNode.Host.ID().String()])
-	assert.Equal(t, float64(1030), newNode.Balances[serverNode.Host.ID().String()])
+	assert.Equal(t, models.Amount(470), newNode.Balance(clientNode.Host.ID().String()))
+	assert.Equal(t, models.Amount(1030), newNode.Balance(serverNode.Host.ID().String()))
 
 	clientNode.Transfer(newNode.Host.ID().String(), 20)
 
-	assert.Equal(t, float64(450), newNode.Balances[clientNode.Host.ID().String()])
-	assert.Equal(t, float64(1030), newNode.Balances[serverNode.Host.ID().String()])
-	assert.Equal(t, float64(20), newNode.Balances[newNode.Host.ID().String()])
+	assert.Equal(t, models.Amount(450), newNode.Balance(clientNode.Host.ID().String()))
+	assert.Equal(t, models.Amount(1030), newNode.Balance(serverNode.Host.ID().String()))
+	assert.Equal(t, models.Amount(20), newNode.Balance(newNode.Host.ID().String()))
+
+	assert.Equal(t, models.Amount(450), clientNode.Balance(clientNode.Host.ID().String()))
+	assert.Equal(t, models.Amount(1030), clientNode.Balance(serverNode.Host.ID().String()))
+	assert.Equal(t, models.Amount(20), clientNode.Balance(newNode.Host.ID().String()))
+
+	assert.Equal(t, models.Amount(450), serverNode.Balance(clientNode.Host.ID().String()))
+	assert.Equal(t, models.Amount(1030), serverNode.Balance(serverNode.Host.ID().String()))
+	assert.Equal(t, models.Amount(20), serverNode.Balance(newNode.Host.ID().String()))
+}
+
+func TestNodeRestart_RecoversLedger(t *testing.T) {
+	mn := mocknet.New()
+
+	clientHost, err := mn.GenPeer()
+	assert.NoError(t, err)
+
+	serverHost, err := mn.GenPeer()
+	assert.NoError(t, err)
+
+	err = mn.LinkAll()
+	assert.NoError(t, err)
+
+	genesis := make(map[string]models.Amount)
+	genesis[clientHost.ID().String()] = 500
+	genesis[serverHost.ID().String()] = 1000
+
+	dataDir := t.TempDir()
+	privKey := serverHost.Peerstore().PrivKey(serverHost.ID())
+	serverNode := New(privKey, &serverHost, genesis, []string{}, dataDir)
+	assert.NoError(t, serverNode.Start())
+	serverMultiAddr := createMultiaddress(t, serverNode)
+
+	privKey = clientHost.Peerstore().PrivKey(clientHost.ID())
+	clientNode := New(privKey, &clientHost, genesis, []string{serverMultiAddr}, "")
+	clientNode.Start()
+
+	_, err = clientNode.Transfer(serverHost.ID().String(), 30)
+	assert.NoError(t, err)
+	serverNode.ledger.close()
+
+	//Restart the server from its data dir without any bootstrap peers
+	restartedHost, err := mn.GenPeer()
+	assert.NoError(t, err)
+
+	privKey = restartedHost.Peerstore().PrivKey(restartedHost.ID())
+	restarted := New(privKey, &restartedHost, genesis, []string{}, dataDir)
+	assert.NoError(t, restarted.Start())
+
+	assert.Equal(t, 1, len(restarted.Txs()[clientHost.ID().String()]))
+	assert.True(t, restarted.Txs()[clientHost.ID().String()][0].Comitted)
+	assert.Equal(t, models.Amount(470), restarted.Balance(clientHost.ID().String()))
+	assert.Equal(t, models.Amount(1030), restarted.Balance(serverHost.ID().String()))
+}
+
+func TestTransfer_Concurrent(t *testing.T) {
+	node1, node2, node3 := createNetworkThreePeers(t, 1000, 1000, 1000)
+
+	addr1 := node1.Host.ID().String()
+	addr2 := node2.Host.ID().String()
+	addr3 := node3.Host.ID().String()
+
+	done := make(chan struct{})
+	var readers sync.WaitGroup
+	for _, n := range []*Node{node1, node2, node3} {
+		readers.Add(1)
+		go func(n *Node) {
+			defer readers.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+					n.Balances()
+					n.Txs()
+				}
+			}
+		}(n)
+	}
+
+	var transfers sync.WaitGroup
+	transfer := func(from *Node, to string) {
+		defer transfers.Done()
+		for i := 0; i < 3; i++ {
+			_, err := from.Transfer(to, 10)
+			assert.NoError(t, err)
+		}
+	}
+
+	transfers.Add(3)
+	go transfer(node1, addr2)
+	go transfer(node2, addr3)
+	go transfer(node3, addr1)
+	transfers.Wait()
+
+	close(done)
+	readers.Wait()
+
+	for _, n := range []*Node{node1, node2, node3} {
+		assert.Equal(t, models.Amount(1000), n.Balance(addr1))
+		assert.Equal(t, models.Amount(1000), n.Balance(addr2))
+		assert.Equal(t, models.Amount(1000), n.Balance(addr3))
+	}
+}
+
+func TestVerifyTx_Equivocation(t *testing.T) {
+	node1, node2, node3 := createNetworkThreePeers(t, 1000, 1000, 1000)
+
+	pubKeyBytes, err := crypto.MarshalPublicKey(node1.privKey.GetPublic())
+	assert.NoError(t, err)
+
+	from := node1.Host.ID().String()
+	txA := &models.Tx{Network: node1.networkID, SequenceNum: 0, From: from, To: node2.Host.ID().String(), Amount: 10, Pubkey: pubKeyBytes}
+	txB := &models.Tx{Network: node1.networkID, SequenceNum: 0, From: from, To: node3.Host.ID().String(), Amount: 20, Pubkey: pubKeyBytes}
+	assert.NoError(t, fcrypto.SignTx(txA, node1.privKey))
+	assert.NoError(t, fcrypto.SignTx(txB, node1.privKey))
+
+	assert.NoError(t, node1.getNodeVerification(txA, node2.Host.ID()))
+	assert.NoError(t, node1.getNodeVerification(txB, node3.Host.ID()))
+
+	//node2 already signed txA so it must refuse txB and freeze the sender
+	assert.Error(t, node1.getNodeVerification(txB, node2.Host.ID()))
+	assert.True(t, node2.IsFrozen(from))
+
+	//The proof is gossiped to the other peers
+	assert.Eventually(t, func() bool { return node3.IsFrozen(from) }, 5*time.Second, 10*time.Millisecond)
+
+	_, err = node1.Transfer(node2.Host.ID().String(), 5)
+	assert.Error(t, err)
+
+	node2.Unfreeze(from)
+	assert.False(t, node2.IsFrozen(from))
+}
+
+func TestVerifyTx_SignedSequenceNumAfterExpiry(t *testing.T) {
+	node1, node2, node3 := createNetworkThreePeers(t, 1000, 2000, 500)
+
+	from := node1.Host.ID().String()
+
+	//node2 alone holds a quorum and signs txA, which expires uncommitted
+	txA := verifyWith(t, node1, node2, node2.Host.ID().String(), 10)
+	assert.NotEmpty(t, node2.ledger.expirePending(time.Now().Add(time.Hour)))
+	assert.NotEmpty(t, node1.ledger.expirePending(time.Now().Add(time.Hour)))
+	assert.Equal(t, 0, len(node2.Txs()[from]))
+
+	pubKeyBytes, err := crypto.MarshalPublicKey(node1.privKey.GetPublic())
+	assert.NoError(t, err)
+	txB := &models.Tx{Network: node1.networkID, SequenceNum: txA.SequenceNum, From: from, To: node3.Host.ID().String(), Amount: 20, Pubkey: pubKeyBytes}
+	assert.NoError(t, fcrypto.SignTx(txB, node1.privKey))
+
+	//node2 won't certify a second tx for the sequence number
+	assert.Error(t, node1.getNodeVerification(txB, node2.Host.ID()))
+	assert.Equal(t, 0, len(node2.Txs()[from]))
+
+	//Nor will it commit txA once it has dropped it
+	msg, err := json.Marshal(txA)
+	assert.NoError(t, err)
+	assert.NoError(t, node1.commits.send(msg, node2.Host.ID()))
+	assert.Equal(t, 0, len(node2.Txs()[from]))
+	assert.Equal(t, models.Amount(1000), node2.Balance(from))
+
+	//The sender can still have txA itself signed again
+	txA.Verifiers = nil
+	assert.NoError(t, node1.getNodeVerification(txA, node2.Host.ID()))
+	assert.Equal(t, txA.ID(), node2.Txs()[from][0].ID())
+	assert.NoError(t, node2.ledger.commit(txA))
+	assert.Equal(t, models.Amount(990), node2.Balance(from))
+}
+
+func TestVerifyTx_ForgedSender(t *testing.T) {
+	server, client := createNetworkTwoPeers(t, 1000, 3000)
+
+	pubKeyBytes, err := crypto.MarshalPublicKey(client.privKey.GetPublic())
+	assert.NoError(t, err)
+
+	//BuildTx refuses to put someone else's account in From
+	_, err = client.BuildTx(server.Host.ID().String(), client.Host.ID().String(), 20, pubKeyBytes)
+	assert.Error(t, err)
+
+	//A hand built tx spending from the server's account with the client's key
+	tx := &models.Tx{
+		Network:     client.networkID,
+		SequenceNum: 0,
+		From:        server.Host.ID().String(),
+		To:          client.Host.ID().String(),
+		Amount:      20,
+		Pubkey:      pubKeyBytes,
+	}
+	assert.NoError(t, fcrypto.SignTx(tx, client.privKey))
+
+	err = client.getNodeVerification(tx, server.Host.ID())
+	assert.Error(t, err)
+	assert.Equal(t, 0, len(server.Txs()[server.Host.ID().String()]))
+
+	//Committing it with a forged verifier set is rejected as well
+	tx.Verifiers = []models.Verifier{{ID: server.Host.ID().String()}}
+	msg, err := json.Marshal(tx)
+	assert.NoError(t, err)
+	assert.Error(t, client.commits.send(msg, server.Host.ID()))
+	assert.Equal(t, models.Amount(3000), server.Balance(server.Host.ID().String()))
+}
+
+func TestHandshake_DifferentGenesis(t *testing.T) {
+	mn := mocknet.New()
+
+	serverHost, err := mn.GenPeer()
+	assert.NoError(t, err)
+
+	otherHost, err := mn.GenPeer()
+	assert.NoError(t, err)
+
+	err = mn.LinkAll()
+	assert.NoError(t, err)
+
+	genesis := map[string]models.Amount{serverHost.ID().String(): 1000}
+	server := New(serverHost.Peerstore().PrivKey(serverHost.ID()), &serverHost, genesis, []string{}, "")
+	server.Start()
+	serverMultiAddr := createMultiaddress(t, server)
+
+	otherGenesis := map[string]models.Amount{otherHost.ID().String(): 1000}
+	other := New(otherHost.Peerstore().PrivKey(otherHost.ID()), &otherHost, otherGenesis, []string{serverMultiAddr}, "")
+	other.Start()
+	assert.NotEqual(t, server.NetworkID(), other.NetworkID())
+
+	_, err = other.connect(serverMultiAddr)
+	assert.ErrorContains(t, err, "is on network")
+
+	//The scoped protocols can't be opened across networks either
+	_, err = otherHost.NewStream(context.Background(), serverHost.ID(), other.protocolID(verifyTxProtocol))
+	assert.Error(t, err)
+}
+
+func TestVerifyTx_WrongNetwork(t *testing.T) {
+	server, client := createNetworkTwoPeers(t, 1000, 3000)
+
+	pubKeyBytes, err := crypto.MarshalPublicKey(client.privKey.GetPublic())
+	assert.NoError(t, err)
+
+	tx, err := client.BuildTx(client.Host.ID().String(), server.Host.ID().String(), 20, pubKeyBytes)
+	assert.NoError(t, err)
+
+	//Re-sign the tx for another network
+	tx.Network = models.NewNetworkID(map[string]models.Amount{"other": 1})
+	assert.NoError(t, fcrypto.SignTx(tx, client.privKey))
+
+	err = client.getNodeVerification(tx, server.Host.ID())
+	assert.Error(t, err)
+	assert.Equal(t, 0, len(server.Txs()[client.Host.ID().String()]))
+}
+
+// verifyWith gets tx verified by a single peer and adds it to the sender's
+// ledger, leaving the other peers unaware of it
+func verifyWith(t *testing.T, sender *Node, verifier *Node, to string, amount models.Amount) *models.Tx {
+	pubKeyBytes, err := crypto.MarshalPublicKey(sender.privKey.GetPublic())
+	assert.NoError(t, err)
+
+	tx, err := sender.BuildTx(sender.Host.ID().String(), to, amount, pubKeyBytes)
+	assert.NoError(t, err)
+	assert.NoError(t, fcrypto.SignTx(tx, sender.privKey))
+	assert.NoError(t, sender.getNodeVerification(tx, verifier.Host.ID()))
+	assert.NoError(t, sender.ledger.addPending(*tx))
+
+	return tx
+}
+
+func TestCommit_TxNeverVerified(t *testing.T) {
+	node1, node2, node3 := createNetworkThreePeers(t, 1000, 2000, 500)
+
+	from := node1.Host.ID().String()
+	to := node2.Host.ID().String()
+
+	//node2 alone holds a quorum so node3 never sees the verification
+	tx := verifyWith(t, node1, node2, to, 25)
+	assert.Equal(t, 0, len(node3.Txs()[from]))
+
+	_, err := node1.CommitTx(tx)
+	assert.NoError(t, err)
+
+	assert.Equal(t, 1, len(node3.Txs()[from]))
+	assert.True(t, node3.Txs()[from][0].Comitted)
+	assert.Equal(t, models.Amount(975), node3.Balance(from))
+	assert.Equal(t, models.Amount(2025), node3.Balance(to))
+}
+
+func TestCommit_DoubleSignedTxNotReplaced(t *testing.T) {
+	node1, node2, node3 := createNetworkThreePeers(t, 1000, 2000, 500)
 
-	assert.Equal(t, float64(450), clientNode.Balances[clientNode.Host.ID().String()])
-	assert.Equal(t, float64(1030), clientNode.Balances[serverNode.Host.ID().String()])
-	assert.Equal(t, float64(20), clientNode.Balances[newNode.Host.ID().String()])
+	from := node1.Host.ID().String()
+	verifier := node2.Host.ID().String()
+
+	//node2 alone holds a quorum
+	txA := verifyWith(t, node1, node2, verifier, 25)
+	_, err := node1.CommitTx(txA)
+	assert.NoError(t, err)
+
+	//node2 signs a second tx for the same sequence number
+	pubKeyBytes, err := crypto.MarshalPublicKey(node1.privKey.GetPublic())
+	assert.NoError(t, err)
+	txB := &models.Tx{
+		Network:     node1.networkID,
+		SequenceNum: txA.SequenceNum,
+		From:        from,
+		To:          node3.Host.ID().String(),
+		Amount:      25,
+		Pubkey:      pubKeyBytes,
+	}
+	assert.NoError(t, fcrypto.SignTx(txB, node1.privKey))
+	v, err := fcrypto.CreateVerifier(txB, node2.privKey)
+	assert.NoError(t, err)
+	txB.Verifiers = []models.Verifier{*v}
+
+	msg, err := json.Marshal(txB)
+	assert.NoError(t, err)
+	assert.NoError(t, node1.commits.send(msg, node3.Host.ID()))
+
+	//node3 keeps the committed tx and freezes the sender and node2
+	assert.Equal(t, txA.ID(), node3.Txs()[from][0].ID())
+	assert.Equal(t, models.Amount(975), node3.Balance(from))
+	assert.True(t, node3.IsFrozen(from))
+	assert.True(t, node3.IsFrozen(verifier))
+
+	reconciliations := node3.Reconciliations()
+	assert.Equal(t, 1, len(reconciliations))
+	assert.Equal(t, []string{verifier}, reconciliations[0].DoubleSigners)
+}
+
+func TestCommitTx_RejectedLocally(t *testing.T) {
+	server, client := createNetworkTwoPeers(t, 1000, 3000)
+
+	pubKeyBytes, err := crypto.MarshalPublicKey(client.privKey.GetPublic())
+	assert.NoError(t, err)
+
+	//More than the client holds so its own ledger won't commit it
+	tx, err := client.BuildTx(client.Host.ID().String(), server.Host.ID().String(), 2000, pubKeyBytes)
+	assert.NoError(t, err)
+	assert.NoError(t, fcrypto.SignTx(tx, client.privKey))
+	tx.Verifiers = []models.Verifier{{ID: server.Host.ID().String()}}
+
+	coverage, err := client.CommitTx(tx)
+	assert.Error(t, err)
+	assert.Nil(t, coverage)
+	assert.Empty(t, client.OutboundCommits())
+	assert.Empty(t, client.Txs()[client.Host.ID().String()])
+}
+
+func TestCommit_OutOfOrder(t *testing.T) {
+	node1, node2, node3 := createNetworkThreePeers(t, 1000, 2000, 500)
+
+	from := node1.Host.ID().String()
+	to := node2.Host.ID().String()
+
+	tx0 := verifyWith(t, node1, node2, to, 25)
+	tx1 := verifyWith(t, node1, node2, to, 30)
+
+	//Only node1 commits tx0 so node3 first hears of tx1
+	assert.NoError(t, node1.ledger.commit(tx0))
+	msg, err := json.Marshal(tx1)
+	assert.NoError(t, err)
+	assert.NoError(t, node1.commits.send(msg, node3.Host.ID()))
+
+	//node3 fetches tx0 from node1 and then applies the buffered tx1
+	assert.Eventually(t, func() bool { return len(node3.Txs()[from]) == 2 }, 5*time.Second, 10*time.Millisecond)
+	assert.Empty(t, node3.MissingTxs())
+	assert.Equal(t, models.Amount(945), node3.Balance(from))
+	assert.Equal(t, models.Amount(2055), node3.Balance(to))
+}
+
+func TestTransfer_SlowVerifier(t *testing.T) {
+	node1, node2, node3 := createNetworkThreePeers(t, 1000, 2000, 500)
+
+	//node3 takes longer than the request timeout to answer but node2 alone
+	//holds a quorum so the transfer shouldn't wait for it
+	node3.Host.SetStreamHandler(node3.protocolID(verifyTxProtocol), func(s network.Stream) {
+		time.Sleep(10 * time.Second)
+		s.Reset()
+	})
+
+	start := time.Now()
+	_, err := node1.Transfer(node2.Host.ID().String(), 25)
+	assert.NoError(t, err)
+	assert.Less(t, time.Since(start), 2*time.Second)
+
+	_, ok := node1.PeerLatency(node2.Host.ID())
+	assert.True(t, ok)
+
+	_, ok = node1.PeerLatency(node3.Host.ID())
+	assert.False(t, ok)
+}
+
+func TestCommit_GossipPartialMesh(t *testing.T) {
+	mn := mocknet.New()
+
+	var hosts []host.Host
+	for i := 0; i < 3; i++ {
+		h, err := mn.GenPeer()
+		assert.NoError(t, err)
+		hosts = append(hosts, h)
+	}
+	assert.NoError(t, mn.LinkAll())
+
+	genesis := map[string]models.Amount{
+		hosts[0].ID().String(): 1000,
+		hosts[1].ID().String(): 2000,
+		hosts[2].ID().String(): 500,
+	}
+
+	//A line node1 - node2 - node3 so node1 and node3 never connect
+	node1 := New(hosts[0].Peerstore().PrivKey(hosts[0].ID()), &hosts[0], genesis, []string{}, "")
+	node1.Start()
+	node2 := New(hosts[1].Peerstore().PrivKey(hosts[1].ID()), &hosts[1], genesis, []string{createMultiaddress(t, node1)}, "")
+	node2.Start()
+	node3 := New(hosts[2].Peerstore().PrivKey(hosts[2].ID()), &hosts[2], genesis, []string{createMultiaddress(t, node2)}, "")
+	node3.Start()
+
+	from := node1.Host.ID().String()
+	to := node2.Host.ID().String()
+
+	_, err := node1.Transfer(to, 25)
+	assert.NoError(t, err)
+
+	//node2 passes the commit on to node3
+	assert.Eventually(t, func() bool {
+		txs := node3.Txs()[from]
+		return len(txs) == 1 && txs[0].Comitted
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, 0, len(node1.Host.Network().ConnsToPeer(node3.Host.ID())))
+	assert.Equal(t, models.Amount(975), node3.Balance(from))
+	assert.Equal(t, models.Amount(2025), node3.Balance(to))
+
+	//A tx without a quorum certificate is dropped by node2
+	uncertified := verifyWith(t, node1, node2, to, 30)
+	uncertified.Verifiers = nil
+	msg, err := json.Marshal(uncertified)
+	assert.NoError(t, err)
+	node1.commits.Publish(msg)
 
-	assert.Equal(t, float64(450), serverNode.Balances[clientNode.Host.ID().String()])
-	assert.Equal(t, float64(1030), serverNode.Balances[serverNode.Host.ID().String()])
-	assert.Equal(t, float64(20), serverNode.Balances[newNode.Host.ID().String()])
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, 1, len(node3.Txs()[from]))
+	assert.False(t, node2.Txs()[from][1].Comitted)
 }
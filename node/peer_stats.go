@@ -0,0 +1,108 @@
+package node
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ackhia/flash/models"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// Weight given to the newest sample in the latency moving average
+const latencySmoothing = 0.2
+
+// peerStats tracks how quickly each peer answers verification requests so
+// the fastest peers can be asked first next time, and which peers have sent
+// invalid data
+type peerStats struct {
+	mu          sync.Mutex
+	latency     map[peer.ID]time.Duration
+	failures    map[peer.ID]int
+	misbehaving map[peer.ID]string
+}
+
+func newPeerStats() *peerStats {
+	return &peerStats{
+		latency:     make(map[peer.ID]time.Duration),
+		failures:    make(map[peer.ID]int),
+		misbehaving: make(map[peer.ID]string),
+	}
+}
+
+func (s *peerStats) record(p peer.ID, d time.Duration, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err != nil {
+		s.failures[p]++
+		return
+	}
+
+	s.failures[p] = 0
+	prev, ok := s.latency[p]
+	if !ok {
+		s.latency[p] = d
+		return
+	}
+
+	s.latency[p] = prev + time.Duration(latencySmoothing*float64(d-prev))
+}
+
+// Latency returns the moving average response time of a peer and whether it
+// has answered any request yet
+func (s *peerStats) Latency(p peer.ID) (time.Duration, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	d, ok := s.latency[p]
+	return d, ok
+}
+
+func (s *peerStats) reportMisbehaving(p peer.ID, reason error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.misbehaving[p] = reason.Error()
+}
+
+// Misbehaving returns the peers that have sent invalid data and the last
+// reason for each
+func (s *peerStats) Misbehaving() map[peer.ID]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	misbehaving := make(map[peer.ID]string, len(s.misbehaving))
+	for p, reason := range s.misbehaving {
+		misbehaving[p] = reason
+	}
+
+	return misbehaving
+}
+
+// order sorts peers so those with the most voting weight come first. Ties
+// go to peers that have not been failing and then to the fastest. Peers
+// without any latency samples sort after those with samples.
+func (s *peerStats) order(peers []peer.ID, weights map[string]models.Amount) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sort.SliceStable(peers, func(i, j int) bool {
+		a, b := peers[i], peers[j]
+		if weights[a.String()] != weights[b.String()] {
+			return weights[a.String()] > weights[b.String()]
+		}
+
+		if s.failures[a] != s.failures[b] {
+			return s.failures[a] < s.failures[b]
+		}
+
+		la, okA := s.latency[a]
+		lb, okB := s.latency[b]
+		if okA != okB {
+			return okA
+		}
+
+		return la < lb
+	})
+}
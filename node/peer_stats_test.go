@@ -0,0 +1,44 @@
+package node
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/ackhia/flash/models"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPeerStats_Order(t *testing.T) {
+	heavy, light, fast, slow, failing := peer.ID("heavy"), peer.ID("light"), peer.ID("fast"), peer.ID("slow"), peer.ID("failing")
+	weights := map[string]models.Amount{
+		heavy.String(): 500,
+		light.String(): 10,
+	}
+
+	s := newPeerStats()
+	s.record(fast, 10*time.Millisecond, nil)
+	s.record(slow, 200*time.Millisecond, nil)
+	s.record(failing, time.Millisecond, errors.New("timeout"))
+
+	peers := []peer.ID{failing, slow, light, fast, heavy}
+	s.order(peers, weights)
+
+	assert.Equal(t, []peer.ID{heavy, light, fast, slow, failing}, peers)
+}
+
+func TestPeerStats_Latency(t *testing.T) {
+	s := newPeerStats()
+	p := peer.ID("p")
+
+	_, ok := s.Latency(p)
+	assert.False(t, ok)
+
+	s.record(p, 100*time.Millisecond, nil)
+	s.record(p, 200*time.Millisecond, nil)
+
+	d, ok := s.Latency(p)
+	assert.True(t, ok)
+	assert.Equal(t, 120*time.Millisecond, d)
+}
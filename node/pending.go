@@ -0,0 +1,214 @@
+package node
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	fcrypto "github.com/ackhia/flash/crypto"
+	"github.com/ackhia/flash/models"
+	"github.com/ackhia/flash/store"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// How long a pending tx is held before it can be dropped if it isn't
+// committed, and how often expired txs are swept
+const defaultPendingTxTTL = 2 * time.Minute
+const pendingSweepInterval = 30 * time.Second
+
+// dropPendingFrom removes a sender's txs from sequence number seq on and
+// returns the IDs of those removed. They must all be pending. The caller
+// must hold the lock.
+func (l *ledger) dropPendingFrom(from string, seq int) ([]models.TxID, error) {
+	txs := l.txs[from]
+	first := seq - l.base[from]
+	if first < 0 {
+		return nil, fmt.Errorf("sequence number %d from %s is covered by a checkpoint", seq, from)
+	}
+
+	for i := first; i < len(txs); i++ {
+		if txs[i].Comitted {
+			return nil, fmt.Errorf("tx %d from %s is already committed", txs[i].SequenceNum, from)
+		}
+	}
+
+	//Drop from the end so a failed write leaves the txs without a gap
+	var dropped []models.TxID
+	for last := len(txs) - 1; last >= first; last-- {
+		if err := l.persist(store.RecordDrop, &txs[last]); err != nil {
+			l.txs[from] = txs[:last+1]
+			return dropped, fmt.Errorf("could not persist drop: %v", err)
+		}
+
+		l.releasePending(&txs[last])
+		l.index.remove(&txs[last])
+		dropped = append(dropped, txs[last].ID())
+	}
+
+	if len(dropped) == 0 {
+		return nil, nil
+	}
+
+	l.txs[from] = txs[:first]
+
+	return dropped, nil
+}
+
+// expireFrom drops a sender's pending txs from seq on if the tx at seq has
+// expired and none after it are committed, and returns the IDs of those
+// dropped. The caller must hold the lock.
+func (l *ledger) expireFrom(from string, seq int, now time.Time) []models.TxID {
+	tx := l.txAt(from, seq)
+	if tx == nil || tx.Comitted {
+		return nil
+	}
+
+	expires, ok := l.expiry[tx.ID()]
+	if !ok || now.Before(expires) {
+		return nil
+	}
+
+	dropped, err := l.dropPendingFrom(from, seq)
+	if err != nil {
+		return dropped
+	}
+
+	log.Printf("Dropped %d expired pending txs from %s from sequence number %d", len(dropped), from, seq)
+	return dropped
+}
+
+// expirePending drops every sender's expired pending txs and returns the
+// IDs of those dropped
+func (l *ledger) expirePending(now time.Time) []models.TxID {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var dropped []models.TxID
+	for from, txs := range l.txs {
+		for i := range txs {
+			if ids := l.expireFrom(from, txs[i].SequenceNum, now); len(ids) > 0 {
+				dropped = append(dropped, ids...)
+				break
+			}
+		}
+	}
+
+	return dropped
+}
+
+// cancel drops the pending txs a sender abandoned. The caller must have
+// checked the cancellation's sig.
+func (l *ledger) cancel(c *models.Cancellation) ([]models.TxID, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.dropPendingFrom(c.From, c.SequenceNum)
+}
+
+// pendingTxs returns copies of a sender's pending txs in sequence order
+func (l *ledger) pendingTxs(from string) []models.Tx {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	//Committed txs always come before pending ones
+	return append([]models.Tx(nil), l.txs[from][l.committed[from]:]...)
+}
+
+// startPendingExpiry sweeps expired pending txs every interval so an
+// account whose sender gave up on a tx isn't stuck on its sequence number
+func (n *Node) startPendingExpiry(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			n.txStatus.drop(n.ledger.expirePending(time.Now()), models.TxExpired, nil)
+		}
+	}()
+}
+
+// Cancel abandons our pending txs from sequence number seq on. The signed
+// cancellation is gossiped so peers holding them drop them too. Our next tx
+// reuses seq, so only txs no verifier signed should be cancelled: a
+// verifier that signed one never signs a different tx for its sequence
+// number.
+func (n *Node) Cancel(seq int) error {
+	pubKeyBytes, err := crypto.MarshalPublicKey(n.privKey.GetPublic())
+	if err != nil {
+		return err
+	}
+
+	c := models.Cancellation{
+		Network:     n.networkID,
+		From:        n.Host.ID().String(),
+		SequenceNum: seq,
+		Pubkey:      pubKeyBytes,
+	}
+
+	if err = fcrypto.SignCancellation(&c, n.privKey); err != nil {
+		return fmt.Errorf("could not sign cancellation: %v", err)
+	}
+
+	dropped, err := n.ledger.cancel(&c)
+	if err != nil {
+		return fmt.Errorf("could not cancel txs: %v", err)
+	}
+	n.txStatus.drop(dropped, models.TxFailed, errors.New("cancelled"))
+
+	n.mu.Lock()
+	n.nextSequenceNum = min(n.nextSequenceNum, seq)
+	n.mu.Unlock()
+
+	msg, err := json.Marshal(c)
+	if err != nil {
+		return fmt.Errorf("could not marshal cancellation: %v", err)
+	}
+
+	n.cancellations.Publish(msg)
+
+	return nil
+}
+
+// validateCancelMsg is the cancellation topic's validator. Only
+// cancellations signed by the sender are gossiped on.
+func (n *Node) validateCancelMsg(from peer.ID, data []byte) error {
+	var c models.Cancellation
+	if err := json.Unmarshal(data, &c); err != nil {
+		return fmt.Errorf("could not unmarshal cancellation: %v", err)
+	}
+
+	if c.Network != n.networkID {
+		return fmt.Errorf("cancellation is for network %s", c.Network)
+	}
+
+	result, err := fcrypto.VerifyCancellationSig(&c)
+	if err != nil {
+		return fmt.Errorf("could not verify cancellation sig: %v", err)
+	}
+
+	if !result {
+		return fmt.Errorf("cancellation has invalid sig")
+	}
+
+	return nil
+}
+
+func (n *Node) handleCancelMsg(from peer.ID, data []byte) {
+	var c models.Cancellation
+	if err := json.Unmarshal(data, &c); err != nil {
+		return
+	}
+
+	dropped, err := n.ledger.cancel(&c)
+	if err != nil {
+		log.Printf("Could not cancel txs from %s %v", c.From, err)
+		return
+	}
+
+	if len(dropped) > 0 {
+		log.Printf("Cancelled %d pending txs from %s from sequence number %d", len(dropped), c.From, c.SequenceNum)
+	}
+}
@@ -0,0 +1,209 @@
+package node
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	fcrypto "github.com/ackhia/flash/crypto"
+	"github.com/ackhia/flash/models"
+	"github.com/ackhia/flash/transport"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// Largest account ID a peer can ask for the head of
+const maxAccountIDBytes = 1024
+
+// Largest account head reply the client will read
+const maxAccountHeadBytes = 4 << 20
+
+// accountHeadReply is how far a peer's ledger goes for an account along
+// with the account's pending txs it holds
+type accountHeadReply struct {
+	Head    models.AccountHead `json:"head"`
+	Pending []models.Tx        `json:"pending,omitempty"`
+}
+
+// startAccountHeadServer tells peers how far our ledger goes for an account
+// and which of its txs we hold pending so a node can pick up txs it lost
+func (n *Node) startAccountHeadServer() {
+	n.Host.SetStreamHandler(n.protocolID(accountHeadProtocol), func(s network.Stream) {
+		defer s.Close()
+
+		account, err := transport.ReceiveBytesMax(s, maxAccountIDBytes)
+		if err != nil {
+			log.Printf("Could not read account %v", err)
+			return
+		}
+
+		reply := accountHeadReply{
+			Head:    n.ledger.AccountHead(string(account)),
+			Pending: n.ledger.pendingTxs(string(account)),
+		}
+
+		msg, err := json.Marshal(reply)
+		if err != nil {
+			log.Printf("Could not marshal account head %v", err)
+			return
+		}
+
+		if err = transport.SendBytes(msg, s); err != nil {
+			log.Printf("Could not send account head %v", err)
+		}
+	})
+}
+
+// queryAccountHead asks a peer how far its ledger goes for an account
+func (n *Node) queryAccountHead(p peer.ID, account string) (*accountHeadReply, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	stream, err := n.Host.NewStream(ctx, p, n.protocolID(accountHeadProtocol))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open stream: %v", err)
+	}
+
+	defer stream.Close()
+	stream.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if err = transport.SendBytes([]byte(account), stream); err != nil {
+		return nil, fmt.Errorf("failed to send account: %v", err)
+	}
+
+	data, err := transport.ReceiveBytesMax(stream, maxAccountHeadBytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to receive account head: %v", err)
+	}
+
+	var reply accountHeadReply
+	if err = json.Unmarshal(data, &reply); err != nil {
+		return nil, fmt.Errorf("could not unmarshal account head: %v", err)
+	}
+
+	return &reply, nil
+}
+
+// recoverSequence picks up our next sequence number from our own txs after
+// a restart. Peers that hold commits of ours we don't are synced from. A
+// verifier never signs a different tx for a sequence number it has signed
+// one for, so pending txs of ours we lost are finished rather than replaced.
+// Those that can't be finished yet are retried before our next tx. Our next
+// tx then follows on from what the network has.
+func (n *Node) recoverSequence() {
+	self := n.Host.ID().String()
+	head := n.ledger.AccountHead(self)
+
+	peerNext := head.Next
+	var lost []models.Tx
+	for _, p := range n.Host.Network().Peers() {
+		theirs, err := n.queryAccountHead(p, self)
+		if err != nil {
+			log.Printf("Could not get our account head from %s %v", p, err)
+			continue
+		}
+
+		if theirs.Head.Committed > head.Committed {
+			if err = n.syncFrom(p); err != nil {
+				log.Printf("Could not sync from %s %v", p, err)
+			}
+			head = n.ledger.AccountHead(self)
+		}
+
+		if theirs.Head.Next > peerNext {
+			peerNext = theirs.Head.Next
+			lost = theirs.Pending
+		}
+	}
+
+	for i, tx := range lost {
+		if tx.SequenceNum < head.Next {
+			continue
+		}
+
+		if err := n.resumeTx(tx); err != nil {
+			log.Printf("Could not finish lost tx %d yet %v", tx.SequenceNum, err)
+			n.mu.Lock()
+			n.unfinished = append(n.unfinished, lost[i:]...)
+			n.mu.Unlock()
+			head.Next = lost[len(lost)-1].SequenceNum + 1
+			break
+		}
+		head = n.ledger.AccountHead(self)
+	}
+
+	if peerNext > head.Next {
+		log.Printf("Peers hold pending txs of ours from sequence number %d, cancelling them", head.Next)
+		if err := n.Cancel(head.Next); err != nil {
+			log.Printf("Could not cancel txs %v", err)
+		}
+	}
+
+	n.mu.Lock()
+	n.nextSequenceNum = max(n.nextSequenceNum, head.Next)
+	n.mu.Unlock()
+
+	log.Printf("Next sequence number is %d", head.Next)
+}
+
+// finishUnfinished sends our unfinished txs again in sequence order. It
+// stops at the first that still doesn't reach a quorum, which stays
+// unfinished.
+func (n *Node) finishUnfinished() error {
+	for {
+		n.mu.Lock()
+		if len(n.unfinished) == 0 {
+			n.mu.Unlock()
+			return nil
+		}
+		tx := n.unfinished[0]
+		n.unfinished = n.unfinished[1:]
+		n.mu.Unlock()
+
+		if err := n.resumeTx(tx); err != nil {
+			n.mu.Lock()
+			n.unfinished = append([]models.Tx{tx}, n.unfinished...)
+			n.mu.Unlock()
+			return fmt.Errorf("tx %d: %v", tx.SequenceNum, err)
+		}
+	}
+}
+
+// resumeTx collects a certificate for a tx of ours that we lost or that
+// didn't reach a quorum before, and commits it
+func (n *Node) resumeTx(tx models.Tx) error {
+	if tx.From != n.Host.ID().String() {
+		return fmt.Errorf("tx is from %s", tx.From)
+	}
+
+	result, err := fcrypto.VerifyTxSig(tx)
+	if err != nil {
+		return fmt.Errorf("could not verify tx sig: %v", err)
+	}
+
+	if !result {
+		return fmt.Errorf("tx has invalid sig")
+	}
+
+	tx.Verifiers = nil
+	tx.Comitted = false
+	n.txStatus.start(&tx, time.Now())
+
+	n.txStatus.update(&tx, models.TxVerifying, nil)
+	if err = n.VerifyTx(&tx); err != nil {
+		n.txStatus.update(&tx, models.TxFailed, err)
+		return err
+	}
+	n.txStatus.update(&tx, models.TxQuorumReached, nil)
+
+	n.txStatus.update(&tx, models.TxCommitting, nil)
+	if _, err = n.CommitTx(&tx); err != nil {
+		n.txStatus.update(&tx, models.TxFailed, err)
+		return err
+	}
+	n.txStatus.update(&tx, models.TxCommitted, nil)
+
+	return nil
+}
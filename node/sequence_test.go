@@ -0,0 +1,34 @@
+package node
+
+import (
+	"testing"
+
+	"github.com/ackhia/flash/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecoverSequence_AfterRestart(t *testing.T) {
+	server, client := createNetworkTwoPeers(t, 1000, 3000)
+
+	from := client.Host.ID().String()
+	to := server.Host.ID().String()
+	_, err := client.Transfer(to, 10)
+	assert.NoError(t, err)
+
+	//The server verified a tx the client loses when it restarts
+	verifyWith(t, client, server, to, 20)
+	assert.Equal(t, models.AccountHead{Committed: 1, Next: 2}, server.AccountHead(from))
+
+	restarted := New(client.privKey, &client.Host, client.ledger.genesis, []string{createMultiaddress(t, server)}, "")
+	assert.NoError(t, restarted.Start())
+
+	//The commit is synced and the lost pending tx is finished as the
+	//server won't sign another for its sequence number
+	assert.Equal(t, models.AccountHead{Committed: 2, Next: 2}, restarted.AccountHead(from))
+	assert.Equal(t, models.AccountHead{Committed: 2, Next: 2}, server.AccountHead(from))
+
+	_, err = restarted.Transfer(to, 30)
+	assert.NoError(t, err)
+	assert.Equal(t, models.AccountHead{Committed: 3, Next: 3}, server.AccountHead(from))
+	assert.Equal(t, models.Amount(940), server.Balance(from))
+}
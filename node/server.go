@@ -3,7 +3,11 @@ package node
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"log"
+	"time"
 
 	fcrypto "github.com/ackhia/flash/crypto"
 	"github.com/ackhia/flash/models"
@@ -12,27 +16,49 @@ import (
 	"github.com/libp2p/go-libp2p/core/peer"
 )
 
-func (n Node) startTransactionServer() {
-	n.Host.SetStreamHandler("/flash/transactions/1.0.0", func(s network.Stream) {
+// Largest verification request or reply either side will read
+const maxVerifyMsgBytes = 1 << 20
+
+// Largest equivocation proof a node will read
+const maxEquivocationBytes = 1 << 20
+
+// startHandshakeServer answers a peer's network ID with ours and drops the
+// connection if they differ
+func (n *Node) startHandshakeServer() {
+	n.Host.SetStreamHandler(handshakeProtocol, func(s network.Stream) {
 		defer s.Close()
-		data, err := json.Marshal(n.Txs)
+
+		data, err := transport.ReceiveBytesMax(s, int64(len(n.networkID)))
 		if err != nil {
-			log.Printf("could not marshal transactions")
+			log.Printf("Could not read handshake %v", err)
 			return
 		}
-		s.Write(data)
-	})
 
-	select {}
+		err = transport.SendBytes(n.networkID[:], s)
+		if err != nil {
+			log.Printf("Could not send handshake %v", err)
+			return
+		}
+
+		if !bytes.Equal(data, n.networkID[:]) {
+			log.Printf("Peer %s is on network %x, disconnecting", s.Conn().RemotePeer(), data)
+
+			//Give the peer time to read our network ID before dropping the
+			//connection, closing it straight away discards the reply
+			s.SetReadDeadline(time.Now().Add(5 * time.Second))
+			io.Copy(io.Discard, s)
+			s.Conn().Close()
+		}
+	})
 }
 
 func (n *Node) startVerificationServer() {
-	n.Host.SetStreamHandler(verifyTxProtocol, func(s network.Stream) {
+	n.Host.SetStreamHandler(n.protocolID(verifyTxProtocol), func(s network.Stream) {
 		defer s.Close()
 
 		log.Print("Client connected to verification server")
 
-		data, err := transport.ReceiveBytes(s)
+		data, err := transport.ReceiveBytesMax(s, maxVerifyMsgBytes)
 		if err != nil {
 			log.Printf("Could not read tx %v", err)
 			return
@@ -46,18 +72,12 @@ func (n *Node) startVerificationServer() {
 			return
 		}
 
-		bal, ok := n.Balances[tx.From]
-		if !ok || bal < tx.Amount {
-			log.Printf("Balance too low for %s", tx.From)
-			return
-		}
-
-		if len(n.Txs[tx.From]) != tx.SequenceNum {
-			log.Printf("Invalid sequence number %d", tx.SequenceNum)
+		if tx.Network != n.networkID {
+			log.Printf("Tx is for network %s", tx.Network)
 			return
 		}
 
-		if tx.Amount <= 0 {
+		if tx.Amount == 0 {
 			return
 		}
 
@@ -85,103 +105,100 @@ func (n *Node) startVerificationServer() {
 			return
 		}
 
-		sig, err := fcrypto.CreateVerifyerSig(&tx, n.privKey)
+		verifier, err := fcrypto.CreateVerifier(&tx, n.privKey)
 		if err != nil {
 			log.Printf("Could not sign tx %v", err)
 			return
 		}
 
-		tx.Comitted = false
-		n.Txs[tx.From] = append(n.Txs[tx.From], tx)
-
-		err = transport.SendBytes(sig, s)
+		msg, err := json.Marshal(verifier)
 		if err != nil {
-			log.Printf("Could not send bytes %v", err)
+			log.Printf("Could not marshal verifier %v", err)
+			return
 		}
-	})
 
-	select {}
-}
-
-func (n *Node) startCommitTxServer() {
-	n.Host.SetStreamHandler(commitTxProtocol, func(s network.Stream) {
+		if err = n.ledger.addSigned(tx); err != nil {
+			log.Printf("Could not add tx %v", err)
 
-		defer s.Close()
-
-		log.Print("Client connected to commit server")
-
-		data, err := transport.ReceiveBytes(s)
-		if err != nil {
-			log.Printf("Could not read tx %v", err)
+			var eqErr *equivocationError
+			if errors.As(err, &eqErr) {
+				n.handleEquivocation(&eqErr.proof)
+			}
 			return
 		}
-		log.Print("Received commit request")
 
-		var tx models.Tx
-		err = json.Unmarshal(data, &tx)
+		err = transport.SendBytes(msg, s)
 		if err != nil {
-			log.Printf("Could not unmarshall tx %v", err)
-			return
+			log.Printf("Could not send bytes %v", err)
 		}
+	})
+}
 
-		var localTx *models.Tx
-		for i := range n.Txs[tx.From] {
-			t := &n.Txs[tx.From][i]
-			if bytes.Compare(t.Sig, tx.Sig) == 0 {
-				localTx = t
-				break
-			}
-		}
+// applyCommit commits a certified tx received from a peer. Equivocations
+// are handled, a reconciled conflict counts as committed, and if earlier
+// txs are missing they are fetched from the peer.
+func (n *Node) applyCommit(tx *models.Tx, from peer.ID) error {
+	err := n.ledger.commit(tx)
+	if err == nil {
+		return nil
+	}
 
-		if localTx == nil {
-			log.Print("Could not find local tx")
-			return
+	var eqErr *equivocationError
+	if errors.As(err, &eqErr) {
+		n.handleEquivocation(&eqErr.proof)
+		if eqErr.reconciled {
+			return nil
 		}
+	}
 
-		if localTx.Amount != tx.Amount ||
-			localTx.From != tx.From ||
-			bytes.Compare(localTx.Pubkey, tx.Pubkey) != 0 ||
-			localTx.To != tx.To ||
-			bytes.Compare(localTx.Sig, tx.Sig) != 0 ||
-			localTx.Comitted ||
-			tx.Comitted ||
-			localTx.SequenceNum != tx.SequenceNum {
-			log.Print("tx dose not match database")
-			return
-		}
+	log.Printf("Could not commit tx %v", err)
 
-		for _, v := range tx.Verifiers {
-			peerID, err := peer.Decode(v.ID)
-			if err != nil {
-				log.Printf("Error decoding Peer ID %v", err)
-				return
-			}
+	var missingErr *missingTxsError
+	if errors.As(err, &missingErr) {
+		go n.fetchMissingTxs(from)
+	}
+
+	return err
+}
 
-			result, err := fcrypto.VerifyVerifier(&v, &tx, n.Host.Network().Peerstore().PubKey(peerID), peerID)
+// validateCommitMsg is the commit topic's validator. It runs the same
+// checks as verifying a tx's quorum certificate so only certified txs are
+// gossiped on.
+func (n *Node) validateCommitMsg(from peer.ID, data []byte) error {
+	var tx models.Tx
+	if err := json.Unmarshal(data, &tx); err != nil {
+		return fmt.Errorf("could not unmarshall tx %v", err)
+	}
 
-			if err != nil {
-				log.Printf("Verifier not valid %v", err)
-				return
-			}
+	return n.validateCertifiedTx(&tx)
+}
 
-			if !result {
-				log.Printf("Verifier not valid")
-				return
-			}
-		}
+func (n *Node) handleCommitMsg(from peer.ID, data []byte) {
+	var tx models.Tx
+	if err := json.Unmarshal(data, &tx); err != nil {
+		return
+	}
+
+	n.applyCommit(&tx, from)
+}
 
-		_, err = n.isVerifierConsensus(&tx)
+func (n *Node) startEquivocationServer() {
+	n.Host.SetStreamHandler(n.protocolID(equivocationProtocol), func(s network.Stream) {
+		defer s.Close()
+
+		data, err := transport.ReceiveBytesMax(s, maxEquivocationBytes)
 		if err != nil {
-			log.Print("Consensus could not be reached")
+			log.Printf("Could not read equivocation proof %v", err)
 			return
 		}
 
-		localTx.Verifiers = tx.Verifiers
-		localTx.Comitted = true
-		n.calcBalances()
+		var proof models.EquivocationProof
+		err = json.Unmarshal(data, &proof)
+		if err != nil {
+			log.Printf("Could not unmarshall equivocation proof %v", err)
+			return
+		}
 
-		transport.SendBytes([]byte("ok"), s)
+		n.handleEquivocation(&proof)
 	})
-
-	select {}
 }
@@ -0,0 +1,395 @@
+package node
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/ackhia/flash/merkle"
+	"github.com/ackhia/flash/models"
+	"github.com/ackhia/flash/transport"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// Largest state request or response either side will read
+const maxStateMsgBytes = 1 << 20
+
+// stateRequest asks a peer for the hashes of some nodes of its state tree
+// and the contents of some buckets
+type stateRequest struct {
+	Nodes   []int `json:"nodes"`
+	Buckets []int `json:"buckets"`
+}
+
+type stateResponse struct {
+	Nodes   map[int]merkle.Hash                    `json:"nodes"`
+	Buckets map[int]map[string]merkle.AccountState `json:"buckets"`
+}
+
+// rebuildState recomputes the balances and state tree from scratch. The
+// caller must hold the lock.
+func (l *ledger) rebuildState() error {
+	err := l.calcBalances()
+
+	l.state = merkle.New()
+	l.index.rebuild(l.txs)
+	l.rebuildOrder()
+	l.committed = make(map[string]int)
+	l.pendingDebits = make(map[string]models.Amount)
+	l.pendingCredits = make(map[string]models.Amount)
+
+	for from, txs := range l.txs {
+		l.advanceCommitted(from)
+		for i := range txs {
+			if txs[i].Comitted {
+				continue
+			}
+
+			if addErr := addTo(l.pendingDebits, txs[i].From, txs[i].Amount); addErr != nil && err == nil {
+				err = addErr
+			}
+			if addErr := addTo(l.pendingCredits, txs[i].To, txs[i].Amount); addErr != nil && err == nil {
+				err = addErr
+			}
+		}
+	}
+
+	for account := range l.balances {
+		l.updateState(account)
+	}
+	for account := range l.base {
+		l.updateState(account)
+	}
+	for account := range l.txs {
+		l.updateState(account)
+	}
+
+	return err
+}
+
+// trackCommit applies a newly committed tx to the balances and state tree.
+// The caller must hold the lock.
+func (l *ledger) trackCommit(tx *models.Tx) {
+	if err := addTo(l.credits, tx.To, tx.Amount); err != nil {
+		log.Printf("Could not credit tx %s %v", tx.ID(), err)
+	}
+	if err := addTo(l.debits, tx.From, tx.Amount); err != nil {
+		log.Printf("Could not debit tx %s %v", tx.ID(), err)
+	}
+	l.advanceCommitted(tx.From)
+	l.order = append(l.order, txRef{from: tx.From, seq: tx.SequenceNum})
+
+	l.updateState(tx.From)
+	l.updateState(tx.To)
+}
+
+// rebuildOrder drops txs from the commit order that are no longer held
+// committed, such as those a checkpoint pruned. The caller must hold the
+// lock.
+func (l *ledger) rebuildOrder() {
+	seen := make(map[txRef]bool, len(l.order))
+	order := l.order[:0]
+	for _, ref := range l.order {
+		tx := l.txAt(ref.from, ref.seq)
+		if seen[ref] || tx == nil || !tx.Comitted {
+			continue
+		}
+		seen[ref] = true
+		order = append(order, ref)
+	}
+	clear(l.order[len(order):])
+	l.order = order
+}
+
+// advanceCommitted moves a sender's committed count past any txs that are
+// now committed. The caller must hold the lock.
+func (l *ledger) advanceCommitted(from string) {
+	txs := l.txs[from]
+	c := l.committed[from]
+	for c < len(txs) && txs[c].Comitted {
+		c++
+	}
+	l.committed[from] = c
+}
+
+// updateState sets an account's balance and leaf from the ledger. The
+// caller must hold the lock.
+func (l *ledger) updateState(account string) {
+	balance := l.committedBalance(account)
+	if old, ok := l.balances[account]; !ok || old != balance {
+		l.balances[account] = balance
+		l.emit(Event{Type: EventBalanceChanged, Account: account, Balance: balance})
+	}
+
+	head := l.accountHead(account).Committed
+	l.state.Set(account, merkle.AccountState{Balance: balance, Head: head})
+}
+
+// committedBalance is an account's balance from committed txs only. The
+// caller must hold the lock.
+func (l *ledger) committedBalance(account string) models.Amount {
+	credited, err := l.baseBalances()[account].Add(l.credits[account])
+	if err != nil {
+		return 0
+	}
+
+	//A commit is only appended once its sender's balance covers it, but a
+	//certified tx replacing a pending one is taken on its quorum as the
+	//verifiers saw it funded. Until we commit the tx that funded it the
+	//balance is short, and it is held at zero rather than wrapping around.
+	balance, err := credited.Sub(l.debits[account])
+	if err != nil {
+		return 0
+	}
+
+	return balance
+}
+
+// available is what an account can still spend: its committed balance less
+// what its pending txs have reserved. Coins sent to it by pending txs don't
+// count until they commit. The caller must hold the lock.
+func (l *ledger) available(account string) models.Amount {
+	available, err := l.committedBalance(account).Sub(l.pendingDebits[account])
+	if err != nil {
+		return 0
+	}
+
+	return available
+}
+
+// pendingBalance is an account's committed balance with its pending txs
+// applied. The caller must hold the lock.
+func (l *ledger) pendingBalance(account string) models.Amount {
+	credited, err := l.committedBalance(account).Add(l.pendingCredits[account])
+	if err != nil {
+		return 0
+	}
+
+	balance, err := credited.Sub(l.pendingDebits[account])
+	if err != nil {
+		return 0
+	}
+
+	return balance
+}
+
+// releasePending frees what a pending tx reserved once it commits or is
+// dropped. The caller must hold the lock.
+func (l *ledger) releasePending(tx *models.Tx) {
+	l.pendingDebits[tx.From] = release(l.pendingDebits, tx.From, tx)
+	if l.pendingDebits[tx.From] == 0 {
+		delete(l.pendingDebits, tx.From)
+	}
+
+	l.pendingCredits[tx.To] = release(l.pendingCredits, tx.To, tx)
+	if l.pendingCredits[tx.To] == 0 {
+		delete(l.pendingCredits, tx.To)
+	}
+	delete(l.expiry, tx.ID())
+}
+
+// addTo adds amount to an account's total in sums, leaving the total as it
+// was if it would overflow
+func addTo(sums map[string]models.Amount, account string, amount models.Amount) error {
+	total, err := sums[account].Add(amount)
+	if err != nil {
+		return fmt.Errorf("total of %s overflows", account)
+	}
+	sums[account] = total
+
+	return nil
+}
+
+func release(pending map[string]models.Amount, account string, tx *models.Tx) models.Amount {
+	released, err := pending[account].Sub(tx.Amount)
+	if err != nil {
+		log.Printf("Pending amounts for %s are less than tx %s", account, tx.ID())
+		return 0
+	}
+
+	return released
+}
+
+// StateRoot returns the root of the tree over committed account states
+func (l *ledger) StateRoot() merkle.Hash {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	return l.state.Root()
+}
+
+func (l *ledger) answerState(req *stateRequest) (*stateResponse, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	resp := stateResponse{
+		Nodes:   make(map[int]merkle.Hash),
+		Buckets: make(map[int]map[string]merkle.AccountState),
+	}
+
+	for _, i := range req.Nodes {
+		h, err := l.state.Node(i)
+		if err != nil {
+			return nil, err
+		}
+		resp.Nodes[i] = h
+	}
+
+	for _, b := range req.Buckets {
+		accounts, err := l.state.Bucket(b)
+		if err != nil {
+			return nil, err
+		}
+		resp.Buckets[b] = accounts
+	}
+
+	return &resp, nil
+}
+
+// startStateServer answers requests for parts of our state tree. A peer can
+// send any number of requests on one stream.
+func (n *Node) startStateServer() {
+	n.Host.SetStreamHandler(n.protocolID(stateProtocol), func(s network.Stream) {
+		defer s.Close()
+
+		for {
+			data, err := transport.ReceiveBytesMax(s, maxStateMsgBytes)
+			if err != nil {
+				return
+			}
+
+			var req stateRequest
+			if err = json.Unmarshal(data, &req); err != nil {
+				log.Printf("Could not unmarshal state request %v", err)
+				return
+			}
+
+			resp, err := n.ledger.answerState(&req)
+			if err != nil {
+				log.Printf("Invalid state request %v", err)
+				return
+			}
+
+			msg, err := json.Marshal(resp)
+			if err != nil {
+				log.Printf("Could not marshal state response %v", err)
+				return
+			}
+
+			if err = transport.SendBytes(msg, s); err != nil {
+				log.Printf("Could not send state response %v", err)
+				return
+			}
+		}
+	})
+}
+
+// CompareState walks a peer's state tree from the root down the branches
+// that differ from ours and returns the accounts whose balance or head
+// differ. It is empty when the nodes agree.
+func (n *Node) CompareState(p peer.ID) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	stream, err := n.Host.NewStream(ctx, p, n.protocolID(stateProtocol))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open stream: %v", err)
+	}
+
+	defer stream.Close()
+	stream.SetDeadline(time.Now().Add(10 * time.Second))
+
+	ask := func(req *stateRequest) (*stateResponse, error) {
+		msg, err := json.Marshal(req)
+		if err != nil {
+			return nil, err
+		}
+
+		if err = transport.SendBytes(msg, stream); err != nil {
+			return nil, fmt.Errorf("failed to send state request: %v", err)
+		}
+
+		data, err := transport.ReceiveBytesMax(stream, maxStateMsgBytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to receive state response: %v", err)
+		}
+
+		var resp stateResponse
+		if err = json.Unmarshal(data, &resp); err != nil {
+			return nil, fmt.Errorf("could not unmarshal state response: %v", err)
+		}
+
+		return &resp, nil
+	}
+
+	//Each round compares the children of the nodes that differed in the
+	//last one until it reaches the buckets
+	level := []int{1}
+	var buckets []int
+	for len(level) > 0 {
+		theirs, err := ask(&stateRequest{Nodes: level})
+		if err != nil {
+			return nil, err
+		}
+
+		ours, err := n.ledger.answerState(&stateRequest{Nodes: level})
+		if err != nil {
+			return nil, err
+		}
+
+		var next []int
+		for _, i := range level {
+			h, ok := theirs.Nodes[i]
+			if !ok {
+				return nil, fmt.Errorf("peer did not send node %d", i)
+			}
+
+			if h == ours.Nodes[i] {
+				continue
+			}
+
+			if merkle.IsBucket(i) {
+				buckets = append(buckets, i-merkle.NumBuckets)
+			} else {
+				next = append(next, 2*i, 2*i+1)
+			}
+		}
+		level = next
+	}
+
+	if len(buckets) == 0 {
+		return nil, nil
+	}
+
+	theirs, err := ask(&stateRequest{Buckets: buckets})
+	if err != nil {
+		return nil, err
+	}
+
+	ours, err := n.ledger.answerState(&stateRequest{Buckets: buckets})
+	if err != nil {
+		return nil, err
+	}
+
+	var diverging []string
+	for _, b := range buckets {
+		for account, state := range ours.Buckets[b] {
+			if other, ok := theirs.Buckets[b][account]; !ok || other != state {
+				diverging = append(diverging, account)
+			}
+		}
+
+		for account := range theirs.Buckets[b] {
+			if _, ok := ours.Buckets[b][account]; !ok {
+				diverging = append(diverging, account)
+			}
+		}
+	}
+	sort.Strings(diverging)
+
+	return diverging, nil
+}
@@ -0,0 +1,61 @@
+package node
+
+import (
+	"sort"
+	"testing"
+
+	"github.com/ackhia/flash/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompareState(t *testing.T) {
+	node1, node2, node3 := createNetworkThreePeers(t, 1000, 2000, 500)
+	assert.Equal(t, node1.StateRoot(), node3.StateRoot())
+
+	from := node1.Host.ID().String()
+	to := node2.Host.ID().String()
+
+	//node3 misses the commit
+	tx := verifyWith(t, node1, node2, to, 25)
+	assert.NoError(t, node1.ledger.commit(tx))
+	assert.NoError(t, node2.ledger.commit(tx))
+
+	assert.Equal(t, node1.StateRoot(), node2.StateRoot())
+	assert.NotEqual(t, node1.StateRoot(), node3.StateRoot())
+
+	diverging, err := node3.CompareState(node1.Host.ID())
+	assert.NoError(t, err)
+	expected := []string{from, to}
+	sort.Strings(expected)
+	assert.Equal(t, expected, diverging)
+
+	diverging, err = node2.CompareState(node1.Host.ID())
+	assert.NoError(t, err)
+	assert.Empty(t, diverging)
+
+	assert.NoError(t, node3.ledger.commit(tx))
+	assert.Equal(t, node1.StateRoot(), node3.StateRoot())
+}
+
+func TestLedger_StateMatchesRebuild(t *testing.T) {
+	l := newLedger(map[string]models.Amount{"Alice": 100, "Heavy": 50, "Light": 10})
+	empty := l.StateRoot()
+
+	//Pending txs aren't part of the state
+	assert.NoError(t, l.addPending(models.Tx{SequenceNum: 0, From: "Alice", To: "Bob", Amount: 10, Sig: []byte("pending")}))
+	assert.Equal(t, empty, l.StateRoot())
+
+	//Replace the pending tx, and a heavier one doesn't replace that
+	l.commit(&models.Tx{SequenceNum: 0, From: "Alice", To: "Carol", Amount: 20, Sig: []byte("certified"), Verifiers: []models.Verifier{{ID: "Light"}}})
+	l.commit(&models.Tx{SequenceNum: 0, From: "Alice", To: "Dave", Amount: 30, Sig: []byte("heavier"), Verifiers: []models.Verifier{{ID: "Heavy"}}})
+	assert.NoError(t, l.commit(&models.Tx{SequenceNum: 1, From: "Alice", To: "Bob", Amount: 5, Sig: []byte("next")}))
+	assert.Equal(t, models.Amount(0), l.Balance("Dave"))
+	assert.Equal(t, models.Amount(20), l.Balance("Carol"))
+
+	incremental := l.StateRoot()
+	l.mu.Lock()
+	l.rebuildState()
+	l.mu.Unlock()
+	assert.Equal(t, incremental, l.StateRoot())
+	assert.NotEqual(t, empty, incremental)
+}
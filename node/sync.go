@@ -0,0 +1,274 @@
+package node
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/ackhia/flash/models"
+	"github.com/ackhia/flash/transport"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// Most txs and bytes the sync server puts in one batch
+const syncBatchSize = 100
+const syncBatchBytes = 1 << 20
+
+// Largest batch the sync client will read. A single tx may take a batch
+// over syncBatchBytes so this leaves some headroom.
+const maxSyncBatchBytes = 4 << 20
+
+// How long the sync client waits for the next batch
+const syncBatchTimeout = 30 * time.Second
+
+// startSyncServer answers a peer's sequence heads with the committed txs it
+// is missing, in the order we committed them. Txs are streamed in batches, each a length prefixed JSON
+// array, and an empty batch ends the stream.
+func (n *Node) startSyncServer() {
+	n.Host.SetStreamHandler(n.protocolID(syncProtocol), func(s network.Stream) {
+		defer s.Close()
+
+		data, err := transport.ReceiveBytesMax(s, maxSyncBatchBytes)
+		if err != nil {
+			log.Printf("Could not read sync heads %v", err)
+			return
+		}
+
+		heads := make(map[string]int)
+		if err = json.Unmarshal(data, &heads); err != nil {
+			log.Printf("Could not unmarshal sync heads %v", err)
+			return
+		}
+
+		var batch []json.RawMessage
+		size := 0
+		flush := func() error {
+			if len(batch) == 0 {
+				return nil
+			}
+
+			msg, err := json.Marshal(batch)
+			if err != nil {
+				return err
+			}
+			batch, size = nil, 0
+
+			return transport.SendBytes(msg, s)
+		}
+
+		//A tx can spend coins another sender's tx sent, so txs go in the
+		//order we committed them rather than sender by sender
+		refs := n.ledger.syncRefs(heads)
+		for len(refs) > 0 {
+			count := min(syncBatchSize, len(refs))
+			txs := n.ledger.committedTxs(refs[:count])
+			refs = refs[count:]
+
+			//A checkpoint pruned the rest while we were sending
+			if len(txs) < count {
+				refs = nil
+			}
+
+			for i := range txs {
+				raw, err := json.Marshal(&txs[i])
+				if err != nil {
+					log.Printf("Could not marshal tx %v", err)
+					return
+				}
+
+				if len(batch) == syncBatchSize || (size > 0 && size+len(raw) > syncBatchBytes) {
+					if err = flush(); err != nil {
+						log.Printf("Could not send sync batch %v", err)
+						return
+					}
+				}
+				batch = append(batch, raw)
+				size += len(raw)
+			}
+		}
+
+		if err = flush(); err != nil {
+			log.Printf("Could not send sync batch %v", err)
+			return
+		}
+
+		transport.SendBytes(nil, s)
+	})
+}
+
+// syncRefs returns the committed txs the holder of heads is missing in the
+// order we committed them. Each sender's txs stop at the first one we don't
+// hold committed, and none are sent for a sender whose head is before our
+// latest checkpoint as those txs are pruned.
+func (l *ledger) syncRefs(heads map[string]int) []txRef {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	end := make(map[string]int)
+	for from := range l.txs {
+		head := heads[from]
+		if head < l.base[from] {
+			continue
+		}
+
+		seq := head
+		for tx := l.txAt(from, seq); tx != nil && tx.Comitted; tx = l.txAt(from, seq) {
+			seq++
+		}
+		end[from] = seq
+	}
+
+	var refs []txRef
+	sent := make(map[txRef]bool)
+	for _, ref := range l.order {
+		if ref.seq >= heads[ref.from] && ref.seq < end[ref.from] {
+			refs = append(refs, ref)
+			sent[ref] = true
+		}
+	}
+
+	//Commits the order doesn't hold follow in sequence order
+	for _, from := range l.accounts() {
+		for seq := heads[from]; seq < end[from]; seq++ {
+			if ref := (txRef{from: from, seq: seq}); !sent[ref] {
+				refs = append(refs, ref)
+			}
+		}
+	}
+
+	return refs
+}
+
+// committedTxs returns copies of the txs refs point to. It stops at the
+// first that is no longer held committed.
+func (l *ledger) committedTxs(refs []txRef) []models.Tx {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	txs := make([]models.Tx, 0, len(refs))
+	for _, ref := range refs {
+		tx := l.txAt(ref.from, ref.seq)
+		if tx == nil || !tx.Comitted {
+			break
+		}
+		txs = append(txs, *tx)
+	}
+
+	return txs
+}
+
+// syncFrom pulls the checkpoints and then the committed txs we are missing
+// from a peer. Each batch is applied as it arrives so only one is held in
+// memory and an interrupted sync resumes from where it got to next time.
+// Every tx must be certified and follow on from the last one from its
+// sender or the sync is abandoned and the peer reported. A tx we can't
+// commit also ends the sync.
+func (n *Node) syncFrom(p peer.ID) error {
+	//A peer only holds the txs after its latest checkpoint
+	if err := n.syncCheckpoints(p); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	stream, err := n.Host.NewStream(ctx, p, n.protocolID(syncProtocol))
+	if err != nil {
+		return fmt.Errorf("failed to open stream: %v", err)
+	}
+
+	defer stream.Close()
+
+	msg, err := json.Marshal(n.ledger.heads())
+	if err != nil {
+		return fmt.Errorf("error marshalling heads to JSON: %v", err)
+	}
+
+	if err = transport.SendBytes(msg, stream); err != nil {
+		return fmt.Errorf("failed to send heads: %v", err)
+	}
+
+	//The peer must send each sender's txs in order from the head we sent
+	next := n.ledger.heads()
+
+	synced := 0
+	for {
+		stream.SetReadDeadline(time.Now().Add(syncBatchTimeout))
+
+		data, err := transport.ReceiveBytesMax(stream, maxSyncBatchBytes)
+		if err != nil {
+			return fmt.Errorf("failed to receive batch after %d txs: %v", synced, err)
+		}
+
+		if len(data) == 0 {
+			break
+		}
+
+		var batch []models.Tx
+		if err = json.Unmarshal(data, &batch); err != nil {
+			return n.reportPeer(p, fmt.Errorf("could not unmarshal batch: %v", err))
+		}
+
+		for i := range batch {
+			tx := &batch[i]
+			if tx.SequenceNum != next[tx.From] {
+				return n.reportPeer(p, fmt.Errorf("sent tx %d from %s when %d was next", tx.SequenceNum, tx.From, next[tx.From]))
+			}
+			next[tx.From]++
+
+			applied, err := n.applySynced(tx, p)
+			if err != nil {
+				return err
+			}
+
+			if applied {
+				synced++
+			}
+		}
+	}
+
+	log.Printf("Synced %d txs from %s", synced, p)
+	return nil
+}
+
+// applySynced commits a tx received during sync from p and returns whether
+// it was applied. Txs arrive in the order p committed them, so the quorum
+// is checked against the balances as of that point in its history. A tx
+// that isn't certified means p can't be trusted and it is reported.
+func (n *Node) applySynced(tx *models.Tx, p peer.ID) (bool, error) {
+	if n.ledger.hasCommitted(tx) {
+		return false, nil
+	}
+
+	if err := n.validateCertifiedTx(tx); err != nil {
+		return false, n.reportPeer(p, fmt.Errorf("sent tx %d from %s that is not certified: %v", tx.SequenceNum, tx.From, err))
+	}
+
+	err := n.ledger.commit(tx)
+	if err != nil {
+		var eqErr *equivocationError
+		if errors.As(err, &eqErr) {
+			n.handleEquivocation(&eqErr.proof)
+			if eqErr.reconciled {
+				return true, nil
+			}
+		}
+
+		return false, fmt.Errorf("could not commit synced tx %d from %s: %v", tx.SequenceNum, tx.From, err)
+	}
+
+	return true, nil
+}
+
+// reportPeer records that a peer sent us invalid data and returns the
+// reason as an error
+func (n *Node) reportPeer(p peer.ID, reason error) error {
+	log.Printf("Peer %s misbehaved during sync: %v", p, reason)
+	n.peerStats.reportMisbehaving(p, reason)
+
+	return fmt.Errorf("peer %s %v", p, reason)
+}
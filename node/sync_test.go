@@ -0,0 +1,320 @@
+package node
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"testing"
+	"time"
+
+	fcrypto "github.com/ackhia/flash/crypto"
+	"github.com/ackhia/flash/models"
+	"github.com/ackhia/flash/transport"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSync_OnlyMissingTxs(t *testing.T) {
+	server, client := createNetworkTwoPeers(t, 500, 1000)
+
+	from := client.Host.ID().String()
+	to := server.Host.ID().String()
+	for i := 0; i < 3; i++ {
+		_, err := client.Transfer(to, 10)
+		assert.NoError(t, err)
+	}
+
+	stream, err := client.Host.NewStream(context.Background(), server.Host.ID(), client.protocolID(syncProtocol))
+	assert.NoError(t, err)
+	defer stream.Close()
+
+	msg, err := json.Marshal(map[string]int{from: 2})
+	assert.NoError(t, err)
+	assert.NoError(t, transport.SendBytes(msg, stream))
+
+	data, err := transport.ReceiveBytes(stream)
+	assert.NoError(t, err)
+
+	var batch []models.Tx
+	assert.NoError(t, json.Unmarshal(data, &batch))
+	assert.Equal(t, 1, len(batch))
+	assert.Equal(t, 2, batch[0].SequenceNum)
+	assert.NotEmpty(t, batch[0].Verifiers)
+
+	data, err = transport.ReceiveBytes(stream)
+	assert.NoError(t, err)
+	assert.Empty(t, data)
+}
+
+func TestSync_Batches(t *testing.T) {
+	server, client := createNetworkTwoPeers(t, 500, 1000)
+
+	//Batching doesn't look at the txs so they needn't be signed
+	server.ledger.mu.Lock()
+	for i := 0; i < 2*syncBatchSize+50; i++ {
+		server.ledger.txs["Alice"] = append(server.ledger.txs["Alice"], models.Tx{SequenceNum: i, From: "Alice", Amount: 1, Comitted: true})
+	}
+	server.ledger.txs["Alice"][2*syncBatchSize+10].Comitted = false
+	server.ledger.mu.Unlock()
+
+	stream, err := client.Host.NewStream(context.Background(), server.Host.ID(), client.protocolID(syncProtocol))
+	assert.NoError(t, err)
+	defer stream.Close()
+
+	assert.NoError(t, transport.SendBytes([]byte("{}"), stream))
+
+	var sizes []int
+	for {
+		data, err := transport.ReceiveBytesMax(stream, maxSyncBatchBytes)
+		assert.NoError(t, err)
+		if err != nil || len(data) == 0 {
+			break
+		}
+
+		var batch []models.Tx
+		assert.NoError(t, json.Unmarshal(data, &batch))
+		sizes = append(sizes, len(batch))
+	}
+
+	//Txs after the first uncommitted one aren't sent
+	assert.Equal(t, []int{syncBatchSize, syncBatchSize, 10}, sizes)
+}
+
+func TestSync_FallsBackFromInvalidPeer(t *testing.T) {
+	mn := mocknet.New()
+
+	var hosts []host.Host
+	for i := 0; i < 4; i++ {
+		h, err := mn.GenPeer()
+		assert.NoError(t, err)
+		hosts = append(hosts, h)
+	}
+	assert.NoError(t, mn.LinkAll())
+
+	genesis := map[string]models.Amount{
+		hosts[0].ID().String(): 1000,
+		hosts[1].ID().String(): 2000,
+		hosts[2].ID().String(): 100,
+		hosts[3].ID().String(): 10,
+	}
+
+	honest2 := New(hosts[1].Peerstore().PrivKey(hosts[1].ID()), &hosts[1], genesis, []string{}, "")
+	honest2.Start()
+	honest1 := New(hosts[0].Peerstore().PrivKey(hosts[0].ID()), &hosts[0], genesis, []string{createMultiaddress(t, honest2)}, "")
+	honest1.Start()
+
+	from := honest1.Host.ID().String()
+	_, err := honest1.Transfer(honest2.Host.ID().String(), 25)
+	assert.NoError(t, err)
+
+	liar := New(hosts[2].Peerstore().PrivKey(hosts[2].ID()), &hosts[2], genesis, []string{}, "")
+	liar.Start()
+
+	//The liar serves a tx moving honest1's coins to itself, signed and
+	//verified only by itself
+	pubKeyBytes, err := crypto.MarshalPublicKey(liar.privKey.GetPublic())
+	assert.NoError(t, err)
+
+	forged := models.Tx{Network: liar.NetworkID(), From: from, To: liar.Host.ID().String(), Amount: 900, Pubkey: pubKeyBytes}
+	assert.NoError(t, fcrypto.SignTx(&forged, liar.privKey))
+	verifier, err := fcrypto.CreateVerifier(&forged, liar.privKey)
+	assert.NoError(t, err)
+	forged.Verifiers = []models.Verifier{*verifier}
+
+	liar.Host.SetStreamHandler(liar.protocolID(syncProtocol), func(s network.Stream) {
+		defer s.Close()
+
+		transport.ReceiveBytes(s)
+		msg, _ := json.Marshal([]models.Tx{forged})
+		transport.SendBytes(msg, s)
+		transport.SendBytes(nil, s)
+	})
+
+	newcomer := New(hosts[3].Peerstore().PrivKey(hosts[3].ID()), &hosts[3], genesis, []string{createMultiaddress(t, liar), createMultiaddress(t, honest2)}, "")
+	newcomer.Start()
+
+	assert.Contains(t, newcomer.MisbehavingPeers(), liar.Host.ID())
+	assert.NotContains(t, newcomer.MisbehavingPeers(), honest2.Host.ID())
+
+	//The history comes from honest2 instead
+	assert.Equal(t, 1, len(newcomer.Txs()[from]))
+	assert.True(t, newcomer.Txs()[from][0].Comitted)
+	assert.Equal(t, models.Amount(975), newcomer.Balance(from))
+	assert.Equal(t, models.Amount(100), newcomer.Balance(liar.Host.ID().String()))
+}
+
+func TestSync_RejectsSequenceGap(t *testing.T) {
+	server, client := createNetworkTwoPeers(t, 500, 1000)
+
+	//A tx that skips sequence number zero is rejected before its sig is
+	//even checked
+	server.Host.SetStreamHandler(server.protocolID(syncProtocol), func(s network.Stream) {
+		defer s.Close()
+
+		transport.ReceiveBytes(s)
+		msg, _ := json.Marshal([]models.Tx{{SequenceNum: 1, From: "Alice", Amount: 1}})
+		transport.SendBytes(msg, s)
+		transport.SendBytes(nil, s)
+	})
+
+	err := client.syncFrom(server.Host.ID())
+	assert.ErrorContains(t, err, "when 0 was next")
+	assert.Contains(t, client.MisbehavingPeers(), server.Host.ID())
+	assert.Empty(t, client.Txs()["Alice"])
+}
+
+func TestSync_FundedByLaterAccount(t *testing.T) {
+	mn := mocknet.New()
+
+	var hosts []host.Host
+	for i := 0; i < 4; i++ {
+		h, err := mn.GenPeer()
+		assert.NoError(t, err)
+		hosts = append(hosts, h)
+	}
+	assert.NoError(t, mn.LinkAll())
+
+	//funder's account sorts after funded's
+	funded, funder := hosts[1], hosts[2]
+	if funded.ID().String() > funder.ID().String() {
+		funded, funder = funder, funded
+	}
+
+	genesis := map[string]models.Amount{
+		hosts[0].ID().String(): 3000,
+		funded.ID().String():   1000,
+		funder.ID().String():   1000,
+	}
+
+	var nodes []*Node
+	var addrs []string
+	for _, h := range []host.Host{hosts[0], funded, funder} {
+		n := New(h.Peerstore().PrivKey(h.ID()), &h, genesis, addrs, "")
+		n.Start()
+		nodes = append(nodes, n)
+		addrs = append(addrs, createMultiaddress(t, n))
+	}
+	server, fundedNode, funderNode := nodes[0], nodes[1], nodes[2]
+
+	//funded can only send 1500 once funder's commit has landed
+	_, err := funderNode.Transfer(funded.ID().String(), 600)
+	assert.NoError(t, err)
+	_, err = fundedNode.Transfer(server.Host.ID().String(), 1500)
+	assert.NoError(t, err)
+
+	newcomer := New(hosts[3].Peerstore().PrivKey(hosts[3].ID()), &hosts[3], genesis, []string{addrs[0]}, "")
+	assert.NoError(t, newcomer.Start())
+
+	assert.Equal(t, models.Amount(100), newcomer.Balance(funded.ID().String()))
+	assert.Equal(t, models.Amount(400), newcomer.Balance(funder.ID().String()))
+	assert.Equal(t, models.Amount(4500), newcomer.Balance(server.Host.ID().String()))
+	assert.Equal(t, server.StateRoot(), newcomer.StateRoot())
+	assert.Empty(t, newcomer.MissingTxs())
+	assert.Empty(t, newcomer.MisbehavingPeers())
+}
+
+func TestLedger_SyncOrderPersisted(t *testing.T) {
+	dataDir := t.TempDir()
+	genesis := map[string]models.Amount{"Amy": 100, "Zed": 100}
+	l := newLedger(genesis)
+	assert.NoError(t, l.open(dataDir))
+
+	assert.NoError(t, l.commit(&models.Tx{SequenceNum: 0, From: "Zed", To: "Amy", Amount: 50, Sig: []byte("zed")}))
+	assert.NoError(t, l.commit(&models.Tx{SequenceNum: 0, From: "Amy", To: "Zed", Amount: 150, Sig: []byte("amy")}))
+	want := []txRef{{from: "Zed", seq: 0}, {from: "Amy", seq: 0}}
+	assert.Equal(t, want, l.syncRefs(map[string]int{}))
+	assert.Equal(t, []txRef{{from: "Amy", seq: 0}}, l.syncRefs(map[string]int{"Zed": 1}))
+	assert.NoError(t, l.close())
+
+	//The log keeps the commit order and so does the snapshot replacing it
+	for i := 0; i < 2; i++ {
+		restarted := newLedger(genesis)
+		assert.NoError(t, restarted.open(dataDir))
+		assert.Equal(t, want, restarted.syncRefs(map[string]int{}))
+
+		restarted.mu.Lock()
+		restarted.writeSnapshot()
+		restarted.mu.Unlock()
+		assert.NoError(t, restarted.close())
+	}
+}
+
+func TestSync_QuorumAsOfHistory(t *testing.T) {
+	mn := mocknet.New()
+
+	var hosts []host.Host
+	for i := 0; i < 5; i++ {
+		h, err := mn.GenPeer()
+		assert.NoError(t, err)
+		hosts = append(hosts, h)
+	}
+	assert.NoError(t, mn.LinkAll())
+
+	//The verifier's account sorts before the sender's
+	peers := hosts[:4]
+	sort.Slice(peers, func(i, j int) bool { return peers[i].ID().String() < peers[j].ID().String() })
+	verifier, other, receiver, sender := peers[0], peers[1], peers[2], peers[3]
+
+	genesis := map[string]models.Amount{
+		verifier.ID().String(): 2000,
+		other.ID().String():    2000,
+		receiver.ID().String(): 1500,
+		sender.ID().String():   500,
+	}
+
+	var nodes []*Node
+	var addrs []string
+	for _, h := range []host.Host{verifier, other, receiver, sender} {
+		n := New(h.Peerstore().PrivKey(h.ID()), &h, genesis, addrs, "")
+		n.Start()
+		nodes = append(nodes, n)
+		addrs = append(addrs, createMultiaddress(t, n))
+	}
+	verifierNode, receiverNode, senderNode := nodes[0], nodes[2], nodes[3]
+
+	//Only the verifier and other sign the sender's tx
+	pubKeyBytes, err := crypto.MarshalPublicKey(senderNode.privKey.GetPublic())
+	assert.NoError(t, err)
+	tx, err := senderNode.BuildTx(sender.ID().String(), receiver.ID().String(), 100, pubKeyBytes)
+	assert.NoError(t, err)
+	assert.NoError(t, fcrypto.SignTx(tx, senderNode.privKey))
+	assert.NoError(t, senderNode.getNodeVerification(tx, verifier.ID()))
+	assert.NoError(t, senderNode.getNodeVerification(tx, other.ID()))
+	assert.NoError(t, senderNode.ledger.addPending(*tx))
+	_, err = senderNode.CommitTx(tx)
+	assert.NoError(t, err)
+
+	//Their weight then drops below a quorum
+	_, err = verifierNode.Transfer(receiver.ID().String(), 1500)
+	assert.NoError(t, err)
+	assert.Eventually(t, func() bool { return len(receiverNode.Txs()) == 2 }, 5*time.Second, 10*time.Millisecond)
+	assert.Error(t, receiverNode.validateCertifiedTx(&receiverNode.Txs()[sender.ID().String()][0]))
+
+	newcomer := New(hosts[4].Peerstore().PrivKey(hosts[4].ID()), &hosts[4], genesis, []string{createMultiaddress(t, receiverNode)}, "")
+	assert.NoError(t, newcomer.Start())
+
+	assert.Empty(t, newcomer.MisbehavingPeers())
+	assert.Equal(t, models.Amount(400), newcomer.Balance(sender.ID().String()))
+	assert.Equal(t, models.Amount(500), newcomer.Balance(verifier.ID().String()))
+	assert.Equal(t, receiverNode.StateRoot(), newcomer.StateRoot())
+}
+
+func TestSync_UncommittableTxEndsSync(t *testing.T) {
+	node1, node2, _ := createNetworkThreePeers(t, 1000, 2000, 500)
+
+	from := node1.Host.ID().String()
+
+	//node2 signed the tx, then dropped it, so it won't commit it
+	tx := verifyWith(t, node1, node2, node2.Host.ID().String(), 10)
+	assert.NotEmpty(t, node2.ledger.expirePending(time.Now().Add(time.Hour)))
+	_, err := node1.CommitTx(tx)
+	assert.NoError(t, err)
+	assert.Empty(t, node2.Txs()[from])
+
+	//The sync fails but node1 did nothing wrong
+	assert.ErrorContains(t, node2.syncFrom(node1.Host.ID()), "could not commit synced tx")
+	assert.NotContains(t, node2.MisbehavingPeers(), node1.Host.ID())
+}
@@ -0,0 +1,147 @@
+package node
+
+import (
+	"sync"
+	"time"
+
+	"github.com/ackhia/flash/models"
+)
+
+// Number of txs we sent whose status is kept
+const maxTrackedTxs = 1000
+
+// txTracker follows the txs we send through their lifecycle. The oldest are
+// forgotten once there are more than maxTrackedTxs.
+type txTracker struct {
+	mu       sync.Mutex
+	statuses map[models.TxID]*models.TxStatus
+	// order holds the tracked IDs oldest first
+	order []models.TxID
+}
+
+func newTxTracker() *txTracker {
+	return &txTracker{statuses: make(map[models.TxID]*models.TxStatus)}
+}
+
+// start tracks a tx we built at built and have just signed. A tx is tracked
+// by its ID, which covers the sig, so it can't be tracked before this.
+func (t *txTracker) start(tx *models.Tx, built time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	id := tx.ID()
+	if _, ok := t.statuses[id]; ok {
+		return
+	}
+
+	t.statuses[id] = &models.TxStatus{
+		Tx:    *tx,
+		State: models.TxSigned,
+		History: []models.TxStateChange{
+			{State: models.TxBuilt, Time: built},
+			{State: models.TxSigned, Time: time.Now()},
+		},
+	}
+	t.order = append(t.order, id)
+
+	if len(t.order) > maxTrackedTxs {
+		delete(t.statuses, t.order[0])
+		t.order = t.order[1:]
+	}
+}
+
+// update moves a tracked tx to a new state and keeps the latest copy of it,
+// which gains verifiers along the way. A tx in a final state stays there.
+func (t *txTracker) update(tx *models.Tx, state models.TxState, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	s, ok := t.statuses[tx.ID()]
+	if !ok || s.State.Final() {
+		return
+	}
+
+	s.Tx = *tx
+	t.transition(s, state, err)
+}
+
+// drop moves tracked txs that were dropped before they committed to a
+// final state
+func (t *txTracker) drop(ids []models.TxID, state models.TxState, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, id := range ids {
+		if s, ok := t.statuses[id]; ok && !s.State.Final() {
+			t.transition(s, state, err)
+		}
+	}
+}
+
+// transition records a state change. The caller must hold the lock.
+func (t *txTracker) transition(s *models.TxStatus, state models.TxState, err error) {
+	s.State = state
+	if err != nil {
+		s.Error = err.Error()
+	}
+	s.History = append(s.History, models.TxStateChange{State: state, Time: time.Now()})
+}
+
+func (t *txTracker) get(id models.TxID) (*models.TxStatus, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	s, ok := t.statuses[id]
+	if !ok {
+		return nil, false
+	}
+
+	return copyStatus(s), true
+}
+
+// all returns the status of every tracked tx, oldest first
+func (t *txTracker) all() []models.TxStatus {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	statuses := make([]models.TxStatus, 0, len(t.order))
+	for _, id := range t.order {
+		statuses = append(statuses, *copyStatus(t.statuses[id]))
+	}
+
+	return statuses
+}
+
+func copyStatus(s *models.TxStatus) *models.TxStatus {
+	c := *s
+	c.Tx.Verifiers = append([]models.Verifier(nil), s.Tx.Verifiers...)
+	c.History = append([]models.TxStateChange(nil), s.History...)
+
+	return &c
+}
+
+// TxStatus returns where a tx is in its lifecycle. Txs we sent are tracked
+// through every state. Any other tx we hold is reported as verifying until
+// it commits.
+func (n *Node) TxStatus(id models.TxID) (*models.TxStatus, bool) {
+	if s, ok := n.txStatus.get(id); ok {
+		return s, true
+	}
+
+	tx, ok := n.ledger.TxByID(id)
+	if !ok {
+		return nil, false
+	}
+
+	s := models.TxStatus{Tx: tx, State: models.TxVerifying}
+	if tx.Comitted {
+		s.State = models.TxCommitted
+	}
+
+	return &s, true
+}
+
+// TxStatuses returns the status of the txs we sent, oldest first
+func (n *Node) TxStatuses() []models.TxStatus {
+	return n.txStatus.all()
+}
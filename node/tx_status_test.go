@@ -0,0 +1,101 @@
+package node
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/ackhia/flash/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func states(s *models.TxStatus) []models.TxState {
+	var states []models.TxState
+	for _, c := range s.History {
+		states = append(states, c.State)
+	}
+
+	return states
+}
+
+func TestTxStatus_Transfer(t *testing.T) {
+	node1, node2, _ := createNetworkThreePeers(t, 1000, 1000, 1000)
+
+	coverage, err := node1.Transfer(node2.Host.ID().String(), 25)
+	assert.NoError(t, err)
+
+	s, ok := node1.TxStatus(coverage.Tx)
+	assert.True(t, ok)
+	assert.Equal(t, models.TxCommitted, s.State)
+	assert.Equal(t, []models.TxState{
+		models.TxBuilt,
+		models.TxSigned,
+		models.TxVerifying,
+		models.TxQuorumReached,
+		models.TxCommitting,
+		models.TxCommitted,
+	}, states(s))
+	assert.NotEmpty(t, s.Tx.Verifiers)
+
+	//Peers report the txs they hold from their ledger
+	s, ok = node2.TxStatus(coverage.Tx)
+	assert.True(t, ok)
+	assert.Equal(t, models.TxCommitted, s.State)
+
+	_, ok = node2.TxStatus(models.TxID{})
+	assert.False(t, ok)
+}
+
+func TestTxStatus_Failed(t *testing.T) {
+	server, client := createNetworkTwoPeers(t, 1500, 1000)
+
+	_, err := client.Transfer(server.Host.ID().String(), 2000)
+	assert.Error(t, err)
+
+	statuses := client.TxStatuses()
+	assert.Len(t, statuses, 1)
+	assert.Equal(t, models.TxFailed, statuses[0].State)
+	assert.NotEmpty(t, statuses[0].Error)
+
+	//The server refused it so the client cancelled
+	_, ok := server.TxStatus(statuses[0].Tx.ID())
+	assert.False(t, ok)
+}
+
+func TestTxStatus_Unfinished(t *testing.T) {
+	server, client := createNetworkTwoPeers(t, 1500, 1000)
+
+	_, err := client.Transfer(server.Host.ID().String(), 600)
+	assert.Error(t, err)
+
+	//The server signed it so it is still being verified
+	statuses := client.TxStatuses()
+	assert.Len(t, statuses, 1)
+	assert.Equal(t, models.TxVerifying, statuses[0].State)
+	assert.NotEmpty(t, statuses[0].Error)
+}
+
+func TestTxTracker(t *testing.T) {
+	tracker := newTxTracker()
+
+	tx := models.Tx{From: "Alice", To: "Bob", Amount: 10, Sig: []byte("sig")}
+	tracker.start(&tx, time.Now())
+	tracker.update(&tx, models.TxVerifying, nil)
+	tracker.drop([]models.TxID{tx.ID()}, models.TxExpired, nil)
+
+	//Final states stick
+	tracker.update(&tx, models.TxCommitted, nil)
+	s, ok := tracker.get(tx.ID())
+	assert.True(t, ok)
+	assert.Equal(t, models.TxExpired, s.State)
+	assert.Equal(t, []models.TxState{models.TxBuilt, models.TxSigned, models.TxVerifying, models.TxExpired}, states(s))
+
+	//The oldest are forgotten
+	for i := 0; i < maxTrackedTxs; i++ {
+		other := models.Tx{From: "Alice", To: "Bob", Amount: 10, Sig: []byte(fmt.Sprintf("sig%d", i))}
+		tracker.start(&other, time.Now())
+	}
+	_, ok = tracker.get(tx.ID())
+	assert.False(t, ok)
+	assert.Len(t, tracker.all(), maxTrackedTxs)
+}
@@ -2,22 +2,78 @@ package node
 
 import (
 	"fmt"
+	"log"
+	"time"
 
+	fcrypto "github.com/ackhia/flash/crypto"
 	"github.com/ackhia/flash/models"
 )
 
-func (n Node) isVerifierConsensus(tx *models.Tx) (bool, error) {
+// How long an equivocating account stays frozen unless it is unfrozen first
+const freezeTimeout = 24 * time.Hour
 
-	var verifierTotalBalance float64
-	for _, v := range tx.Verifiers {
-		b, ok := n.Balances[v.ID]
-		if ok {
-			verifierTotalBalance += b
+func (n *Node) isVerifierConsensus(tx *models.Tx) (bool, error) {
+
+	err := fcrypto.VerifyQuorumCertificate(tx, n.ledger.Balances())
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// validateCertifiedTx checks everything needed to commit a tx without
+// having verified it: the network, the sender's sig and the quorum of
+// verifier sigs
+func (n *Node) validateCertifiedTx(tx *models.Tx) error {
+	if tx.Network != n.networkID {
+		return fmt.Errorf("tx is for network %s", tx.Network)
+	}
+
+	result, err := fcrypto.VerifyTxSig(*tx)
+	if err != nil {
+		return fmt.Errorf("could not verify tx sig: %v", err)
+	}
+
+	if !result {
+		return fmt.Errorf("tx has invalid sig")
+	}
+
+	_, err = n.isVerifierConsensus(tx)
+	if err != nil {
+		return fmt.Errorf("consensus could not be reached: %v", err)
+	}
+
+	return nil
+}
+
+// handleEquivocation freezes the sender of a valid equivocation proof, and
+// any verifiers that signed both txs, and passes the proof on to our peers
+// the first time it is seen
+func (n *Node) handleEquivocation(proof *models.EquivocationProof) {
+	if proof.First.Network != n.networkID || proof.Second.Network != n.networkID {
+		log.Print("Equivocation proof is for another network")
+		return
+	}
+
+	if err := fcrypto.VerifyEquivocationProof(proof); err != nil {
+		log.Printf("Invalid equivocation proof %v", err)
+		return
+	}
+
+	until := time.Now().Add(freezeTimeout)
+	frozen := n.ledger.freeze(proof.First.From, until)
+	for _, id := range fcrypto.DoubleSigners(proof) {
+		if n.ledger.freeze(id, until) {
+			log.Printf("Verifier %s signed both txs from %s for sequence number %d, freezing it", id, proof.First.From, proof.First.SequenceNum)
+			frozen = true
 		}
 	}
 
-	if verifierTotalBalance <= n.TotalCoins/2 {
-		return false, fmt.Errorf("verifier total balances was less thsn 50%% of available coins")
+	if !frozen {
+		return
 	}
-	return true, nil
+
+	log.Printf("Account %s equivocated at sequence number %d, freezing it", proof.First.From, proof.First.SequenceNum)
+	n.events.publish(Event{Type: EventEquivocation, Account: proof.First.From, Proof: proof})
+	go n.broadcastEquivocation(proof)
 }
@@ -0,0 +1,349 @@
+package store
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/ackhia/flash/models"
+)
+
+const logFilename = "ledger.log"
+const snapshotFilename = "snapshot.json"
+const commitQueueFilename = "commit_queue.json"
+
+// Each log record is framed as a little endian uint32 payload length,
+// a uint32 CRC32 of the payload and the JSON encoded payload.
+const recordHeaderLen = 8
+
+// Largest record payload. A longer length in a header can only come from a
+// corrupt or torn tail so it is rejected before anything is allocated.
+const maxRecordLen = 4 << 20
+
+type RecordType string
+
+const (
+	// RecordAdd is written when a tx is added to the ledger uncommitted
+	RecordAdd RecordType = "add"
+	// RecordCommit is written when a tx is committed with its verifiers
+	RecordCommit RecordType = "commit"
+	// RecordDrop is written when a tx loses a conflict and is removed
+	RecordDrop RecordType = "drop"
+	// RecordSigned is written when the node signs a tx as a verifier
+	RecordSigned RecordType = "signed"
+	// RecordVote is written when the node signs a checkpoint. It holds the
+	// checkpoint instead of a tx.
+	RecordVote RecordType = "vote"
+)
+
+type Record struct {
+	Type RecordType `json:"type"`
+	Tx   models.Tx  `json:"tx"`
+	// Received is when the node first got the tx. It is zero in records
+	// written before it was added.
+	Received   time.Time          `json:"received"`
+	Checkpoint *models.Checkpoint `json:"checkpoint,omitempty"`
+}
+
+// Snapshot is the full ledger state at the time it was taken. The log only
+// holds the records written after the latest snapshot.
+type Snapshot struct {
+	Records  []Record                 `json:"records"`
+	Balances map[string]models.Amount `json:"balances"`
+	// Checkpoints holds the certified checkpoints the ledger has applied.
+	// Records only covers the txs after the latest one.
+	Checkpoints []models.Checkpoint `json:"checkpoints,omitempty"`
+	// Signed holds the txs the node signed as a verifier that no checkpoint
+	// covers yet
+	Signed []Signed `json:"signed,omitempty"`
+	// Votes holds the checkpoints the node signed that aren't applied yet
+	Votes []models.Checkpoint `json:"votes,omitempty"`
+}
+
+// Signed is the tx a node signed for a sender and sequence number
+type Signed struct {
+	From        string      `json:"from"`
+	SequenceNum int         `json:"sequenceNum"`
+	ID          models.TxID `json:"id"`
+}
+
+// QueuedCommit is a commit we are still delivering to peers and the peers
+// that have acked it
+type QueuedCommit struct {
+	Tx     models.Tx `json:"tx"`
+	Acked  []string  `json:"acked"`
+	Queued time.Time `json:"queued"`
+}
+
+type Store struct {
+	mu  sync.Mutex
+	dir string
+	log *os.File
+}
+
+func Open(dir string) (*Store, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create data dir: %w", err)
+	}
+
+	f, err := os.OpenFile(filepath.Join(dir, logFilename), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open log: %w", err)
+	}
+
+	if err = syncDir(dir); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return &Store{dir: dir, log: f}, nil
+}
+
+// Load returns the latest snapshot (nil if none was written) and the log
+// records written after it. A torn record at the end of the log, left by a
+// crash part way through Append, is truncated away.
+func (s *Store) Load() (*Snapshot, []Record, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	snap, err := s.readSnapshot()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if _, err = s.log.Seek(0, io.SeekStart); err != nil {
+		return nil, nil, err
+	}
+
+	var records []Record
+	var offset int64
+	for {
+		r, n, err := readRecord(s.log)
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			log.Printf("Truncating torn ledger log at offset %d: %v", offset, err)
+			if err = s.log.Truncate(offset); err != nil {
+				return nil, nil, fmt.Errorf("failed to truncate log: %w", err)
+			}
+			if err = s.log.Sync(); err != nil {
+				return nil, nil, err
+			}
+			break
+		}
+
+		records = append(records, r)
+		offset += n
+	}
+
+	if _, err = s.log.Seek(offset, io.SeekStart); err != nil {
+		return nil, nil, err
+	}
+
+	return snap, records, nil
+}
+
+// Append writes a record to the log and only returns once it is on disk
+func (s *Store) Append(r Record) error {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return fmt.Errorf("failed to marshal record: %w", err)
+	}
+
+	if len(data) > maxRecordLen {
+		return fmt.Errorf("record is %d bytes, more than the %d allowed", len(data), maxRecordLen)
+	}
+
+	buf := make([]byte, recordHeaderLen+len(data))
+	binary.LittleEndian.PutUint32(buf[0:4], uint32(len(data)))
+	binary.LittleEndian.PutUint32(buf[4:8], crc32.ChecksumIEEE(data))
+	copy(buf[recordHeaderLen:], data)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err = s.log.Write(buf); err != nil {
+		return fmt.Errorf("failed to write record: %w", err)
+	}
+
+	return s.log.Sync()
+}
+
+// WriteSnapshot atomically replaces the snapshot and then empties the log.
+// If a crash happens between the two the log records are replayed on top of
+// the snapshot again, so replaying records must be idempotent.
+func (s *Store) WriteSnapshot(snap *Snapshot) error {
+	data, err := json.Marshal(snap)
+	if err != nil {
+		return fmt.Errorf("failed to marshal snapshot: %w", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err = writeFileAtomic(s.dir, snapshotFilename, data); err != nil {
+		return fmt.Errorf("failed to write snapshot: %w", err)
+	}
+
+	if err = s.log.Truncate(0); err != nil {
+		return fmt.Errorf("failed to truncate log: %w", err)
+	}
+
+	if _, err = s.log.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	return s.log.Sync()
+}
+
+// WriteCommitQueue replaces the stored commit queue
+func (s *Store) WriteCommitQueue(queue []QueuedCommit) error {
+	data, err := json.Marshal(queue)
+	if err != nil {
+		return fmt.Errorf("failed to marshal commit queue: %w", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err = writeFileAtomic(s.dir, commitQueueFilename, data); err != nil {
+		return fmt.Errorf("failed to write commit queue: %w", err)
+	}
+
+	return nil
+}
+
+// LoadCommitQueue returns the stored commit queue, which is empty if none
+// was written
+func (s *Store) LoadCommitQueue() ([]QueuedCommit, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	data, err := os.ReadFile(filepath.Join(s.dir, commitQueueFilename))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read commit queue: %w", err)
+	}
+
+	var queue []QueuedCommit
+	if err = json.Unmarshal(data, &queue); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal commit queue: %w", err)
+	}
+
+	return queue, nil
+}
+
+func (s *Store) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.log.Close()
+}
+
+func (s *Store) readSnapshot() (*Snapshot, error) {
+	data, err := os.ReadFile(filepath.Join(s.dir, snapshotFilename))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to read snapshot: %w", err)
+	}
+
+	var snap Snapshot
+	if err = json.Unmarshal(data, &snap); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal snapshot: %w", err)
+	}
+
+	return &snap, nil
+}
+
+func readRecord(r io.Reader) (Record, int64, error) {
+	var header [recordHeaderLen]byte
+	n, err := io.ReadFull(r, header[:])
+	if err == io.EOF {
+		return Record{}, 0, io.EOF
+	}
+
+	if err != nil {
+		return Record{}, 0, fmt.Errorf("short header (%d bytes)", n)
+	}
+
+	length := binary.LittleEndian.Uint32(header[0:4])
+	checksum := binary.LittleEndian.Uint32(header[4:8])
+	if length > maxRecordLen {
+		return Record{}, 0, fmt.Errorf("record length %d is too long", length)
+	}
+
+	data := make([]byte, length)
+	if _, err = io.ReadFull(r, data); err != nil {
+		return Record{}, 0, fmt.Errorf("short record: %v", err)
+	}
+
+	if crc32.ChecksumIEEE(data) != checksum {
+		return Record{}, 0, errors.New("checksum mismatch")
+	}
+
+	var rec Record
+	if err = json.Unmarshal(data, &rec); err != nil {
+		return Record{}, 0, fmt.Errorf("invalid record: %v", err)
+	}
+
+	return rec, int64(recordHeaderLen + len(data)), nil
+}
+
+// writeFileAtomic replaces a file in dir so a crash leaves either the old
+// or the new contents
+func writeFileAtomic(dir string, name string, data []byte) error {
+	tmpFilename := filepath.Join(dir, name+".tmp")
+	tmp, err := os.OpenFile(tmpFilename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err = tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+
+	if err = os.Rename(tmpFilename, filepath.Join(dir, name)); err != nil {
+		return err
+	}
+
+	return syncDir(dir)
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("failed to open data dir: %w", err)
+	}
+	defer d.Close()
+
+	if err = d.Sync(); err != nil {
+		return fmt.Errorf("failed to sync data dir: %w", err)
+	}
+
+	return nil
+}
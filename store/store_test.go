@@ -0,0 +1,173 @@
+package store
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ackhia/flash/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAppendLoad(t *testing.T) {
+	dir := t.TempDir()
+
+	s, err := Open(dir)
+	assert.NoError(t, err)
+
+	tx := models.Tx{SequenceNum: 0, From: "Alice", To: "Bob", Amount: 30, Sig: []byte("sig1")}
+	assert.NoError(t, s.Append(Record{Type: RecordAdd, Tx: tx}))
+	assert.NoError(t, s.Append(Record{Type: RecordCommit, Tx: tx}))
+	assert.NoError(t, s.Close())
+
+	s, err = Open(dir)
+	assert.NoError(t, err)
+	defer s.Close()
+
+	snap, records, err := s.Load()
+	assert.NoError(t, err)
+	assert.Nil(t, snap)
+	assert.Equal(t, 2, len(records))
+	assert.Equal(t, RecordAdd, records[0].Type)
+	assert.Equal(t, RecordCommit, records[1].Type)
+	assert.Equal(t, tx.Sig, records[1].Tx.Sig)
+}
+
+func TestLoad_TornTail(t *testing.T) {
+	dir := t.TempDir()
+
+	s, err := Open(dir)
+	assert.NoError(t, err)
+
+	tx := models.Tx{SequenceNum: 0, From: "Alice", To: "Bob", Amount: 30, Sig: []byte("sig1")}
+	assert.NoError(t, s.Append(Record{Type: RecordAdd, Tx: tx}))
+	assert.NoError(t, s.Close())
+
+	//Simulate a crash part way through writing the second record
+	logFile := filepath.Join(dir, logFilename)
+	f, err := os.OpenFile(logFile, os.O_APPEND|os.O_WRONLY, 0600)
+	assert.NoError(t, err)
+	_, err = f.Write([]byte{0xff, 0x00, 0x00, 0x00, 0x01})
+	assert.NoError(t, err)
+	f.Close()
+
+	s, err = Open(dir)
+	assert.NoError(t, err)
+
+	_, records, err := s.Load()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(records))
+
+	//New records must follow the last good record
+	assert.NoError(t, s.Append(Record{Type: RecordCommit, Tx: tx}))
+	assert.NoError(t, s.Close())
+
+	s, err = Open(dir)
+	assert.NoError(t, err)
+	defer s.Close()
+
+	_, records, err = s.Load()
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(records))
+}
+
+func TestLoad_CorruptLength(t *testing.T) {
+	dir := t.TempDir()
+
+	s, err := Open(dir)
+	assert.NoError(t, err)
+
+	tx := models.Tx{SequenceNum: 0, From: "Alice", To: "Bob", Amount: 30, Sig: []byte("sig1")}
+	assert.NoError(t, s.Append(Record{Type: RecordAdd, Tx: tx}))
+	assert.NoError(t, s.Close())
+
+	logFile := filepath.Join(dir, logFilename)
+	good, err := os.Stat(logFile)
+	assert.NoError(t, err)
+
+	//A header claiming a 4 GiB payload is treated as a torn tail rather than
+	//read into memory
+	f, err := os.OpenFile(logFile, os.O_APPEND|os.O_WRONLY, 0600)
+	assert.NoError(t, err)
+	_, err = f.Write([]byte{0xff, 0xff, 0xff, 0xff, 0x00, 0x00, 0x00, 0x00, 0x01})
+	assert.NoError(t, err)
+	f.Close()
+
+	s, err = Open(dir)
+	assert.NoError(t, err)
+	defer s.Close()
+
+	_, records, err := s.Load()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(records))
+
+	info, err := os.Stat(logFile)
+	assert.NoError(t, err)
+	assert.Equal(t, good.Size(), info.Size())
+}
+
+func TestWriteSnapshot(t *testing.T) {
+	dir := t.TempDir()
+
+	s, err := Open(dir)
+	assert.NoError(t, err)
+
+	tx := models.Tx{SequenceNum: 0, From: "Alice", To: "Bob", Amount: 30, Sig: []byte("sig1")}
+	assert.NoError(t, s.Append(Record{Type: RecordCommit, Tx: tx}))
+
+	snap := Snapshot{
+		Records:  []Record{{Type: RecordCommit, Tx: tx}},
+		Balances: map[string]models.Amount{"Alice": 70, "Bob": 30},
+	}
+	assert.NoError(t, s.WriteSnapshot(&snap))
+
+	tx2 := models.Tx{SequenceNum: 1, From: "Alice", To: "Bob", Amount: 5, Sig: []byte("sig2")}
+	assert.NoError(t, s.Append(Record{Type: RecordAdd, Tx: tx2}))
+	assert.NoError(t, s.Close())
+
+	s, err = Open(dir)
+	assert.NoError(t, err)
+	defer s.Close()
+
+	loaded, records, err := s.Load()
+	assert.NoError(t, err)
+	assert.NotNil(t, loaded)
+	assert.Equal(t, 1, len(loaded.Records))
+	assert.Equal(t, models.Amount(70), loaded.Balances["Alice"])
+	assert.Equal(t, 1, len(records))
+	assert.Equal(t, tx2.Sig, records[0].Tx.Sig)
+}
+
+func TestCommitQueue(t *testing.T) {
+	dir := t.TempDir()
+
+	s, err := Open(dir)
+	assert.NoError(t, err)
+
+	queue, err := s.LoadCommitQueue()
+	assert.NoError(t, err)
+	assert.Empty(t, queue)
+
+	tx := models.Tx{SequenceNum: 0, From: "Alice", To: "Bob", Amount: 30, Sig: []byte("sig1")}
+	queued := time.Now().UTC().Truncate(time.Second)
+	assert.NoError(t, s.WriteCommitQueue([]QueuedCommit{{Tx: tx, Acked: []string{"Bob"}, Queued: queued}}))
+	assert.NoError(t, s.Close())
+
+	s, err = Open(dir)
+	assert.NoError(t, err)
+	defer s.Close()
+
+	queue, err = s.LoadCommitQueue()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(queue))
+	assert.Equal(t, tx.Sig, queue[0].Tx.Sig)
+	assert.Equal(t, []string{"Bob"}, queue[0].Acked)
+	assert.True(t, queued.Equal(queue[0].Queued))
+
+	//A snapshot leaves the queue alone
+	assert.NoError(t, s.WriteSnapshot(&Snapshot{}))
+	queue, err = s.LoadCommitQueue()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(queue))
+}
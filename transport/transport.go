@@ -3,7 +3,9 @@ package transport
 import (
 	"bufio"
 	"encoding/binary"
+	"fmt"
 	"io"
+	"math"
 
 	"github.com/libp2p/go-libp2p/core/network"
 )
@@ -22,6 +24,12 @@ func SendBytes(payload []byte, s network.Stream) error {
 }
 
 func ReceiveBytes(s network.Stream) ([]byte, error) {
+	return ReceiveBytesMax(s, math.MaxInt64)
+}
+
+// ReceiveBytesMax is ReceiveBytes but fails without allocating if the
+// payload is larger than max bytes
+func ReceiveBytesMax(s network.Stream, max int64) ([]byte, error) {
 	buf := bufio.NewReader(s)
 
 	var len int64
@@ -31,6 +39,10 @@ func ReceiveBytes(s network.Stream) ([]byte, error) {
 		return nil, err
 	}
 
+	if len < 0 || len > max {
+		return nil, fmt.Errorf("payload of %d bytes is over the %d byte limit", len, max)
+	}
+
 	payload := make([]byte, len)
 	_, err = io.ReadFull(buf, payload)
 	if err != nil {
@@ -3,9 +3,9 @@ package ui
 import (
 	"fmt"
 	"log"
-	"strconv"
 	"strings"
 
+	"github.com/ackhia/flash/models"
 	"github.com/ackhia/flash/node"
 	"github.com/atotto/clipboard"
 	"github.com/charmbracelet/bubbles/table"
@@ -22,29 +22,46 @@ const (
 	myNodePage
 	sendTransactionPage
 	viewPeersPage
+	reconciliationsPage
+	transactionsPage
 )
 
 type Model struct {
-	currentPage    page
-	menuOptions    []string
-	selectedOption int
-	peerIDInput    textinput.Model
-	amountInput    textinput.Model
-	table          table.Model
-	viewport       viewport.Model
-	peerID         string
-	peerMA         string
-	balance        float64
-	connectedPeers int
-	totalCoins     float64
-	peers          []peer
-	node           *node.Node
-	message        string
+	currentPage     page
+	menuOptions     []string
+	selectedOption  int
+	peerIDInput     textinput.Model
+	amountInput     textinput.Model
+	table           table.Model
+	viewport        viewport.Model
+	peerID          string
+	peerMA          string
+	networkID       string
+	stateRoot       string
+	antiEntropy     node.AntiEntropyStats
+	balance         models.Amount
+	available       models.Amount
+	pending         models.Amount
+	head            models.AccountHead
+	checkpoint      string
+	connectedPeers  int
+	totalCoins      models.Amount
+	peers           []peer
+	reconciliations []models.Reconciliation
+	txStatuses      []models.TxStatus
+	receivedTxs     []models.LedgerTx
+	node            *node.Node
+	message         string
 }
 
+// nodeEventMsg tells the model the node changed so the page is redrawn
+// without waiting for a key press
+type nodeEventMsg struct{}
+
 type peer struct {
 	ID      string
-	Balance float64
+	Balance models.Amount
+	Frozen  bool
 }
 
 func initialModel() Model {
@@ -52,11 +69,14 @@ func initialModel() Model {
 		"My Node",
 		"Send Transaction",
 		"View Peers",
+		"Reconciliations",
+		"Transactions",
 	}
 
 	columns := []table.Column{
 		{Title: "Peer ID", Width: 30},
 		{Title: "Balance", Width: 10},
+		{Title: "Status", Width: 10},
 	}
 	t := table.New(
 		table.WithColumns(columns),
@@ -82,8 +102,8 @@ func initialModel() Model {
 		connectedPeers: 0,
 		totalCoins:     0,
 		peers: []peer{
-			{"peer1", 50.0},
-			{"peer2", 30.0},
+			{"peer1", 50, false},
+			{"peer2", 30, false},
 		},
 		message: "",
 	}
@@ -96,6 +116,8 @@ func (m *Model) Init() tea.Cmd {
 
 func (m *Model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 	switch msg := msg.(type) {
+	case nodeEventMsg:
+		m.refreshModel()
 	case tea.KeyMsg:
 		switch msg.String() {
 		case "q":
@@ -126,12 +148,12 @@ func (m *Model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 					amount := strings.TrimSpace(m.amountInput.Value())
 					if peerID != "" && amount != "" {
 						// Simulate transaction success/failure
-						err := m.sendTransaction(peerID, amount)
+						coverage, err := m.sendTransaction(peerID, amount)
 						if err != nil {
 							m.message = "Transaction failed. See log for details"
 							log.Print(err)
 						} else {
-							m.message = "Transaction sent"
+							m.message = fmt.Sprintf("Transaction sent, committed by %d of %d peers", len(coverage.Acked), len(coverage.Acked)+len(coverage.Pending))
 						}
 						m.peerIDInput.SetValue("")
 						m.amountInput.SetValue("")
@@ -200,6 +222,10 @@ Fast // Feeless // Secure
 		return m.viewSendTransaction()
 	case viewPeersPage:
 		return m.viewPeers()
+	case reconciliationsPage:
+		return m.viewReconciliations()
+	case transactionsPage:
+		return m.viewTransactions()
 	}
 	return ""
 }
@@ -220,12 +246,19 @@ func (m Model) viewMainMenu() string {
 
 func (m Model) viewMyNode() string {
 	return fmt.Sprintf(
-		"My Node:\n\n%-30s %s\n%-30s %s\n%-30s %.2f\n%-30s %d\n%-30s %.2f\n\nPress ESC to go back. Press c to copy Peer Multiaddress to clipboard",
+		"My Node:\n\n%-30s %s\n%-30s %s\n%-30s %s\n%-30s %s\n%-30s %s\n%-30s %s\n%-30s %s\n%-30s %s\n%-30s %d\n%-30s %s\n%-30s %s\n%-30s %s\n\nPress ESC to go back. Press c to copy Peer Multiaddress to clipboard",
 		"Peer ID:", m.peerID,
 		"Peer Multiaddress:", m.peerMA,
+		"Network ID:", m.networkID,
+		"State Root:", m.stateRoot,
 		"Balance:", m.balance,
+		"Available:", m.available,
+		"Pending Balance:", m.pending,
+		"Committed/Next Sequence:", fmt.Sprintf("%d/%d", m.head.Committed, m.head.Next),
 		"Connected Peers:", m.connectedPeers,
 		"Coins in Circulation:", m.totalCoins,
+		"Divergence Found/Repaired:", fmt.Sprintf("%d/%d", m.antiEntropy.DivergenceFound, m.antiEntropy.Repaired),
+		"Latest Checkpoint:", m.checkpoint,
 	)
 }
 
@@ -243,23 +276,105 @@ func (m Model) viewSendTransaction() string {
 func (m Model) viewPeers() string {
 	rows := []table.Row{}
 	for _, p := range m.peers {
-		rows = append(rows, table.Row{p.ID, fmt.Sprintf("%.2f", p.Balance)})
+		status := ""
+		if p.Frozen {
+			status = "Frozen"
+		}
+		rows = append(rows, table.Row{p.ID, p.Balance.String(), status})
 	}
 	m.table.SetCursor(-1)
 	m.table.SetRows(rows)
 	return fmt.Sprintf("Peers:\n\n%s\n\nPress ESC to go back.", m.table.View())
 }
 
+func (m Model) viewReconciliations() string {
+	var sb strings.Builder
+	sb.WriteString("Reconciliations:\n\n")
+	if len(m.reconciliations) == 0 {
+		sb.WriteString("No conflicting transactions seen\n")
+	}
+
+	//Newest first
+	for i := len(m.reconciliations) - 1; i >= 0; i-- {
+		r := m.reconciliations[i]
+		sb.WriteString(fmt.Sprintf("%s  %s #%d\n", r.Time.Format("2006-01-02 15:04:05"), r.From, r.SequenceNum))
+		sb.WriteString(fmt.Sprintf("    %s\n    kept %s\n", r.Reason, r.Kept))
+		for _, id := range r.Dropped {
+			sb.WriteString(fmt.Sprintf("    dropped %s\n", id))
+		}
+		for _, id := range r.DoubleSigners {
+			sb.WriteString(fmt.Sprintf("    signed both %s\n", id))
+		}
+	}
+
+	sb.WriteString("\nPress ESC to go back.")
+	return sb.String()
+}
+
+func (m Model) viewTransactions() string {
+	var sb strings.Builder
+	sb.WriteString("Transactions:\n\n")
+	if len(m.txStatuses) == 0 {
+		sb.WriteString("No transactions sent\n")
+	}
+
+	//Newest first
+	for i := len(m.txStatuses) - 1; i >= 0; i-- {
+		s := m.txStatuses[i]
+		updated := s.History[len(s.History)-1].Time
+		sb.WriteString(fmt.Sprintf("%s  %s to %s #%d\n", updated.Format("2006-01-02 15:04:05"), s.Tx.Amount, s.Tx.To, s.Tx.SequenceNum))
+		sb.WriteString(fmt.Sprintf("    %s\n    %s\n", s.State, s.Tx.ID()))
+		if s.Error != "" {
+			sb.WriteString(fmt.Sprintf("    %s\n", s.Error))
+		}
+	}
+
+	sb.WriteString("\nReceived:\n\n")
+	if len(m.receivedTxs) == 0 {
+		sb.WriteString("No transactions received\n")
+	}
+
+	//Newest first
+	for i := len(m.receivedTxs) - 1; i >= 0; i-- {
+		r := m.receivedTxs[i]
+		state := "pending"
+		if r.Tx.Comitted {
+			state = "committed"
+		}
+		sb.WriteString(fmt.Sprintf("%s  %s from %s #%d\n", r.Received.Format("2006-01-02 15:04:05"), r.Tx.Amount, r.Tx.From, r.Tx.SequenceNum))
+		sb.WriteString(fmt.Sprintf("    %s\n    %s\n", state, r.Tx.ID()))
+	}
+
+	sb.WriteString("\nPress ESC to go back.")
+	return sb.String()
+}
+
 func (m *Model) refreshModel() {
 	m.peerID = m.node.Host.ID().String()
-	m.balance = m.node.Balances[m.node.Host.ID().String()]
+	m.networkID = m.node.NetworkID().String()
+	m.stateRoot = m.node.StateRoot().String()
+	m.antiEntropy = m.node.AntiEntropyStats()
+	balances := m.node.Balances()
+	frozen := m.node.FrozenAccounts()
+	m.balance = balances[m.node.Host.ID().String()]
+	m.available = m.node.AvailableBalance(m.node.Host.ID().String())
+	m.pending = m.node.PendingBalance(m.node.Host.ID().String())
+	m.head = m.node.AccountHead(m.node.Host.ID().String())
+	m.checkpoint = "none"
+	if cp, ok := m.node.LatestCheckpoint(); ok {
+		m.checkpoint = fmt.Sprintf("%d at height %d", cp.Number, cp.Height())
+	}
 	m.totalCoins = m.node.TotalCoins
 	m.connectedPeers = len(m.node.Host.Network().Peers())
+	m.reconciliations = m.node.Reconciliations()
+	m.txStatuses = m.node.TxStatuses()
+	m.receivedTxs = m.node.TxsTo(m.node.Host.ID().String())
 	m.peers = []peer{}
 	for _, p := range m.node.Host.Network().Peers() {
 		m.peers = append(m.peers, peer{
 			ID:      p.String(),
-			Balance: m.node.Balances[p.String()],
+			Balance: balances[p.String()],
+			Frozen:  !frozen[p.String()].IsZero(),
 		})
 	}
 
@@ -275,21 +390,26 @@ func Show(n *node.Node) {
 	m := initialModel()
 	m.node = n
 	p := tea.NewProgram(&m)
+
+	sub := n.Subscribe(node.EventFilter{})
+	defer sub.Unsubscribe()
+	go func() {
+		for range sub.C {
+			p.Send(nodeEventMsg{})
+		}
+	}()
+
 	if _, err := p.Run(); err != nil {
 		log.Fatalf("Error running program: %v", err)
 	}
 }
 
-func (m Model) sendTransaction(peerID, amount string) error {
+func (m *Model) sendTransaction(peerID, amount string) (*node.CommitCoverage, error) {
 
-	amountFloat, err := strconv.ParseFloat(amount, 64)
-	if err != nil {
-		return fmt.Errorf("invalid amount")
-	}
-	err = m.node.Transfer(peerID, amountFloat)
+	parsedAmount, err := models.ParseAmount(amount)
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("invalid amount: %v", err)
 	}
 
-	return nil
+	return m.node.Transfer(peerID, parsedAmount)
 }